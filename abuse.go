@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+)
+
+// Sustained-volume abuse detection. A sender exceeding abuseMaxMessages
+// within abuseWindow earns a strike; successive strikes escalate from a
+// warning to a temporary send suspension to disconnection.
+var (
+	abuseMaxMessages = envInt("ABUSE_MAX_MESSAGES", 0) // Messages allowed per window; 0 disables the check
+	abuseWindow      = envDuration("ABUSE_WINDOW", 10*time.Minute)
+	abuseSuspension  = envDuration("ABUSE_SUSPENSION", time.Minute) // Send suspension imposed on the second strike
+)
+
+// abuseAction is the outcome of recording one message.
+type abuseAction int
+
+const (
+	abuseAllow      abuseAction = iota // Under the limit
+	abuseWarn                          // First strike: the message goes through with a warning
+	abuseSuspend                       // Second strike, or sending while suspended: the message is rejected
+	abuseDisconnect                    // Third strike: the connection is closed
+)
+
+// abuseTracker keeps the send times of one connection within the window.
+// Each strike clears the window, so escalating further takes another full
+// batch of messages over the limit. It is owned by a single connection's
+// read loop and is not goroutine-safe.
+type abuseTracker struct {
+	sent           []time.Time
+	strikes        int
+	suspendedUntil time.Time
+}
+
+func newAbuseTracker() *abuseTracker {
+	return &abuseTracker{}
+}
+
+// Record notes a message sent at now and returns what to do about it.
+func (t *abuseTracker) Record(now time.Time) abuseAction {
+	if abuseMaxMessages <= 0 {
+		return abuseAllow
+	}
+	if now.Before(t.suspendedUntil) {
+		return abuseSuspend
+	}
+
+	// Drop send times that have slid out of the window
+	cutoff := now.Add(-abuseWindow)
+	i := 0
+	for i < len(t.sent) && !t.sent[i].After(cutoff) {
+		i++
+	}
+	t.sent = append(t.sent[i:], now)
+
+	if len(t.sent) <= abuseMaxMessages {
+		return abuseAllow
+	}
+
+	t.sent = t.sent[:0]
+	t.strikes++
+	switch t.strikes {
+	case 1:
+		return abuseWarn
+	case 2:
+		t.suspendedUntil = now.Add(abuseSuspension)
+		return abuseSuspend
+	default:
+		return abuseDisconnect
+	}
+}
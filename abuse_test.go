@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// withAbuseLimits sets the abuse settings for one test.
+func withAbuseLimits(t *testing.T, max int, window, suspension time.Duration) {
+	t.Helper()
+	savedMax, savedWindow, savedSuspension := abuseMaxMessages, abuseWindow, abuseSuspension
+	t.Cleanup(func() { abuseMaxMessages, abuseWindow, abuseSuspension = savedMax, savedWindow, savedSuspension })
+	abuseMaxMessages, abuseWindow, abuseSuspension = max, window, suspension
+}
+
+func TestAbuseTrackerEscalation(t *testing.T) {
+	withAbuseLimits(t, 3, time.Minute, 30*time.Second)
+	tracker := newAbuseTracker()
+	now := time.Unix(1_700_000_000, 0)
+
+	// record sends n messages a second apart and returns the last action
+	record := func(n int) abuseAction {
+		var action abuseAction
+		for i := 0; i < n; i++ {
+			now = now.Add(time.Second)
+			action = tracker.Record(now)
+		}
+		return action
+	}
+
+	if got := record(3); got != abuseAllow {
+		t.Fatalf("at the limit: %v, want allow", got)
+	}
+	if got := record(1); got != abuseWarn {
+		t.Fatalf("first strike: %v, want warn", got)
+	}
+	// The strike cleared the window, so a new batch is needed to escalate
+	if got := record(3); got != abuseAllow {
+		t.Fatalf("after the warning: %v, want allow", got)
+	}
+	if got := record(1); got != abuseSuspend {
+		t.Fatalf("second strike: %v, want suspend", got)
+	}
+	// Sending during the suspension is refused without counting
+	if got := record(5); got != abuseSuspend {
+		t.Fatalf("while suspended: %v, want suspend", got)
+	}
+	now = now.Add(30 * time.Second)
+	if got := record(3); got != abuseAllow {
+		t.Fatalf("after the suspension: %v, want allow", got)
+	}
+	if got := record(1); got != abuseDisconnect {
+		t.Fatalf("third strike: %v, want disconnect", got)
+	}
+}
+
+func TestAbuseTrackerWindowSlides(t *testing.T) {
+	withAbuseLimits(t, 3, time.Minute, time.Minute)
+	tracker := newAbuseTracker()
+	start := time.Unix(1_700_000_000, 0)
+
+	for i := 0; i < 3; i++ {
+		tracker.Record(start.Add(time.Duration(i) * time.Second))
+	}
+	// The first send has left the window by now, so this is the third in it
+	if got := tracker.Record(start.Add(time.Minute)); got != abuseAllow {
+		t.Errorf("after the oldest send expired: %v, want allow", got)
+	}
+	if got := tracker.Record(start.Add(time.Minute + time.Second/2)); got != abuseWarn {
+		t.Errorf("fourth send within a minute: %v, want warn", got)
+	}
+}
+
+func TestAbuseTrackerDisabled(t *testing.T) {
+	withAbuseLimits(t, 0, time.Minute, time.Minute)
+	tracker := newAbuseTracker()
+	now := time.Unix(1_700_000_000, 0)
+	for i := 0; i < 1000; i++ {
+		if got := tracker.Record(now); got != abuseAllow {
+			t.Fatalf("send %d with the check disabled: %v", i, got)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Delivery acks. A connection with the deliveryAcks capability confirms each
+// direct message it receives with a received frame, and a message only
+// counts as delivered once confirmed. An unconfirmed message is written
+// again after ackTimeout, doubling the wait after each retry; after
+// ackMaxRetries it is given up on and left undelivered in MongoDB, to be
+// replayed when the device next connects.
+var (
+	ackTimeout    = envDuration("ACK_TIMEOUT", 10*time.Second) // Wait for a received frame before the first retry
+	ackMaxRetries = envInt("ACK_MAX_RETRIES", 3)               // Retries before falling back to replay on reconnect
+	ackQueueSize  = envInt("ACK_QUEUE_SIZE", 100)              // Unconfirmed messages tracked per connection
+)
+
+func init() {
+	if ackTimeout <= 0 || ackMaxRetries < 0 || ackQueueSize <= 0 {
+		log.Fatalf("ACK_TIMEOUT (%s) and ACK_QUEUE_SIZE (%d) must be positive and ACK_MAX_RETRIES (%d) not negative", ackTimeout, ackQueueSize, ackMaxRetries)
+	}
+}
+
+// receivedRequest is the data of an inbound received frame.
+type receivedRequest struct {
+	MessageIDs []int64 `json:"messageIds"`
+}
+
+// ackTracker holds the messages written to one connection that its client
+// has yet to confirm, each with the timer of its next retry.
+type ackTracker struct {
+	mu      sync.Mutex
+	pending map[int64]*unacked
+	stopped bool
+}
+
+// unacked is a message awaiting its received frame.
+type unacked struct {
+	message Message
+	retries int // Retries written so far
+	timer   *time.Timer
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{pending: make(map[int64]*unacked)}
+}
+
+// track starts waiting for c to confirm message. When the queue is full the
+// message is not tracked, and so stays undelivered for replay.
+func (t *ackTracker) track(c *connEntry, message Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || t.pending[message.ID] != nil {
+		return
+	}
+	if len(t.pending) >= ackQueueSize {
+		slog.Warn("Ack queue full, message left for replay", "user_id", c.userID, "conn_id", c.connID, "message_id", message.ID)
+		return
+	}
+	t.pending[message.ID] = &unacked{
+		message: message,
+		timer:   time.AfterFunc(ackTimeout, func() { t.retry(c, message.ID) }),
+	}
+}
+
+// retry writes an unconfirmed message again, or gives up on it once it has
+// used up its retries.
+func (t *ackTracker) retry(c *connEntry, id int64) {
+	t.mu.Lock()
+	u := t.pending[id]
+	if t.stopped || u == nil {
+		t.mu.Unlock()
+		return
+	}
+	if u.retries >= ackMaxRetries {
+		delete(t.pending, id)
+		t.mu.Unlock()
+		slog.Info("Message not acknowledged, left for replay", "user_id", c.userID, "conn_id", c.connID, "message_id", id)
+		return
+	}
+	u.retries++
+	u.timer = time.AfterFunc(ackTimeout<<u.retries, func() { t.retry(c, id) })
+	message := u.message
+	t.mu.Unlock()
+
+	writeToSocket(c, message)
+}
+
+// acknowledge stops tracking the given messages and returns the ones that
+// were awaiting confirmation. Unknown IDs are ignored.
+func (t *ackTracker) acknowledge(ids []int64) []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var confirmed []Message
+	for _, id := range ids {
+		if u := t.pending[id]; u != nil {
+			u.timer.Stop()
+			delete(t.pending, id)
+			confirmed = append(confirmed, u.message)
+		}
+	}
+	return confirmed
+}
+
+// stop cancels every pending retry when the connection ends. Unconfirmed
+// messages stay undelivered for replay. A nil tracker is a no-op.
+func (t *ackTracker) stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	for id, u := range t.pending {
+		u.timer.Stop()
+		delete(t.pending, id)
+	}
+}
+
+// settleDirect records that direct messages to its user reached c: right
+// away, or once the client confirms them if c uses delivery acks.
+func settleDirect(c *connEntry, messages []Message) {
+	if c.acks == nil {
+		recordDelivered(c, messages)
+		return
+	}
+	for _, message := range messages {
+		c.acks.track(c, message)
+	}
+}
+
+// handleReceived marks the messages a client with delivery acks confirmed as
+// delivered. Only messages written to this connection and still awaiting
+// confirmation are affected; other IDs are ignored.
+func (s *session) handleReceived(data []byte) bool {
+	if s.client.acks == nil {
+		return s.reject("acks_not_enabled")
+	}
+	if reason := s.checkWrite(); reason != "" {
+		return s.reject(reason)
+	}
+	var req receivedRequest
+	if err := json.Unmarshal(data, &req); err != nil || len(req.MessageIDs) == 0 {
+		return s.reject("invalid_received")
+	}
+	if len(req.MessageIDs) > maxReadBatch {
+		return s.reject("too_many_ids")
+	}
+
+	confirmed := s.client.acks.acknowledge(req.MessageIDs)
+	recordDelivered(s.client, confirmed)
+
+	// Like reads, confirmations are only answered when asked to correlate
+	if s.requestID == "" {
+		return true
+	}
+	ids := make([]int64, 0, len(confirmed))
+	for _, message := range confirmed {
+		ids = append(ids, message.ID)
+	}
+	return s.reply(Frame{Type: envelopeAck, Data: receivedRequest{MessageIDs: ids}})
+}
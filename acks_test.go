@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// useAckSettings shortens the delivery ack settings for a test.
+func useAckSettings(t *testing.T, timeout time.Duration, retries, queueSize int) {
+	t.Helper()
+	savedTimeout, savedRetries, savedSize := ackTimeout, ackMaxRetries, ackQueueSize
+	ackTimeout, ackMaxRetries, ackQueueSize = timeout, retries, queueSize
+	t.Cleanup(func() { ackTimeout, ackMaxRetries, ackQueueSize = savedTimeout, savedRetries, savedSize })
+}
+
+func TestAckTrackerRetriesThenGivesUp(t *testing.T) {
+	useAckSettings(t, 20*time.Millisecond, 2, 10)
+	entry, client := newTestConn(t, &JWTClaims{ID: 41}, nil)
+	entry.acks = newAckTracker()
+	t.Cleanup(entry.acks.stop)
+
+	entry.acks.track(entry, Message{ID: 5, SenderID: 42, RecipientID: 41, Content: "hi"})
+	start := time.Now()
+	for retry := 1; retry <= 2; retry++ {
+		if got := readMessage(t, client); got.ID != 5 {
+			t.Fatalf("retry %d wrote message %d, want 5", retry, got.ID)
+		}
+	}
+	// Waits of 20ms, then 40ms: the second retry comes after 60ms
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("two retries took %s, want backoff of at least 60ms", elapsed)
+	}
+
+	time.Sleep(120 * time.Millisecond) // Past the last 80ms wait
+	if confirmed := entry.acks.acknowledge([]int64{5}); len(confirmed) != 0 {
+		t.Errorf("message still tracked after its retries ran out")
+	}
+	expectNoFrame(t, client)
+}
+
+func TestAckTrackerQueueBound(t *testing.T) {
+	useAckSettings(t, time.Minute, 3, 2)
+	entry, _ := newTestConn(t, &JWTClaims{ID: 41}, nil)
+	entry.acks = newAckTracker()
+	t.Cleanup(entry.acks.stop)
+
+	for id := int64(1); id <= 3; id++ {
+		entry.acks.track(entry, Message{ID: id, RecipientID: 41})
+	}
+	confirmed := entry.acks.acknowledge([]int64{1, 2, 3})
+	if len(confirmed) != 2 || confirmed[0].ID != 1 || confirmed[1].ID != 2 {
+		t.Errorf("confirmed %v, want the first two messages only", confirmed)
+	}
+}
+
+func TestReceivedMarksDelivered(t *testing.T) {
+	useTestDB(t)
+	useAckSettings(t, time.Minute, 3, 10)
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	entry.acks = newAckTracker()
+	t.Cleanup(entry.acks.stop)
+	hub.Register(entry)
+	t.Cleanup(func() { hub.Unregister(entry) })
+
+	ctx := context.Background()
+	stored, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "hi"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	deliverMessage(stored)
+	if got := readMessage(t, client); got.ID != stored.ID {
+		t.Fatalf("got message %d, want %d", got.ID, stored.ID)
+	}
+
+	delivered := func() bool {
+		t.Helper()
+		var message Message
+		if err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: stored.ID}}).Decode(&message); err != nil {
+			t.Fatalf("loading message: %v", err)
+		}
+		return message.Delivered && message.Status == statusDelivered
+	}
+	if delivered() {
+		t.Fatal("message marked delivered before the client confirmed it")
+	}
+
+	s := newSession(ctx, entry, claims)
+	if !s.handleFrame([]byte(fmt.Sprintf(`{"type":"received","data":{"messageIds":[%d]}}`, stored.ID))) {
+		t.Fatal("received frame ended the session")
+	}
+	if !delivered() {
+		t.Error("message not marked delivered after the client confirmed it")
+	}
+	expectNoFrame(t, client)
+}
+
+func TestReceivedWithoutAcks(t *testing.T) {
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+	s.handleFrame([]byte(`{"type":"received","data":{"messageIds":[1]}}`))
+	if reason := readErrorReason(t, client); reason != "acks_not_enabled" {
+		t.Errorf("reason = %q, want acks_not_enabled", reason)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"sync/atomic"
+)
+
+// AnalyticsEvent is the metadata of one message, emitted for analytics.
+// Content is only filled in when ANALYTICS_INCLUDE_CONTENT is enabled.
+type AnalyticsEvent struct {
+	Type        string `json:"type"`              // Kind of message, e.g. "message"
+	MessageID   int64  `json:"messageId"`         // Sequence ID of the stored message
+	Tenant      string `json:"tenant"`            // Tenant the message belongs to
+	SenderID    int64  `json:"senderId"`          // Sender of the message
+	RecipientID int64  `json:"recipientId"`       // Recipient of the message
+	Size        int    `json:"size"`              // Content length in bytes
+	Timestamp   int64  `json:"timestamp"`         // Server timestamp of the message
+	Content     string `json:"content,omitempty"` // Message content, only for compliance setups
+}
+
+// AnalyticsSink receives message events off the delivery path. A Kafka or
+// HTTP sink can be plugged in here.
+type AnalyticsSink interface {
+	Emit(ctx context.Context, event AnalyticsEvent) error
+}
+
+// noopAnalytics is the default sink and discards every event.
+type noopAnalytics struct{}
+
+func (noopAnalytics) Emit(ctx context.Context, event AnalyticsEvent) error { return nil }
+
+// loggingAnalytics logs events, useful to check the tap before wiring a real sink.
+type loggingAnalytics struct{}
+
+func (loggingAnalytics) Emit(ctx context.Context, event AnalyticsEvent) error {
+	if redactSensitive {
+		event.Content = ""
+	}
+	slog.Info("Analytics event", "event", event)
+	return nil
+}
+
+var (
+	analyticsSink           = newAnalyticsSink(envString("ANALYTICS_SINK", "noop"))
+	analyticsIncludeContent = envBool("ANALYTICS_INCLUDE_CONTENT", false)
+	analyticsEvents         = make(chan AnalyticsEvent, envInt("ANALYTICS_BUFFER", 1024))
+	analyticsDropped        atomic.Int64 // Events dropped because the buffer was full
+)
+
+func newAnalyticsSink(name string) AnalyticsSink {
+	switch name {
+	case "noop":
+		return noopAnalytics{}
+	case "log":
+		return loggingAnalytics{}
+	default:
+		log.Fatalf("Unknown ANALYTICS_SINK %q", name)
+		return nil
+	}
+}
+
+// analyticsEnabled reports whether events are worth collecting at all.
+func analyticsEnabled() bool {
+	_, noop := analyticsSink.(noopAnalytics)
+	return !noop
+}
+
+// emitMessageEvent queues an event for a stored message. It never blocks:
+// when the buffer is full the event is dropped and counted.
+func emitMessageEvent(message Message) {
+	if !analyticsEnabled() {
+		return
+	}
+
+	event := AnalyticsEvent{
+		Type:        "message",
+		MessageID:   message.ID,
+		Tenant:      message.Tenant,
+		SenderID:    message.SenderID,
+		RecipientID: message.RecipientID,
+		Size:        len(message.Content),
+		Timestamp:   message.Timestamp,
+	}
+	if analyticsIncludeContent {
+		event.Content = message.Content
+	}
+
+	select {
+	case analyticsEvents <- event:
+	default:
+		if n := analyticsDropped.Add(1); n%1000 == 1 {
+			slog.Warn("Analytics buffer full", "dropped_total", n)
+		}
+	}
+}
+
+// runAnalytics hands queued events to the sink until ctx is canceled.
+func runAnalytics(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-analyticsEvents:
+			if err := analyticsSink.Emit(ctx, event); err != nil {
+				slog.Error("Analytics emit error", "message_id", event.MessageID, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// maxBlobBytes caps the size of one attachment. Attachments are only
+// accepted when ALLOWED_FRAME_TYPES includes binary.
+var maxBlobBytes = int64(envInt("MAX_BLOB_BYTES", 5<<20))
+
+// Attachment references the stored blob of an attachment message.
+type Attachment struct {
+	ID          string `bson:"id" json:"id"`                   // Blob store ID
+	ContentType string `bson:"contentType" json:"contentType"` // MIME type announced by the sender
+	Size        int64  `bson:"size" json:"size"`               // Blob size in bytes
+	URL         string `bson:"url" json:"url"`                 // Where participants can download the blob
+}
+
+// BlobStore keeps attachment bodies out of the message documents.
+type BlobStore interface {
+	Put(ctx context.Context, tenant, contentType string, data []byte) (id string, err error)
+	Get(ctx context.Context, id string) ([]byte, error) // Returns errBlobNotFound for unknown IDs
+	Delete(ctx context.Context, id string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+var blobStore BlobStore // Set by connectMongoDB
+
+// gridFSBlobStore stores blobs in the default GridFS bucket of the database.
+type gridFSBlobStore struct {
+	bucket *mongo.GridFSBucket
+}
+
+func newGridFSBlobStore(db *mongo.Database) *gridFSBlobStore {
+	return &gridFSBlobStore{bucket: db.GridFSBucket()}
+}
+
+func (g *gridFSBlobStore) Put(ctx context.Context, tenant, contentType string, data []byte) (string, error) {
+	metadata := bson.D{{Key: "tenant", Value: tenant}, {Key: "contentType", Value: contentType}}
+	opts := options.GridFSUpload().SetMetadata(metadata)
+	id, err := g.bucket.UploadFromStream(ctx, "attachment", bytes.NewReader(data), opts)
+	if err != nil {
+		return "", err
+	}
+	return id.Hex(), nil
+}
+
+func (g *gridFSBlobStore) Get(ctx context.Context, id string) ([]byte, error) {
+	fileID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errBlobNotFound
+	}
+	var buf bytes.Buffer
+	if _, err := g.bucket.DownloadToStream(ctx, fileID, &buf); err != nil {
+		if errors.Is(err, mongo.ErrFileNotFound) {
+			return nil, errBlobNotFound
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *gridFSBlobStore) Delete(ctx context.Context, id string) error {
+	fileID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return errBlobNotFound
+	}
+	err = g.bucket.Delete(ctx, fileID)
+	if errors.Is(err, mongo.ErrFileNotFound) {
+		return errBlobNotFound
+	}
+	return err
+}
+
+// attachmentHeader is the data of an attachment frame. It addresses the
+// binary frame that follows it, which carries the blob itself.
+type attachmentHeader struct {
+	RecipientID  int64  `json:"recipientId"`
+	RoomID       int64  `json:"roomId"`
+	ContentType  string `json:"contentType"`
+	ClientMsgID  string `json:"clientMsgId"`
+	ClientTempID string `json:"clientTempId"`
+	requestID    string // Of the header frame, echoed on the ack of the attachment
+}
+
+// handleAttachmentHeader remembers an announced attachment until its
+// binary frame arrives. A new announcement replaces an unused one.
+func (s *session) handleAttachmentHeader(data []byte) bool {
+	var header attachmentHeader
+	if err := json.Unmarshal(data, &header); err != nil || strings.TrimSpace(header.ContentType) == "" {
+		return s.reject("invalid_attachment")
+	}
+	header.requestID = s.requestID
+	s.attachment = &header
+	return true
+}
+
+// handleAttachment stores a binary frame as the blob of the announced
+// attachment and sends it as a message of type "attachment". readInbound
+// has already held the frame to maxBlobBytes.
+func (s *session) handleAttachment(data []byte) bool {
+	header := s.attachment
+	s.attachment = nil
+	s.requestID = ""
+	if header == nil {
+		return s.reject("attachment_not_announced")
+	}
+	s.requestID = header.requestID
+
+	message := Message{
+		RecipientID:  header.RecipientID,
+		RoomID:       header.RoomID,
+		ClientMsgID:  header.ClientMsgID,
+		ClientTempID: header.ClientTempID,
+		Type:         typeAttachment,
+	}
+	upload := func(m *Message) error {
+		ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+		defer cancel()
+		return storeAttachment(ctx, blobStore, m, header.ContentType, data)
+	}
+	return s.sendMessage(message, upload)
+}
+
+// storeAttachment puts data into store and points the message at the blob.
+func storeAttachment(ctx context.Context, store BlobStore, m *Message, contentType string, data []byte) error {
+	id, err := store.Put(ctx, m.Tenant, contentType, data)
+	if err != nil {
+		return err
+	}
+	m.Attachment = &Attachment{
+		ID:          id,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		URL:         "/attachments?id=" + id,
+	}
+	return nil
+}
+
+// attachmentHandler serves GET /attachments?id=, the blob of an attachment
+// message. Only the participants of that message may download it.
+func attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET")
+		return
+	}
+
+	claims, err := validateJWTToken(bearerToken(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "id", "id is required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	// The blob is reachable only through a live message of the caller's tenant
+	var message Message
+	filter := bson.D{{Key: "tenant", Value: claims.TenantID()}, {Key: "attachment.id", Value: id}}
+	err = collection.FindOne(ctx, filter).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(w, http.StatusNotFound, "not_found", "No such attachment")
+		return
+	}
+	if err != nil {
+		slog.Error("Attachment lookup error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load attachment")
+		return
+	}
+
+	allowed := message.SenderID == claims.ID || message.RecipientID == claims.ID
+	if message.RoomID != 0 {
+		allowed, err = isRoomMember(ctx, claims.TenantID(), claims.ID, message.RoomID)
+		if err != nil {
+			slog.Error("Room membership check error", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load attachment")
+			return
+		}
+	}
+	if !allowed {
+		writeError(w, http.StatusNotFound, "not_found", "No such attachment")
+		return
+	}
+
+	data, err := blobStore.Get(ctx, id)
+	if errors.Is(err, errBlobNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "No such attachment")
+		return
+	}
+	if err != nil {
+		slog.Error("Attachment download error", "message_id", message.ID, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load attachment")
+		return
+	}
+
+	// The content type is sender-supplied, so never let it run as a page
+	w.Header().Set("Content-Type", message.Attachment.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		slog.Warn("Response write error", "error", err)
+	}
+}
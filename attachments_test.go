@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// memoryBlobStore is a BlobStore kept in memory.
+type memoryBlobStore struct {
+	mu      sync.Mutex
+	next    int
+	blobs   map[string][]byte
+	tenants map[string]string
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: map[string][]byte{}, tenants: map[string]string{}}
+}
+
+func (m *memoryBlobStore) Put(_ context.Context, tenant, _ string, data []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	id := strconv.Itoa(m.next)
+	m.blobs[id] = bytes.Clone(data)
+	m.tenants[id] = tenant
+	return id, nil
+}
+
+func (m *memoryBlobStore) Get(_ context.Context, id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[id]
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	return data, nil
+}
+
+func (m *memoryBlobStore) Delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.blobs[id]; !ok {
+		return errBlobNotFound
+	}
+	delete(m.blobs, id)
+	delete(m.tenants, id)
+	return nil
+}
+
+func TestStoreAttachment(t *testing.T) {
+	useTestDB(t)
+	store := newMemoryBlobStore()
+	blobStore = store
+
+	claims := &JWTClaims{ID: 1, Tenant: "acme"}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+
+	// The header frame announces the binary frame that follows it
+	if !s.handleFrame([]byte(`{"type":"attachment","data":{"recipientId":2,"contentType":"image/png","clientTempId":"t1"}}`)) {
+		t.Fatal("header frame ended the session")
+	}
+	data := []byte("\x89PNG fake image")
+	if !s.handleAttachment(data) {
+		t.Fatal("binary frame ended the session")
+	}
+
+	frameType, raw := readFrame(t, client)
+	var ack ackEvent
+	if err := json.Unmarshal(raw, &ack); frameType != envelopeAck || err != nil || ack.ClientTempID != "t1" {
+		t.Fatalf("got %s frame %s, want an ack for t1", frameType, raw)
+	}
+
+	var message Message
+	if err := collection.FindOne(context.Background(), bson.D{{Key: "_id", Value: ack.ID}}).Decode(&message); err != nil {
+		t.Fatalf("stored message: %v", err)
+	}
+	if message.Type != typeAttachment || message.SenderID != 1 || message.RecipientID != 2 || message.Tenant != "acme" {
+		t.Errorf("stored message = %+v", message)
+	}
+	a := message.Attachment
+	if a == nil {
+		t.Fatal("message has no attachment reference")
+	}
+	if a.ContentType != "image/png" || a.Size != int64(len(data)) || a.URL != "/attachments?id="+a.ID {
+		t.Errorf("attachment = %+v", *a)
+	}
+	got, err := store.Get(context.Background(), a.ID)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get(%q) = %q, %v; want the uploaded data", a.ID, got, err)
+	}
+	if tenant := store.tenants[a.ID]; tenant != "acme" {
+		t.Errorf("blob tenant = %q, want acme", tenant)
+	}
+}
+
+func TestAttachmentNotAnnounced(t *testing.T) {
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+
+	if !s.handleAttachment([]byte("data")) {
+		t.Fatal("handleAttachment ended the session")
+	}
+	if reason := readErrorReason(t, client); reason != "attachment_not_announced" {
+		t.Errorf("reason = %q, want attachment_not_announced", reason)
+	}
+}
+
+func TestValidateMessageAttachmentWithoutContent(t *testing.T) {
+	attachment := Message{SenderID: 1, RecipientID: 2, Type: typeAttachment}
+	if _, err := validateMessage(context.Background(), attachment); err != nil {
+		t.Errorf("attachment without content: %v", err)
+	}
+
+	text := Message{SenderID: 1, RecipientID: 2}
+	_, err := validateMessage(context.Background(), text)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Reason != "missing_fields" {
+		t.Errorf("text without content: err = %v, want missing_fields", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Live delivery batching spares bandwidth-constrained clients a frame per
+// message. A connection with the batching capability gets the live
+// messages arriving within batchWindow of the first one as a single
+// messages frame, in arrival order. Like messages held during catch-up, a
+// batched message is settled once its batch is written: direct messages
+// count as delivered then, or with delivery acks once the client confirms
+// them, and room cursors move past the room messages. Typing and presence
+// frames are written at once; any other frame first flushes the batch, so
+// it cannot overtake the messages it may refer to.
+var batchWindow = envDuration("BATCH_WINDOW", 100*time.Millisecond) // Zero disables batching
+
+const (
+	maxBatchWindow = time.Second // Longest a live message may be held back
+	maxBatchSize   = 100         // Messages after which a batch is written before its window ends
+)
+
+func init() {
+	if batchWindow < 0 || batchWindow > maxBatchWindow {
+		log.Fatalf("BATCH_WINDOW (%s) must be between 0 and %s", batchWindow, maxBatchWindow)
+	}
+}
+
+// BatchFrame carries the live messages of one batch window.
+type BatchFrame struct {
+	Type  string    `json:"type"`  // Always "messages"
+	Items []Message `json:"items"` // Messages in the order they arrived
+}
+
+// messageBatch collects the live messages of one socket during its window.
+// mu is held while the batch is written, so batches go out in order.
+type messageBatch struct {
+	mu    sync.Mutex
+	items []Message
+	timer *time.Timer // Flushes the batch; nil when empty
+}
+
+// batches reports whether live messages to the connection are batched.
+func (c *connEntry) batches() bool {
+	return batchWindow > 0 && c.caps[capBatching]
+}
+
+// batchMessage adds a live message to the connection's batch, writing the
+// batch at once when it is full.
+func (c *connEntry) batchMessage(message Message) {
+	b := &c.batch
+	b.mu.Lock()
+	b.items = append(b.items, message)
+	full := len(b.items) >= maxBatchSize
+	if b.timer == nil && !full {
+		b.timer = time.AfterFunc(batchWindow, c.flushBatch)
+	}
+	b.mu.Unlock()
+
+	if full {
+		c.flushBatch()
+	}
+}
+
+// flushBatch writes the messages batched for the connection as one frame
+// and settles them. A socket that fails is closed, and its messages are left
+// for replay.
+func (c *connEntry) flushBatch() {
+	b := &c.batch
+	b.mu.Lock()
+	items := b.items
+	b.items = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(items) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	err := c.writeJSON(BatchFrame{Type: envelopeMessages, Items: items})
+	b.mu.Unlock()
+
+	if err != nil {
+		slog.Warn("Batch delivery failed", "user_id", c.userID, "conn_id", c.connID, "error", err)
+		c.conn.Close()
+		return
+	}
+	for _, message := range items {
+		c.noteSent(message)
+	}
+	settleHeld(c, items)
+}
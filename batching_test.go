@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// readBatch reads the next frame and decodes it as a messages frame.
+func readBatch(t *testing.T, client *websocket.Conn) BatchFrame {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading batch: %v", err)
+	}
+	var batch BatchFrame
+	if err := json.Unmarshal(data, &batch); err != nil || batch.Type != envelopeMessages {
+		t.Fatalf("got %s, want a messages frame", data)
+	}
+	return batch
+}
+
+func TestBatchingGroupsWindow(t *testing.T) {
+	claims := &JWTClaims{ID: 901}
+	entry, client := newTestConn(t, claims, nil)
+	entry.caps = parseClientCaps(capBatching)
+	hub.Register(entry)
+	t.Cleanup(func() { hub.Unregister(entry) })
+
+	// Echoes of the user's own messages need no settling, so no database
+	start := time.Now()
+	for id := int64(1); id <= 3; id++ {
+		sendToSockets(defaultTenant, 901, nil, Message{ID: id, Tenant: defaultTenant, SenderID: 901, RecipientID: 902})
+	}
+	sendToSockets(defaultTenant, 901, nil, Frame{Type: envelopeTyping, Data: typingEvent{SenderID: 902}})
+
+	if frameType, _ := readFrame(t, client); frameType != envelopeTyping {
+		t.Fatalf("first frame is %s, want typing ahead of the batch", frameType)
+	}
+	batch := readBatch(t, client)
+	if elapsed := time.Since(start); elapsed < batchWindow {
+		t.Errorf("batch written after %s, before the window ended", elapsed)
+	}
+	if len(batch.Items) != 3 || batch.Items[0].ID != 1 || batch.Items[1].ID != 2 || batch.Items[2].ID != 3 {
+		t.Errorf("batch = %+v, want messages 1, 2 and 3 in order", batch.Items)
+	}
+
+	// Other frames flush the batch first
+	sendToSockets(defaultTenant, 901, nil, Message{ID: 4, Tenant: defaultTenant, SenderID: 901, RecipientID: 902})
+	sendToSockets(defaultTenant, 901, nil, Frame{Type: envelopeDelete, Data: map[string]int64{"messageId": 4}})
+	if batch := readBatch(t, client); len(batch.Items) != 1 || batch.Items[0].ID != 4 {
+		t.Errorf("batch = %+v, want message 4 ahead of its delete", batch.Items)
+	}
+	if frameType, _ := readFrame(t, client); frameType != envelopeDelete {
+		t.Errorf("got %s, want the delete after the batch", frameType)
+	}
+	expectNoFrame(t, client)
+}
+
+func TestBatchingSettlesOnFlush(t *testing.T) {
+	useTestDB(t)
+	saved := batchWindow
+	batchWindow = time.Minute // Flushed by hand below, so settling is done when it returns
+	t.Cleanup(func() { batchWindow = saved })
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	entry.caps = parseClientCaps(capBatching)
+	hub.Register(entry)
+	t.Cleanup(func() { hub.Unregister(entry) })
+
+	ctx := context.Background()
+	var ids []int64
+	for _, content := range []string{"one", "two"} {
+		stored, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: content})
+		if err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+		deliverMessage(stored)
+		ids = append(ids, stored.ID)
+	}
+	delivered := func() int64 {
+		t.Helper()
+		count, err := collection.CountDocuments(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}, {Key: "delivered", Value: true}})
+		if err != nil {
+			t.Fatalf("counting delivered: %v", err)
+		}
+		return count
+	}
+	if count := delivered(); count != 0 {
+		t.Errorf("%d messages marked delivered before their batch was written", count)
+	}
+
+	entry.flushBatch()
+	batch := readBatch(t, client)
+	if len(batch.Items) != 2 || batch.Items[0].ID != ids[0] || batch.Items[1].ID != ids[1] {
+		t.Fatalf("batch = %+v, want both messages in order", batch.Items)
+	}
+	if count := delivered(); count != 2 {
+		t.Errorf("%d of 2 batched messages marked delivered after the batch was written", count)
+	}
+}
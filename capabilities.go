@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Capabilities describes the optional features and limits of this deployment
+// so clients can configure themselves instead of hardcoding assumptions.
+type Capabilities struct {
+	FrameTypes    []string         `json:"frameTypes"`    // Accepted inbound WebSocket frame types
+	ContentPolicy string           `json:"contentPolicy"` // Markup policy applied to message content
+	Features      map[string]bool  `json:"features"`      // Optional features and whether they are enabled
+	Limits        map[string]int64 `json:"limits"`        // Size and count limits enforced by the server
+	ClientCaps    []string         `json:"clientCaps"`    // Names a WebSocket client may pass in ?caps= on /ws
+}
+
+// Client capabilities a WebSocket connection opts into with ?caps= on /ws,
+// a comma-separated list. Each enables extra frames that older or simpler
+// clients would not expect.
+const (
+	capUnreadSummary  = "unreadSummary"  // An unreadSummary frame right after connecting
+	capStatusEvents   = "statusEvents"   // Status frames for delivered and read messages, instead of read frames
+	capHeartbeatStats = "heartbeatStats" // Heartbeat frames with connection stats, when HEARTBEAT_STATS_INTERVAL is set
+	capDeliveryAcks   = "deliveryAcks"   // Direct messages count as delivered only once confirmed with a received frame
+	capUndoSend       = "undoSend"       // Messages with a clientMsgId are held for UNDO_WINDOW and can be taken back with an undo frame
+	capCheckpoints    = "checkpoints"    // Checkpoint frames every CHECKPOINT_INTERVAL naming the last message sent per conversation
+	capBatching       = "batching"       // Live messages arriving within BATCH_WINDOW come as one messages frame
+)
+
+// eventCaps are the optional event frames a client may negotiate by naming
+// their frame types in ?caps=, each with the feature in Capabilities.Features
+// that must be enabled for it. A client that names none of them gets all of
+// them, like every client before negotiation existed; one that names any
+// gets only the enabled ones it named.
+var eventCaps = map[string]string{
+	envelopeTyping:   "typing",
+	envelopePresence: "presence",
+	envelopeEdit:     "edits",
+	envelopeDelete:   "deletes",
+}
+
+// clientCaps lists every client capability the server understands.
+var clientCaps = []string{capUnreadSummary, capStatusEvents, capHeartbeatStats, capDeliveryAcks, capUndoSend, capCheckpoints, capBatching, envelopeTyping, envelopePresence, envelopeEdit, envelopeDelete}
+
+// parseClientCaps returns the known capabilities named in v. Unknown names
+// are ignored, so clients may ask for features only newer servers have.
+func parseClientCaps(v string) map[string]bool {
+	caps := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		for _, known := range clientCaps {
+			if name == known {
+				caps[name] = true
+			}
+		}
+	}
+	return caps
+}
+
+// negotiateEvents returns the optional event frames a connection with caps
+// receives, or nil when it named none and so receives them all.
+func negotiateEvents(caps map[string]bool) map[string]bool {
+	var events map[string]bool
+	features := currentCapabilities().Features
+	for frameType, feature := range eventCaps {
+		if !caps[frameType] {
+			continue
+		}
+		if events == nil {
+			events = make(map[string]bool)
+		}
+		if features[feature] {
+			events[frameType] = true
+		}
+	}
+	return events
+}
+
+// sendFeatures tells a connection that negotiated its events which of them
+// it will receive, as a features frame listing their frame types.
+func sendFeatures(c *connEntry) {
+	if c.events == nil {
+		return
+	}
+	names := []string{}
+	for frameType := range c.events {
+		names = append(names, frameType)
+	}
+	sort.Strings(names)
+	if err := c.writeJSON(Frame{Type: envelopeFeatures, Data: names}); err != nil {
+		slog.Warn("Write error", "error", err)
+	}
+}
+
+// currentCapabilities assembles the capability document from the live config.
+func currentCapabilities() Capabilities {
+	frameTypes := []string{}
+	for messageType := range allowedFrameTypes {
+		switch messageType {
+		case websocket.TextMessage:
+			frameTypes = append(frameTypes, "text")
+		case websocket.BinaryMessage:
+			frameTypes = append(frameTypes, "binary")
+		}
+	}
+	sort.Strings(frameTypes)
+
+	return Capabilities{
+		FrameTypes:    frameTypes,
+		ContentPolicy: contentPolicy,
+		Features: map[string]bool{
+			"selfChat":           allowSelfChat,
+			"signatures":         true,
+			"schemaValidation":   messageSchema != nil,
+			"strictClientMsgIds": duplicateClientIDMode == duplicateModeStrict,
+			"maintenance":        maintenanceMode.Load(),
+			"heartbeatStats":     heartbeatStatsInterval > 0,
+			"typing":             true,
+			"readReceipts":       true,
+			"rooms":              true,
+			"edits":              true,
+			"deletes":            true,
+			"presence":           true,
+			"attachments":        allowedFrameTypes[websocket.BinaryMessage],
+			"messageStatus":      true,
+			"search":             true,
+			"deviceDelivery":     true,
+			"deliveryAcks":       true,
+			"undoSend":           undoWindow > 0,
+			"subscriptions":      true,
+			"subscribeAll":       subscribeAllByDefault,
+			"checkpoints":        checkpointInterval > 0,
+			"batching":           batchWindow > 0,
+		},
+		Limits: map[string]int64{
+			"maxMessageBytes":           maxMessageBytes,
+			"maxContentBytes":           MaxContentBytes,
+			"clientIdWindow":            int64(clientIDWindow),
+			"abuseMaxMessages":          int64(abuseMaxMessages),
+			"abuseWindowSeconds":        int64(abuseWindow.Seconds()),
+			"messageRatePerMinute":      int64(float64(messageRate) * 60),
+			"messageBurst":              int64(messageBurst),
+			"editWindowSeconds":         int64(editWindow.Seconds()),
+			"presenceMaxContacts":       int64(presenceMaxContacts),
+			"maxBlobBytes":              maxBlobBytes,
+			"typingTtlSeconds":          int64(typingTTL.Seconds()),
+			"ackTimeoutSeconds":         int64(ackTimeout.Seconds()),
+			"ackMaxRetries":             int64(ackMaxRetries),
+			"ackQueueSize":              int64(ackQueueSize),
+			"undoWindowSeconds":         int64(undoWindow.Seconds()),
+			"maxSubscriptions":          int64(maxSubscriptions),
+			"statusWindowMs":            statusWindow.Milliseconds(),
+			"statusWindowMobileMs":      statusWindowMobile.Milliseconds(),
+			"statusWindowDesktopMs":     statusWindowDesktop.Milliseconds(),
+			"checkpointIntervalSeconds": int64(checkpointInterval.Seconds()),
+			"batchWindowMs":             batchWindow.Milliseconds(),
+			"maxBatchSize":              maxBatchSize,
+		},
+		ClientCaps: clientCaps,
+	}
+}
+
+// capabilitiesHandler serves GET /capabilities. It is intentionally
+// unauthenticated: clients read it before they have a token.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, currentCapabilities())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseClientCaps(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]bool
+	}{
+		{"", map[string]bool{}},
+		{"unreadSummary", map[string]bool{capUnreadSummary: true}},
+		{" unreadSummary , futureThing", map[string]bool{capUnreadSummary: true}},
+		{"UnreadSummary", map[string]bool{}},
+	}
+	for _, tt := range tests {
+		if got := parseClientCaps(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseClientCaps(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateEvents(t *testing.T) {
+	tests := []struct {
+		caps string
+		want map[string]bool
+	}{
+		{"", nil},
+		{"unreadSummary", nil},
+		{"typing,edit", map[string]bool{envelopeTyping: true, envelopeEdit: true}},
+		{"statusEvents,presence", map[string]bool{envelopePresence: true}},
+	}
+	for _, tt := range tests {
+		if got := negotiateEvents(parseClientCaps(tt.caps)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("negotiateEvents(%q) = %v, want %v", tt.caps, got, tt.want)
+		}
+	}
+}
+
+func TestSendToSocketsGatesEvents(t *testing.T) {
+	claims := &JWTClaims{ID: 5, Tenant: "negotiation"}
+	legacy, legacyClient := newTestConn(t, claims, nil)
+	typingOnly, typingClient := newTestConn(t, claims, nil)
+	typingOnly.events = negotiateEvents(parseClientCaps("typing"))
+	for _, entry := range []*connEntry{legacy, typingOnly} {
+		hub.Register(entry)
+		t.Cleanup(func() { hub.Unregister(entry) })
+	}
+
+	sendFeatures(typingOnly)
+	if frameType, data := readFrame(t, typingClient); frameType != envelopeFeatures || string(data) != `["typing"]` {
+		t.Errorf("features frame = %s %s, want [\"typing\"]", frameType, data)
+	}
+
+	edit := Frame{Type: envelopeEdit, Data: editEvent{ID: 1, Content: "x"}}
+	if n := sendToSockets("negotiation", 5, nil, edit); n != 1 {
+		t.Errorf("edit reached %d sockets, want only the legacy one", n)
+	}
+	typing := Frame{Type: envelopeTyping, Data: typingEvent{SenderID: 6}}
+	if n := sendToSockets("negotiation", 5, nil, typing); n != 2 {
+		t.Errorf("typing reached %d sockets, want both", n)
+	}
+
+	if frameType, _ := readFrame(t, legacyClient); frameType != envelopeEdit {
+		t.Errorf("legacy socket got %s first, want edit", frameType)
+	}
+	if frameType, _ := readFrame(t, typingClient); frameType != envelopeTyping {
+		t.Errorf("typing-only socket got %s, want typing", frameType)
+	}
+}
+
+func TestHeartbeatStatsOptIn(t *testing.T) {
+	saved := heartbeatStatsInterval
+	heartbeatStatsInterval = 20 * time.Millisecond
+	t.Cleanup(func() { heartbeatStatsInterval = saved })
+
+	claims := &JWTClaims{ID: 7}
+	plain, plainClient := newTestConn(t, claims, nil)
+	opted, optedClient := newTestConn(t, claims, nil)
+	opted.caps = parseClientCaps(capHeartbeatStats)
+	for _, entry := range []*connEntry{plain, opted} {
+		t.Cleanup(entry.startHeartbeat(func() {}))
+	}
+
+	if frameType, _ := readFrame(t, optedClient); frameType != "heartbeat" {
+		t.Errorf("opted-in socket got %s, want heartbeat", frameType)
+	}
+	expectNoFrame(t, plainClient)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Checkpoints let a client spot messages it missed without a counter on
+// every frame. A connection with the checkpoints capability gets, every
+// checkpointInterval, a checkpoint frame for each conversation it was sent
+// messages in since the last one, naming the highest message ID sent. A
+// client missing a message of that conversation below it asks for the rest
+// with a resync frame.
+var checkpointInterval = envDuration("CHECKPOINT_INTERVAL", 30*time.Second) // Zero disables checkpoints
+
+func init() {
+	if checkpointInterval < 0 {
+		log.Fatalf("CHECKPOINT_INTERVAL (%s) must not be negative", checkpointInterval)
+	}
+}
+
+// checkpointEvent is the data of a checkpoint frame.
+type checkpointEvent struct {
+	ConversationID string `json:"conversationId"`
+	LastMessageID  int64  `json:"lastMessageId"`
+}
+
+// resyncRequest is the data of an inbound resync frame.
+type resyncRequest struct {
+	ConversationID string `json:"conversationId"`
+	AfterID        int64  `json:"afterId"` // Last message ID the client holds without a gap
+}
+
+// resyncEvent is the data of the resync frame answering one: the messages of
+// the conversation after AfterID, oldest first. More is set when the page
+// was full and the client should resync again from its last message.
+type resyncEvent struct {
+	ConversationID string    `json:"conversationId"`
+	Messages       []Message `json:"messages"`
+	More           bool      `json:"more"`
+}
+
+// tracksCheckpoints reports whether the connection gets checkpoints.
+func (c *connEntry) tracksCheckpoints() bool {
+	return checkpointInterval > 0 && c.caps[capCheckpoints]
+}
+
+// trackCheckpoints starts recording what the connection is sent, for its
+// checkpoints, if it gets them.
+func (c *connEntry) trackCheckpoints() {
+	if c.tracksCheckpoints() {
+		c.sentLast = make(map[string]int64)
+	}
+}
+
+// noteSent records a message written to the connection for its next
+// checkpoint.
+func (c *connEntry) noteSent(message Message) {
+	c.checkpointMu.Lock()
+	defer c.checkpointMu.Unlock()
+	if c.sentLast == nil {
+		return
+	}
+	id := messageConversationID(message)
+	c.sentLast[id] = max(c.sentLast[id], message.ID)
+}
+
+// sendCheckpoints writes a checkpoint frame for every conversation the
+// connection was sent messages in since the last checkpoints.
+func (c *connEntry) sendCheckpoints() error {
+	c.checkpointMu.Lock()
+	sent := c.sentLast
+	c.sentLast = make(map[string]int64)
+	c.checkpointMu.Unlock()
+
+	ids := make([]string, 0, len(sent))
+	for id := range sent {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		frame := Frame{Type: envelopeCheckpoint, Data: checkpointEvent{ConversationID: id, LastMessageID: sent[id]}}
+		if err := c.writeJSON(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conversationFilter returns the filter matching the messages of the
+// conversation with id, or the reason the caller may not read it.
+func (s *session) conversationFilter(ctx context.Context, id string) (bson.D, string) {
+	tenant := s.claims.TenantID()
+	if v, ok := strings.CutPrefix(id, "room:"); ok {
+		roomID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || roomID <= 0 {
+			return nil, "invalid_resync"
+		}
+		member, err := isRoomMember(ctx, tenant, s.claims.ID, roomID)
+		if err != nil {
+			slog.Error("Room membership check error", "error", err)
+			return nil, "resync_failed"
+		}
+		if !member {
+			return nil, "not_member"
+		}
+		return bson.D{{Key: "tenant", Value: tenant}, {Key: "roomId", Value: roomID}}, ""
+	}
+
+	// Direct conversations are dm:low:high, and the caller must be one side
+	v, ok := strings.CutPrefix(id, "dm:")
+	low, high, found := strings.Cut(v, ":")
+	a, errA := strconv.ParseInt(low, 10, 64)
+	b, errB := strconv.ParseInt(high, 10, 64)
+	if !ok || !found || errA != nil || errB != nil || directConversationID(a, b) != id {
+		return nil, "invalid_resync"
+	}
+	other := a
+	if a == s.claims.ID {
+		other = b
+	} else if b != s.claims.ID {
+		return nil, "not_participant"
+	}
+	return bson.D{
+		{Key: "tenant", Value: tenant},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "senderId", Value: s.claims.ID}, {Key: "recipientId", Value: other}},
+			bson.D{{Key: "senderId", Value: other}, {Key: "recipientId", Value: s.claims.ID}},
+		}},
+	}, ""
+}
+
+// handleResync answers a resync frame with the messages of a conversation
+// after the last one the client holds, up to maxHistoryLimit at a time.
+// Resending leaves the status of the messages alone.
+func (s *session) handleResync(data []byte) bool {
+	if reason := s.checkRate(); reason != "" {
+		return s.reject(reason)
+	}
+	var req resyncRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.ConversationID == "" || req.AfterID < 0 {
+		return s.reject("invalid_resync")
+	}
+
+	// Bound how many queries the user runs at once, like history reads
+	if !queryLimits.acquire(s.claims.TenantID(), s.claims.ID) {
+		return s.reject("too_many_queries")
+	}
+	defer queryLimits.release(s.claims.TenantID(), s.claims.ID)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	defer cancel()
+
+	filter, reason := s.conversationFilter(ctx, req.ConversationID)
+	if reason != "" {
+		return s.reject(reason)
+	}
+	filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$gt", Value: req.AfterID}}})
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(maxHistoryLimit + 1)
+	cursor, err := historyColl.Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("Resync query error", "error", err)
+		return s.reject("resync_failed")
+	}
+	messages := []Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		slog.Error("Resync decode error", "error", err)
+		return s.reject("resync_failed")
+	}
+
+	event := resyncEvent{ConversationID: req.ConversationID, Messages: messages}
+	if len(messages) > maxHistoryLimit {
+		event.Messages, event.More = messages[:maxHistoryLimit], true
+	}
+	for i := range event.Messages {
+		applyTombstone(&event.Messages[i])
+	}
+	return s.reply(Frame{Type: envelopeResync, Data: event})
+}
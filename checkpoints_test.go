@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestCheckpoints(t *testing.T) {
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	entry.caps = parseClientCaps(capCheckpoints)
+	entry.trackCheckpoints()
+	plain, plainClient := newTestConn(t, claims, nil)
+	plain.trackCheckpoints()
+
+	for _, message := range []Message{
+		{ID: 5, SenderID: 2, RecipientID: 1},
+		{ID: 3, SenderID: 4, RoomID: 7},
+		{ID: 4, SenderID: 1, RecipientID: 2}, // The user's own echo, in the same conversation
+	} {
+		for _, c := range []*connEntry{entry, plain} {
+			if !writeToSocket(c, message) {
+				t.Fatalf("writing message %d failed", message.ID)
+			}
+		}
+		readFrame(t, client)
+		readFrame(t, plainClient)
+	}
+
+	if err := entry.sendCheckpoints(); err != nil {
+		t.Fatalf("sendCheckpoints: %v", err)
+	}
+	for _, want := range []checkpointEvent{{"dm:1:2", 5}, {"room:7", 3}} {
+		frameType, data := readFrame(t, client)
+		var got checkpointEvent
+		json.Unmarshal(data, &got)
+		if frameType != envelopeCheckpoint || got != want {
+			t.Errorf("got %s %s, want checkpoint %+v", frameType, data, want)
+		}
+	}
+
+	// Quiet conversations get no new checkpoint
+	if err := entry.sendCheckpoints(); err != nil {
+		t.Fatalf("sendCheckpoints: %v", err)
+	}
+	if plain.sentLast != nil {
+		t.Error("connection without the capability tracks checkpoints")
+	}
+	expectNoFrame(t, client)
+}
+
+func TestResync(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	if err := joinRoom(ctx, defaultTenant, 2, 7); err != nil {
+		t.Fatalf("joinRoom: %v", err)
+	}
+	var direct []Message
+	for _, m := range []Message{
+		{SenderID: 1, RecipientID: 2, Content: "one"},
+		{SenderID: 2, RoomID: 7, Content: "room"},
+		{SenderID: 2, RecipientID: 1, Content: "two"},
+		{SenderID: 3, RecipientID: 1, Content: "elsewhere"},
+		{SenderID: 1, RecipientID: 2, Content: "three"},
+	} {
+		stored, err := InsertMessage(ctx, m)
+		if err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+		if m.RoomID == 0 && m.SenderID != 3 {
+			direct = append(direct, stored)
+		}
+	}
+	// Another tenant's conversation between the same user IDs stays hidden
+	if _, err := InsertMessage(ctx, Message{Tenant: "other", SenderID: 2, RecipientID: 1, Content: "foreign"}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(ctx, entry, claims)
+	s.handleFrame([]byte(fmt.Sprintf(`{"type":"resync","requestId":"r1","data":{"conversationId":"dm:1:2","afterId":%d}}`, direct[0].ID)))
+	reply := readReply(t, client)
+	var event resyncEvent
+	json.Unmarshal(reply.Data, &event)
+	if reply.Type != envelopeResync || reply.RequestID != "r1" || event.More || len(event.Messages) != 2 {
+		t.Fatalf("got %s %s, want the two messages after the first", reply.Type, reply.Data)
+	}
+	for i, message := range event.Messages {
+		if message.ID != direct[i+1].ID {
+			t.Errorf("message %d = %d, want %d", i, message.ID, direct[i+1].ID)
+		}
+	}
+
+	s.handleFrame([]byte(fmt.Sprintf(`{"type":"resync","data":{"conversationId":"dm:1:2","afterId":%d}}`, direct[2].ID)))
+	reply = readReply(t, client)
+	event = resyncEvent{}
+	json.Unmarshal(reply.Data, &event)
+	if event.Messages == nil || len(event.Messages) != 0 {
+		t.Errorf("resync past the end = %s, want an empty list", reply.Data)
+	}
+
+	for _, c := range []struct{ id, reason string }{
+		{"dm:2:3", "not_participant"},
+		{"room:7", "not_member"},
+		{"dm:2:1", "invalid_resync"},
+		{"room:x", "invalid_resync"},
+		{"chat", "invalid_resync"},
+	} {
+		s.handleFrame([]byte(`{"type":"resync","data":{"conversationId":"` + c.id + `"}}`))
+		if reason := readErrorReason(t, client); reason != c.reason {
+			t.Errorf("%s: reason = %q, want %s", c.id, reason, c.reason)
+		}
+	}
+}
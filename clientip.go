@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies lists the CIDRs of reverse proxies whose X-Forwarded-For
+// header is believed. Requests from anywhere else use the socket address.
+var trustedProxies = parseCIDRs(envString("TRUSTED_PROXIES", ""))
+
+func parseCIDRs(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP resolves the originating client address. X-Forwarded-For is
+// walked from the right, skipping trusted proxies, and only when the direct
+// peer is itself a trusted proxy, so clients cannot spoof their address.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
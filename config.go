@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envString returns the value of the environment variable or def when unset.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt parses an integer environment variable, failing fast on malformed values.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s value %q: %v", name, v, err)
+	}
+	return n
+}
+
+// envFloat parses a float environment variable, failing fast on malformed values.
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s value %q: %v", name, v, err)
+	}
+	return f
+}
+
+// envBool parses a boolean environment variable, failing fast on malformed values.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s value %q: %v", name, v, err)
+	}
+	return b
+}
+
+// envDuration parses a duration environment variable (e.g. "30s", "10m"),
+// failing fast on malformed values.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s value %q: %v", name, v, err)
+	}
+	return d
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Content policies for messages that clients render as markdown/HTML.
+const (
+	contentPolicyOff      = "off"      // Store content as-is (plain-text deployments)
+	contentPolicyReject   = "reject"   // Reject content containing disallowed markup
+	contentPolicySanitize = "sanitize" // Neutralize disallowed markup and store the result
+)
+
+var contentPolicy = loadContentPolicy()
+
+var (
+	// htmlPattern matches the start of a raw HTML tag, closing tag, comment,
+	// doctype or processing instruction.
+	htmlPattern = regexp.MustCompile(`<[/!?]?[A-Za-z!?]`)
+
+	// linkTargetPattern captures inline markdown link/image targets "](url"
+	// and reference definitions "[id]: url".
+	linkTargetPattern = regexp.MustCompile(`(\]\(\s*|(?m:^\s*\[[^\]]+\]:\s*))([^\s)]+)`)
+
+	// safeLinkSchemes is the allowlist of URL schemes a link may point at.
+	safeLinkSchemes = []string{"http://", "https://", "mailto:"}
+)
+
+func loadContentPolicy() string {
+	policy := strings.ToLower(envString("CONTENT_POLICY", contentPolicyOff))
+	switch policy {
+	case contentPolicyOff, contentPolicyReject, contentPolicySanitize:
+		return policy
+	default:
+		log.Fatalf("Unknown CONTENT_POLICY %q", policy)
+		return ""
+	}
+}
+
+// isSafeLinkTarget reports whether a markdown link target uses an allowed scheme.
+func isSafeLinkTarget(target string) bool {
+	lower := strings.ToLower(target)
+	for _, scheme := range safeLinkSchemes {
+		if strings.HasPrefix(lower, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUnsafeMarkup reports whether content contains raw HTML or a link whose
+// target is not on the scheme allowlist.
+func hasUnsafeMarkup(content string) bool {
+	if htmlPattern.MatchString(content) {
+		return true
+	}
+	for _, m := range linkTargetPattern.FindAllStringSubmatch(content, -1) {
+		if !isSafeLinkTarget(m[2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeContent rewrites unsafe link targets to "#" and escapes every "<"
+// so no HTML tag can survive rendering. Markdown emphasis, code and quotes
+// are left untouched.
+func sanitizeContent(content string) string {
+	content = linkTargetPattern.ReplaceAllStringFunc(content, func(m string) string {
+		parts := linkTargetPattern.FindStringSubmatch(m)
+		if isSafeLinkTarget(parts[2]) {
+			return m
+		}
+		return parts[1] + "#"
+	})
+	return strings.ReplaceAll(content, "<", "&lt;")
+}
+
+// applyContentPolicy validates or sanitizes content according to CONTENT_POLICY.
+func applyContentPolicy(content string) (string, error) {
+	switch contentPolicy {
+	case contentPolicyReject:
+		if hasUnsafeMarkup(content) {
+			return "", &ValidationError{Reason: "disallowed_markup", Msg: "content contains disallowed markup"}
+		}
+	case contentPolicySanitize:
+		return sanitizeContent(content), nil
+	}
+	return content, nil
+}
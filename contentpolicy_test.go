@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHasUnsafeMarkup(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"plain text", "hello there", false},
+		{"less-than in prose", "1 < 2 and 3 > 2", false},
+		{"markdown emphasis", "**bold** and _italic_ and `code`", false},
+		{"html tag", "<b>hi</b>", true},
+		{"closing tag", "text</div>", true},
+		{"html comment", "<!-- hidden -->", true},
+		{"script tag", "<script>alert(1)</script>", true},
+		{"https link", "[site](https://example.com)", false},
+		{"mailto link", "[mail](mailto:a@example.com)", false},
+		{"javascript link", "[x](javascript:alert(1))", true},
+		{"uppercase scheme", "[x](HTTPS://example.com)", false},
+		{"data image", "![img](data:image/png;base64,AAAA)", true},
+		{"reference definition", "[ref]: javascript:alert(1)", true},
+		{"safe reference definition", "[ref]: https://example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasUnsafeMarkup(tt.content); got != tt.want {
+				t.Errorf("hasUnsafeMarkup(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"plain text", "hello", "hello"},
+		{"html escaped", "<b>hi</b>", "&lt;b>hi&lt;/b>"},
+		{"unsafe link neutralized", "[x](javascript:evil)", "[x](#)"},
+		{"safe link kept", "[x](https://example.com)", "[x](https://example.com)"},
+		{"unsafe reference neutralized", "[ref]: javascript:evil", "[ref]: #"},
+		{"emphasis untouched", "**bold**", "**bold**"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeContent(tt.content); got != tt.want {
+				t.Errorf("sanitizeContent(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyContentPolicy(t *testing.T) {
+	defer func(policy string) { contentPolicy = policy }(contentPolicy)
+
+	tests := []struct {
+		policy  string
+		content string
+		want    string
+		reason  string // Expected ValidationError reason, empty for success
+	}{
+		{contentPolicyOff, "<b>x</b>", "<b>x</b>", ""},
+		{contentPolicyReject, "plain", "plain", ""},
+		{contentPolicyReject, "<b>x</b>", "", "disallowed_markup"},
+		{contentPolicyReject, "[x](javascript:alert(1))", "", "disallowed_markup"},
+		{contentPolicySanitize, "<b>x</b>", "&lt;b>x&lt;/b>", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.content, func(t *testing.T) {
+			contentPolicy = tt.policy
+			got, err := applyContentPolicy(tt.content)
+			if tt.reason != "" {
+				var validationErr *ValidationError
+				if !errors.As(err, &validationErr) || validationErr.Reason != tt.reason {
+					t.Fatalf("applyContentPolicy(%q) error = %v, want reason %q", tt.content, err, tt.reason)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("applyContentPolicy(%q) = %q, %v, want %q", tt.content, got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// conversationSummary is one entry of GET /conversations.
+type conversationSummary struct {
+	UserID      int64   `bson:"_id" json:"userId"`         // The other participant
+	LastMessage Message `bson:"last" json:"lastMessage"`   // Latest message, with previewed content
+	UnreadCount int64   `bson:"unread" json:"unreadCount"` // Messages to the caller not yet read
+}
+
+// conversationsPipeline groups the caller's direct messages by the other
+// participant, keeping the latest message and counting unread ones. Unread
+// is per user, not per device: a read on any device clears it everywhere.
+func conversationsPipeline(tenant string, userID int64, limit int) mongo.Pipeline {
+	otherParticipant := bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{"$senderId", userID}}}, "$recipientId", "$senderId",
+	}}}
+	// Documents from before statuses existed only carry readAt
+	unread := bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{"$recipientId", userID}}},
+		bson.D{{Key: "$ne", Value: bson.A{"$status", statusRead}}},
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$readAt", 0}}}, 0}}},
+		bson.D{{Key: "$ne", Value: bson.A{"$deleted", true}}},
+	}}}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "tenant", Value: tenant},
+			{Key: "roomId", Value: bson.D{{Key: "$exists", Value: false}}},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "senderId", Value: userID}},
+				bson.D{{Key: "recipientId", Value: userID}},
+			}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: otherParticipant},
+			{Key: "last", Value: bson.D{{Key: "$first", Value: "$$ROOT"}}},
+			{Key: "unread", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{unread, 1, 0}}}}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "last.timestamp", Value: -1}, {Key: "last._id", Value: -1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+}
+
+// conversationsHandler serves GET /conversations?limit=, the caller's direct
+// conversations with the latest message of each, newest first. A user who
+// never sent or received a message gets an empty array.
+func conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET")
+		return
+	}
+
+	claims, err := validateJWTToken(bearerToken(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "limit", "limit must be between 1 and 200")
+			return
+		}
+	}
+
+	// Bound how many queries the user runs at once
+	if !queryLimits.acquire(claims.TenantID(), claims.ID) {
+		writeError(w, http.StatusTooManyRequests, "too_many_queries", "Too many queries in flight; retry when one completes")
+		return
+	}
+	defer queryLimits.release(claims.TenantID(), claims.ID)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	conversations, err := loadConversations(ctx, claims.TenantID(), claims.ID, limit)
+	if err != nil {
+		slog.Error("Conversations query error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load conversations")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, conversations)
+}
+
+// loadConversations returns up to limit of the user's conversations, newest
+// first, with the latest message of each cut down to a preview.
+func loadConversations(ctx context.Context, tenant string, userID int64, limit int) ([]conversationSummary, error) {
+	cursor, err := historyColl.Aggregate(ctx, conversationsPipeline(tenant, userID, limit))
+	if err != nil {
+		return nil, err
+	}
+	conversations := []conversationSummary{}
+	if err := cursor.All(ctx, &conversations); err != nil {
+		return nil, err
+	}
+	for i := range conversations {
+		last := &conversations[i].LastMessage
+		applyTombstone(last)
+		last.Content = previewContent(last.Content, previewLength)
+		last.Edits = nil // History is only shown with the full message
+	}
+	return conversations, nil
+}
+
+// unreadSummary is the data of the unreadSummary frame: the same entries as
+// GET /conversations, so a client can render its chat list without a
+// separate request.
+type unreadSummary struct {
+	Conversations []conversationSummary `json:"conversations"`
+	TotalUnread   int64                 `json:"totalUnread"` // Sum over the listed conversations
+}
+
+func newUnreadSummary(conversations []conversationSummary) unreadSummary {
+	summary := unreadSummary{Conversations: conversations}
+	for _, conversation := range conversations {
+		summary.TotalUnread += conversation.UnreadCount
+	}
+	return summary
+}
+
+// sendUnreadSummary sends the unreadSummary frame to a client that asked for
+// it. A failed lookup only costs the client the shortcut, so it is logged
+// and the connection carries on.
+func sendUnreadSummary(ctx context.Context, c *connEntry) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	conversations, err := loadConversations(ctx, c.tenant, c.userID, defaultHistoryLimit)
+	if err != nil {
+		slog.Error("Unread summary query error", "user_id", c.userID, "error", err)
+		return
+	}
+	frame := Frame{Type: envelopeUnreadSummary, Data: newUnreadSummary(conversations)}
+	if err := c.writeJSON(frame); err != nil {
+		slog.Warn("Write error", "error", err)
+	}
+}
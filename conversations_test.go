@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewUnreadSummary(t *testing.T) {
+	summary := newUnreadSummary([]conversationSummary{
+		{UserID: 2, UnreadCount: 3},
+		{UserID: 3, UnreadCount: 0},
+		{UserID: 4, UnreadCount: 5},
+	})
+	if summary.TotalUnread != 8 || len(summary.Conversations) != 3 {
+		t.Errorf("summary = %+v, want 3 conversations with 8 unread", summary)
+	}
+
+	// A user without conversations still gets a list, not null
+	data, err := json.Marshal(newUnreadSummary([]conversationSummary{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"conversations":[],"totalUnread":0}`; string(data) != want {
+		t.Errorf("empty summary = %s, want %s", data, want)
+	}
+}
+
+func TestConversationsHandler(t *testing.T) {
+	useTestDB(t)
+	for _, content := range []string{"first", "second"} {
+		if _, err := InsertMessage(context.Background(), Message{SenderID: 2, RecipientID: 1, Content: content}); err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+	}
+	get := func(userID int64) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/conversations", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, userID, time.Now().Add(time.Hour)))
+		rec := httptest.NewRecorder()
+		conversationsHandler(rec, req)
+		return rec
+	}
+
+	// A brand-new user gets an empty array, not an error or null
+	if rec := get(9); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("new user: status %d, body %s; want 200 and []", rec.Code, rec.Body)
+	}
+
+	rec := get(1)
+	var conversations []conversationSummary
+	json.Unmarshal(rec.Body.Bytes(), &conversations)
+	if rec.Code != http.StatusOK || len(conversations) != 1 || conversations[0].UserID != 2 || conversations[0].UnreadCount != 2 || conversations[0].LastMessage.Content != "second" {
+		t.Errorf("recipient: status %d, body %s; want one conversation with 2 unread", rec.Code, rec.Body)
+	}
+}
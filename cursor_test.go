@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	want := pageCursor{Timestamp: 1_700_000_000, ID: 42}
+	token := signCursor("default|1|with:2", want)
+	got, err := parseCursor("default|1|with:2", token)
+	if err != nil || got != want {
+		t.Errorf("parseCursor = %+v, %v; want %+v", got, err, want)
+	}
+}
+
+func TestCursorTampered(t *testing.T) {
+	const scope = "default|1|with:2"
+	token := signCursor(scope, pageCursor{Timestamp: 1_700_000_000, ID: 42})
+	payload, sig, _ := strings.Cut(token, ".")
+
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"t":9999999999,"i":1}`))
+	flipped := []byte(sig)
+	flipped[0] ^= 1
+
+	tests := map[string]string{
+		"empty":              "",
+		"no signature":       payload,
+		"forged position":    forged + "." + sig,
+		"altered signature":  payload + "." + string(flipped),
+		"bad base64":         payload + ".!!",
+		"other user":         signCursor("default|3|with:2", pageCursor{Timestamp: 1, ID: 1}),
+		"other conversation": signCursor("default|1|with:9", pageCursor{Timestamp: 1, ID: 1}),
+		"other tenant":       signCursor("acme|1|with:2", pageCursor{Timestamp: 1, ID: 1}),
+		"room cursor":        signCursor("default|1|room:2", pageCursor{Timestamp: 1, ID: 1}),
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseCursor(scope, token); !errors.Is(err, errInvalidCursor) {
+				t.Errorf("parseCursor(%q) err = %v, want errInvalidCursor", token, err)
+			}
+		})
+	}
+}
+
+func TestHistoryRejectsBadPosition(t *testing.T) {
+	token := testToken(t, 1, time.Now().Add(time.Hour))
+	for _, query := range []string{"with=2&cursor=abc.def", "with=2&before=yesterday"} {
+		req := httptest.NewRequest(http.MethodGet, "/messages?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		historyHandler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /messages?%s: status = %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// A direct message may carry a deliverBy deadline, for messages only worth
+// delivering quickly. Once it passes with the message still sent, the
+// message expires: it is never delivered or replayed after, and its sender
+// gets a deliveryFailed frame.
+var expiryScanInterval = envDuration("EXPIRY_SCAN_INTERVAL", 10*time.Second) // Zero disables the expiry scanner
+
+const expiryScanBatch = 100 // Maximum messages expired per scan
+
+// pastDeadline reports whether the message's delivery deadline has passed.
+func (m *Message) pastDeadline(now time.Time) bool {
+	return m.DeliverBy != 0 && now.Unix() > m.DeliverBy
+}
+
+// deliverableClause keeps messages whose deadline has passed out of a
+// replay. Messages without a deadline match as well.
+func deliverableClause(now time.Time) bson.E {
+	return bson.E{Key: "deliverBy", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$lt", Value: now.Unix()}}}}}
+}
+
+// runExpiryScanner periodically expires messages whose deadline passed
+// while their recipient was offline, until ctx is canceled.
+func runExpiryScanner(ctx context.Context) {
+	slog.Info("Expiry scanner started", "interval", expiryScanInterval.String())
+
+	ticker := time.NewTicker(expiryScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expireDue(ctx)
+		}
+	}
+}
+
+// expireDue expires a batch of messages past their deadline.
+func expireDue(ctx context.Context) {
+	now := time.Now()
+	filter := bson.D{
+		{Key: "deliverBy", Value: bson.D{{Key: "$lt", Value: now.Unix()}}},
+		{Key: "status", Value: statusSent}, // Matches the partial index
+	}
+	opts := options.Find().SetLimit(expiryScanBatch).SetProjection(bson.D{
+		{Key: "tenant", Value: 1},
+		{Key: "senderId", Value: 1},
+		{Key: "clientMsgId", Value: 1},
+	})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("Expiry scan error", "error", err)
+		return
+	}
+	var messages []Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		slog.Error("Expiry scan decode error", "error", err)
+		return
+	}
+	for _, message := range messages {
+		expireMessage(ctx, message, now)
+	}
+}
+
+// expireMessage moves a message that missed its deadline to expired and
+// notifies its sender. The status update only matches a message not yet
+// delivered, so a message expires at most once, and never after reaching
+// its recipient, even with several server instances racing.
+func expireMessage(ctx context.Context, message Message, now time.Time) {
+	filter := bson.D{
+		{Key: "tenant", Value: message.Tenant},
+		{Key: "_id", Value: message.ID},
+	}
+	clause, update := advanceStatus(statusExpired, now, nil)
+	result, err := collection.UpdateOne(ctx, append(filter, clause), update)
+	recentHistory.forget(message.Tenant, []int64{message.ID})
+	if err != nil {
+		slog.Error("Message expiry error", "message_id", message.ID, "error", err)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		return
+	}
+	slog.Info("Message expired undelivered", "message_id", message.ID, "sender_id", message.SenderID)
+
+	frame := DeliveryFailedFrame{
+		Type:        "deliveryFailed",
+		MessageID:   message.ID,
+		ClientMsgID: message.ClientMsgID,
+		Reason:      deliveryFailureReason("expired"),
+	}
+	sendToSockets(message.Tenant, message.SenderID, nil, frame)
+	notifyStatus(message.Tenant, map[int64][]int64{message.SenderID: {message.ID}}, statusExpired, now)
+}
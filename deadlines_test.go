@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestValidateDeliverBy(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		message Message
+		wantErr bool
+	}{
+		{"no deadline", Message{SenderID: 1, RecipientID: 2, Content: "hi"}, false},
+		{"future deadline", Message{SenderID: 1, RecipientID: 2, Content: "hi", DeliverBy: now + 60}, false},
+		{"past deadline", Message{SenderID: 1, RecipientID: 2, Content: "hi", DeliverBy: now - 1}, true},
+		{"room message", Message{SenderID: 1, RoomID: 7, Content: "hi", DeliverBy: now + 60}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateMessage(context.Background(), tt.message)
+			var validationErr *ValidationError
+			if gotErr := errors.As(err, &validationErr) && validationErr.Reason == "invalid_deliver_by"; gotErr != tt.wantErr {
+				t.Errorf("validateMessage error = %v, want invalid_deliver_by: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// readDeliveryFailed reads one frame from a test client, which must be a
+// deliveryFailed frame.
+func readDeliveryFailed(t *testing.T, client *websocket.Conn) DeliveryFailedFrame {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	var frame DeliveryFailedFrame
+	if err := client.ReadJSON(&frame); err != nil || frame.Type != "deliveryFailed" {
+		t.Fatalf("reading deliveryFailed frame: %+v, %v", frame, err)
+	}
+	return frame
+}
+
+func TestDeliveryDeadline(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	sender, senderClient := newTestConn(t, &JWTClaims{ID: 2}, nil)
+	hub.Register(sender)
+	t.Cleanup(func() { hub.Unregister(sender) })
+
+	// Stored directly: validation only accepts deadlines still ahead
+	store := func(content string, deliverBy int64) Message {
+		t.Helper()
+		stored, err := insertValidated(ctx, Message{Tenant: defaultTenant, SenderID: 2, RecipientID: 1, Content: content, DeliverBy: deliverBy})
+		if err != nil {
+			t.Fatalf("insertValidated: %v", err)
+		}
+		return stored
+	}
+	missed := store("call me now", time.Now().Unix()-10)
+	current := store("still relevant", time.Now().Unix()+3600)
+
+	// The recipient reconnects: the missed message is not replayed
+	recipient, recipientClient := newTestConn(t, &JWTClaims{ID: 1}, nil)
+	catchUp(ctx, recipient)
+	if got := readMessage(t, recipientClient); got.ID != current.ID {
+		t.Fatalf("replayed message %d, want only %d", got.ID, current.ID)
+	}
+
+	expireDue(ctx)
+	if frame := readDeliveryFailed(t, senderClient); frame.MessageID != missed.ID || frame.Reason != "expired" {
+		t.Errorf("sender got %+v, want message %d expired", frame, missed.ID)
+	}
+	var stored Message
+	if err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: missed.ID}}).Decode(&stored); err != nil {
+		t.Fatalf("loading message: %v", err)
+	}
+	if stored.Status != statusExpired || stored.Delivered {
+		t.Errorf("stored status %q, delivered %v; want expired and undelivered", stored.Status, stored.Delivered)
+	}
+	expireDue(ctx) // Already expired: no second notification
+
+	// A live delivery past the deadline expires instead of reaching the recipient
+	hub.Register(recipient)
+	t.Cleanup(func() { hub.Unregister(recipient) })
+	late := store("too late", time.Now().Unix()-1)
+	deliverMessage(late)
+	if frame := readDeliveryFailed(t, senderClient); frame.MessageID != late.ID {
+		t.Errorf("sender got %+v, want message %d expired", frame, late.ID)
+	}
+	expectNoFrame(t, recipientClient)
+	expectNoFrame(t, senderClient)
+}
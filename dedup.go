@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// Handling of a clientMsgId the client already used on the same connection.
+const (
+	duplicateModeLenient = "lenient" // Drop the duplicate silently
+	duplicateModeStrict  = "strict"  // Reply with a duplicate_client_id error frame
+)
+
+var (
+	duplicateClientIDMode = loadDuplicateClientIDMode()
+	clientIDWindow        = envInt("CLIENT_ID_WINDOW", 256) // Recent clientMsgIds remembered per connection
+)
+
+func loadDuplicateClientIDMode() string {
+	mode := strings.ToLower(envString("DUPLICATE_CLIENT_ID_MODE", duplicateModeLenient))
+	if mode != duplicateModeLenient && mode != duplicateModeStrict {
+		log.Fatalf("Unknown DUPLICATE_CLIENT_ID_MODE %q", mode)
+	}
+	return mode
+}
+
+// recentIDSet remembers the last N IDs added, evicting the oldest first.
+// It is owned by a single connection's read loop and is not goroutine-safe.
+type recentIDSet struct {
+	ids   map[string]struct{}
+	order []string // Ring buffer of IDs in insertion order
+	next  int      // Ring slot to overwrite on the next Add
+}
+
+func newRecentIDSet(size int) *recentIDSet {
+	if size < 1 {
+		size = 1
+	}
+	return &recentIDSet{ids: make(map[string]struct{}, size), order: make([]string, 0, size)}
+}
+
+// Contains reports whether id was added recently.
+func (s *recentIDSet) Contains(id string) bool {
+	_, ok := s.ids[id]
+	return ok
+}
+
+// Add records id, evicting the oldest entry when the set is full.
+func (s *recentIDSet) Add(id string) {
+	if s.Contains(id) {
+		return
+	}
+	if len(s.order) < cap(s.order) {
+		s.order = append(s.order, id)
+	} else {
+		delete(s.ids, s.order[s.next])
+		s.order[s.next] = id
+		s.next = (s.next + 1) % len(s.order)
+	}
+	s.ids[id] = struct{}{}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestRecentIDSet(t *testing.T) {
+	s := newRecentIDSet(3)
+	for _, id := range []string{"a", "b", "c"} {
+		s.Add(id)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if !s.Contains(id) {
+			t.Errorf("%s missing before the set is full", id)
+		}
+	}
+
+	// Re-adding a present ID does not take a slot or refresh it
+	s.Add("a")
+	s.Add("d")
+	if s.Contains("a") {
+		t.Error("a survived although it was the oldest")
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		if !s.Contains(id) {
+			t.Errorf("%s was evicted out of order", id)
+		}
+	}
+
+	// The ring keeps evicting oldest first as it wraps around
+	s.Add("e")
+	s.Add("f")
+	s.Add("g")
+	for _, id := range []string{"b", "c", "d"} {
+		if s.Contains(id) {
+			t.Errorf("%s still present after three newer IDs", id)
+		}
+	}
+	for _, id := range []string{"e", "f", "g"} {
+		if !s.Contains(id) {
+			t.Errorf("%s missing", id)
+		}
+	}
+	if len(s.ids) != 3 {
+		t.Errorf("set holds %d IDs, want 3", len(s.ids))
+	}
+}
+
+func TestRecentIDSetMinimumSize(t *testing.T) {
+	s := newRecentIDSet(0)
+	s.Add("a")
+	if !s.Contains("a") {
+		t.Error("a size-0 set remembers nothing; want it raised to 1")
+	}
+	s.Add("b")
+	if s.Contains("a") || !s.Contains("b") {
+		t.Error("a size-1 set must keep only the latest ID")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// deletedTombstone replaces the content of deleted messages in responses,
+// so clients can render a placeholder while ordering stays intact.
+const deletedTombstone = "[message deleted]"
+
+// deleteRequest is the data of an inbound delete frame, and of the delete
+// frame sent to the participants.
+type deleteRequest struct {
+	ID int64 `json:"id"`
+}
+
+// applyTombstone shows a deleted message with the tombstone as its content.
+func applyTombstone(message *Message) {
+	if message.Deleted {
+		message.Content = deletedTombstone
+	}
+}
+
+// handleDelete soft-deletes one of the caller's own messages: the document
+// stays, flagged deleted, with its content, edit history and signature removed.
+// Like edits, deletes are only accepted within editWindow.
+func (s *session) handleDelete(data []byte) bool {
+	if reason := s.checkWrite(); reason != "" {
+		return s.reject(reason)
+	}
+	var req deleteRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.ID <= 0 {
+		return s.reject("invalid_delete")
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	defer cancel()
+
+	var message Message
+	filter := bson.D{{Key: "tenant", Value: s.claims.TenantID()}, {Key: "_id", Value: req.ID}}
+	err := collection.FindOne(ctx, filter).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s.reject("not_found")
+	}
+	if err != nil {
+		slog.Error("Delete lookup error", "error", err)
+		return s.reject("delete_failed")
+	}
+	if message.SenderID != s.claims.ID {
+		slog.Warn("Delete of another user's message refused", "user_id", s.claims.ID, "message_id", message.ID, "sender_id", message.SenderID)
+		return s.reject("not_sender")
+	}
+	// Repeating a delete that already happened stays harmless past the window
+	if !message.Deleted && !withinEditWindow(message.Timestamp, time.Now()) {
+		return s.reject("immutable")
+	}
+
+	if !message.Deleted {
+		update := bson.D{
+			{Key: "$set", Value: bson.D{{Key: "deleted", Value: true}, {Key: "content", Value: ""}}},
+			{Key: "$unset", Value: bson.D{{Key: "edits", Value: ""}, {Key: "signature", Value: ""}, {Key: "attachment", Value: ""}}},
+		}
+		_, err := collection.UpdateOne(ctx, filter, update)
+		recentHistory.forget(s.claims.TenantID(), []int64{message.ID})
+		if err != nil {
+			slog.Error("Delete update error", "error", err)
+			return s.reject("delete_failed")
+		}
+		slog.Info("Message deleted", "message_id", message.ID, "user_id", s.claims.ID)
+		if message.Attachment != nil {
+			if err := blobStore.Delete(ctx, message.Attachment.ID); err != nil {
+				slog.Warn("Attachment blob delete error", "message_id", message.ID, "error", err)
+			}
+		}
+	}
+
+	frame := Frame{Type: envelopeDelete, Data: deleteRequest{ID: message.ID}}
+	notifyParticipants(message, frame)
+	sendToSockets(s.claims.TenantID(), s.claims.ID, s.client, frame) // The sender's other devices
+	return s.reply(frame)
+}
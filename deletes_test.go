@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestHandleDelete(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	stored, err := InsertMessage(ctx, Message{SenderID: 1, RecipientID: 2, Content: "regret"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	recipient, recipientClient := newTestConn(t, &JWTClaims{ID: 2}, nil)
+	hub.Register(recipient)
+	t.Cleanup(func() { hub.Unregister(recipient) })
+	data, _ := json.Marshal(deleteRequest{ID: stored.ID})
+
+	// The recipient may not delete what they were sent
+	rs := newSession(ctx, recipient, &JWTClaims{ID: 2})
+	if !rs.handleDelete(data) {
+		t.Fatal("handleDelete ended the session")
+	}
+	if reason := readErrorReason(t, recipientClient); reason != "not_sender" {
+		t.Errorf("recipient: reason = %q, want not_sender", reason)
+	}
+	if message := storedMessage(t, stored.ID); message.Deleted {
+		t.Fatal("message deleted by its recipient")
+	}
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(ctx, entry, claims)
+	if !s.handleDelete(data) {
+		t.Fatal("handleDelete ended the session")
+	}
+	if frameType, _ := readFrame(t, client); frameType != envelopeDelete {
+		t.Errorf("sender got %s, want the delete", frameType)
+	}
+	var event deleteRequest
+	frameType, raw := readFrame(t, recipientClient)
+	json.Unmarshal(raw, &event)
+	if frameType != envelopeDelete || event.ID != stored.ID {
+		t.Errorf("recipient got %s %s, want the delete of %d", frameType, raw, stored.ID)
+	}
+	if message := storedMessage(t, stored.ID); !message.Deleted || message.Content != "" {
+		t.Errorf("stored deleted %t with content %q, want deleted and emptied", message.Deleted, message.Content)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// deviceIDPattern is what a client may send as ?device= on /ws: a stable
+// identifier it picks once per installation.
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// DeliveryTracker remembers, per device, the newest direct message that
+// reached it. Connections that name their device catch up from there, so a
+// message reaches each device at most once, and a device that was offline
+// still gets what another device of the same user already received.
+//
+// Unread counts do not depend on it: they come from the read state of the
+// message, which any device's read receipt sets for the user as a whole,
+// so a message delivered to several devices is still counted once.
+type DeliveryTracker interface {
+	// Through returns the newest message ID delivered to the device, and
+	// false for a device never seen before.
+	Through(ctx context.Context, tenant string, userID int64, deviceID string) (int64, bool, error)
+	// Advance records delivery up to id. The position never moves back.
+	Advance(ctx context.Context, tenant string, userID int64, deviceID string, id int64) error
+}
+
+var deliveryTracker DeliveryTracker // Set by connectMongoDB
+
+// mongoDeliveryTracker keeps one document per device.
+type mongoDeliveryTracker struct {
+	coll *mongo.Collection
+}
+
+func newMongoDeliveryTracker(coll *mongo.Collection) *mongoDeliveryTracker {
+	return &mongoDeliveryTracker{coll: coll}
+}
+
+func deviceKey(tenant string, userID int64, deviceID string) string {
+	return fmt.Sprintf("%s|%d|%s", tenant, userID, deviceID)
+}
+
+func (t *mongoDeliveryTracker) Through(ctx context.Context, tenant string, userID int64, deviceID string) (int64, bool, error) {
+	var doc struct {
+		DeliveredThrough int64 `bson:"deliveredThrough"`
+	}
+	err := t.coll.FindOne(ctx, bson.D{{Key: "_id", Value: deviceKey(tenant, userID, deviceID)}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return doc.DeliveredThrough, true, nil
+}
+
+func (t *mongoDeliveryTracker) Advance(ctx context.Context, tenant string, userID int64, deviceID string, id int64) error {
+	filter := bson.D{{Key: "_id", Value: deviceKey(tenant, userID, deviceID)}}
+	update := bson.D{
+		{Key: "$max", Value: bson.D{{Key: "deliveredThrough", Value: id}}},
+		{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: time.Now().Unix()}}},
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: "tenant", Value: tenant},
+			{Key: "userId", Value: userID},
+			{Key: "deviceId", Value: deviceID},
+		}},
+	}
+	_, err := t.coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// pendingFilter matches the direct messages c has yet to receive. A device
+// the tracker knows catches up from its own position; connections without a
+// device, and devices seen for the first time, get what no device received.
+func pendingFilter(ctx context.Context, tracker DeliveryTracker, c *connEntry) (bson.D, error) {
+	if c.deviceID == "" {
+		return undeliveredFilter(c.tenant, c.userID), nil
+	}
+	through, known, err := tracker.Through(ctx, c.tenant, c.userID, c.deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		return undeliveredFilter(c.tenant, c.userID), nil
+	}
+	return bson.D{
+		{Key: "tenant", Value: c.tenant},
+		{Key: "recipientId", Value: c.userID},
+		{Key: "_id", Value: bson.D{{Key: "$gt", Value: through}}},
+	}, nil
+}
+
+// recordDeviceDelivery advances the device of c past id, when c names one.
+func recordDeviceDelivery(ctx context.Context, tracker DeliveryTracker, c *connEntry, id int64) {
+	if c.deviceID == "" || id == 0 {
+		return
+	}
+	if err := tracker.Advance(ctx, c.tenant, c.userID, c.deviceID, id); err != nil {
+		slog.Error("Device delivery update error", "user_id", c.userID, "device_id", c.deviceID, "error", err)
+	}
+}
+
+// startDeviceTracking gives a device seen for the first time a position at
+// the newest message to its user, so from then on it only catches up on
+// what it missed. Devices the tracker already knows are left alone.
+func startDeviceTracking(ctx context.Context, tracker DeliveryTracker, c *connEntry) {
+	if c.deviceID == "" {
+		return
+	}
+	if _, known, err := tracker.Through(ctx, c.tenant, c.userID, c.deviceID); err != nil || known {
+		return
+	}
+	// A user without messages yet starts the device at zero
+	var newest Message
+	filter := bson.D{{Key: "tenant", Value: c.tenant}, {Key: "recipientId", Value: c.userID}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.D{{Key: "_id", Value: 1}})
+	err := collection.FindOne(ctx, filter, opts).Decode(&newest)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		slog.Error("Newest message lookup error", "user_id", c.userID, "error", err)
+		return
+	}
+	if err := tracker.Advance(ctx, c.tenant, c.userID, c.deviceID, newest.ID); err != nil {
+		slog.Error("Device delivery update error", "user_id", c.userID, "device_id", c.deviceID, "error", err)
+	}
+}
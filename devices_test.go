@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// memoryDeliveryTracker is a DeliveryTracker kept in memory.
+type memoryDeliveryTracker struct {
+	mu      sync.Mutex
+	through map[string]int64
+}
+
+func newMemoryDeliveryTracker() *memoryDeliveryTracker {
+	return &memoryDeliveryTracker{through: make(map[string]int64)}
+}
+
+func (t *memoryDeliveryTracker) Through(_ context.Context, tenant string, userID int64, deviceID string) (int64, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id, ok := t.through[deviceKey(tenant, userID, deviceID)]
+	return id, ok, nil
+}
+
+func (t *memoryDeliveryTracker) Advance(_ context.Context, tenant string, userID int64, deviceID string, id int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := deviceKey(tenant, userID, deviceID)
+	if id > t.through[key] {
+		t.through[key] = id
+	}
+	return nil
+}
+
+func TestPerDeviceDelivery(t *testing.T) {
+	ctx := context.Background()
+	tracker := newMemoryDeliveryTracker()
+	phone := &connEntry{tenant: "acme", userID: 1, deviceID: "phone"}
+	laptop := &connEntry{tenant: "acme", userID: 1, deviceID: "laptop"}
+	tablet := &connEntry{tenant: "acme", userID: 1, deviceID: "tablet"}
+	legacy := &connEntry{tenant: "acme", userID: 1}
+
+	// Messages 1-5 reach the phone; the laptop was offline after message 3
+	for id := int64(1); id <= 5; id++ {
+		recordDeviceDelivery(ctx, tracker, phone, id)
+		if id <= 3 {
+			recordDeviceDelivery(ctx, tracker, laptop, id)
+		}
+	}
+	// A late write of an older message never moves a device back
+	recordDeviceDelivery(ctx, tracker, phone, 2)
+
+	tests := []struct {
+		name  string
+		entry *connEntry
+		want  bson.D
+	}{
+		{"phone resumes after what it got", phone, afterFilter("acme", 1, 5)},
+		{"laptop still gets 4 and 5", laptop, afterFilter("acme", 1, 3)},
+		{"new device gets what no device got", tablet, undeliveredFilter("acme", 1)},
+		{"no device id", legacy, undeliveredFilter("acme", 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pendingFilter(ctx, tracker, tt.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalBSON(t, got, tt.want) {
+				t.Errorf("pendingFilter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The same device ID of another user or tenant is another device
+	if _, known, _ := tracker.Through(ctx, "acme", 2, "phone"); known {
+		t.Error("another user's phone shares the position")
+	}
+	if _, known, _ := tracker.Through(ctx, "other", 1, "phone"); known {
+		t.Error("the same user ID in another tenant shares the position")
+	}
+}
+
+// Unread counts come from read state alone, so a message delivered to
+// several devices is counted once and a read on any device clears it.
+func TestUnreadIgnoresDelivery(t *testing.T) {
+	for _, stage := range conversationsPipeline("acme", 1, 10) {
+		data, err := bson.MarshalExtJSON(stage, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "delivered") {
+			t.Errorf("conversation stage depends on delivery state: %s", data)
+		}
+	}
+}
+
+func afterFilter(tenant string, userID, through int64) bson.D {
+	return bson.D{
+		{Key: "tenant", Value: tenant},
+		{Key: "recipientId", Value: userID},
+		{Key: "_id", Value: bson.D{{Key: "$gt", Value: through}}},
+	}
+}
+
+func equalBSON(t *testing.T, a, b bson.D) bool {
+	t.Helper()
+	x, err := bson.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := bson.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(x) == string(y)
+}
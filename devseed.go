@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// devMode enables development-only endpoints. It must be set to exactly
+// "true"; any other value (including unset) keeps them disabled.
+var devMode = os.Getenv("DEV_MODE") == "true"
+
+const maxSeedCount = 1000 // Upper bound on messages created by a single seed request
+
+type seedRequest struct {
+	UserA  int64  `json:"userA"`  // First participant
+	UserB  int64  `json:"userB"`  // Second participant
+	Count  int    `json:"count"`  // Number of messages to create
+	Tenant string `json:"tenant"` // Optional tenant, defaults to the default tenant
+}
+
+// devSeedHandler inserts synthetic messages alternating between two users,
+// for exercising pagination and history locally.
+func devSeedHandler(w http.ResponseWriter, r *http.Request) {
+	if !devMode {
+		writeError(w, http.StatusNotFound, "not_found", "Not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use POST")
+		return
+	}
+
+	if maintenanceMode.Load() {
+		writeError(w, http.StatusServiceUnavailable, "maintenance", "Sends are disabled during maintenance")
+		return
+	}
+
+	var req seedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Request body must be valid JSON")
+		return
+	}
+	if req.UserA == 0 {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "userA", "userA is required")
+		return
+	}
+	if req.UserB == 0 {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "userB", "userB is required")
+		return
+	}
+	if req.Count <= 0 || req.Count > maxSeedCount {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "count", fmt.Sprintf("count must be between 1 and %d", maxSeedCount))
+		return
+	}
+
+	created := 0
+	for i := 0; i < req.Count; i++ {
+		message := Message{Tenant: req.Tenant, SenderID: req.UserA, RecipientID: req.UserB}
+		if i%2 == 1 {
+			message.SenderID, message.RecipientID = req.UserB, req.UserA
+		}
+		message.Content = fmt.Sprintf("Seed message %d", i+1)
+
+		if _, err := InsertMessage(r.Context(), message); err != nil {
+			slog.Error("Dev seed insert error", "error", err)
+			break
+		}
+		created++
+	}
+
+	slog.Info("Dev seed finished", "created", created, "user_a", req.UserA, "user_b", req.UserB)
+	writeJSON(w, http.StatusOK, map[string]int{"created": created})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// editWindow is how long after sending a message may be edited or deleted.
+// Later attempts are rejected as immutable, keeping older messages intact
+// for audit.
+var editWindow = envDuration("EDIT_WINDOW", 15*time.Minute)
+
+// withinEditWindow reports whether a message sent at the Unix time sentAt
+// may still be changed at now. The window's last second is included.
+func withinEditWindow(sentAt int64, now time.Time) bool {
+	return now.Sub(time.Unix(sentAt, 0)) <= editWindow
+}
+
+// EditRecord keeps a previous version of an edited message.
+type EditRecord struct {
+	Content    string `bson:"content" json:"content"`       // Content before the edit
+	ReplacedAt int64  `bson:"replacedAt" json:"replacedAt"` // When this version was replaced
+}
+
+// editRequest is the data of an inbound edit frame.
+type editRequest struct {
+	ID        int64  `json:"id"`
+	Content   string `json:"content"`
+	Signature string `json:"signature,omitempty"` // Signature over the new content, if the client signs
+}
+
+// editEvent is the data of the edit frame sent to the participants.
+type editEvent struct {
+	ID        int64  `json:"id"`
+	Content   string `json:"content"`
+	Signature string `json:"signature,omitempty"`
+	EditedAt  int64  `json:"editedAt"`
+}
+
+// handleEdit replaces the content of one of the caller's own messages within
+// editWindow, keeping the prior content in the message's edit history.
+func (s *session) handleEdit(data []byte) bool {
+	if reason := s.checkWrite(); reason != "" {
+		return s.reject(reason)
+	}
+	var req editRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.ID <= 0 || req.Content == "" {
+		return s.reject("invalid_edit")
+	}
+	content, err := applyContentPolicy(req.Content)
+	if err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			return s.reject(validationErr.Reason)
+		}
+		return s.reject("invalid_edit")
+	}
+	// Sanitizing can grow the content, so the limit applies to what is stored
+	if len(content) > MaxContentBytes {
+		return s.reject("content_too_long")
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	defer cancel()
+
+	var message Message
+	filter := bson.D{{Key: "tenant", Value: s.claims.TenantID()}, {Key: "_id", Value: req.ID}}
+	err = collection.FindOne(ctx, filter).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s.reject("not_found")
+	}
+	if err != nil {
+		slog.Error("Edit lookup error", "error", err)
+		return s.reject("edit_failed")
+	}
+	if message.Deleted {
+		return s.reject("message_deleted")
+	}
+	if message.Type == typeAttachment {
+		return s.reject("not_editable")
+	}
+	if message.SenderID != s.claims.ID {
+		slog.Warn("Edit of another user's message refused", "user_id", s.claims.ID, "message_id", message.ID, "sender_id", message.SenderID)
+		return s.reject("not_sender")
+	}
+	now := time.Now()
+	if !withinEditWindow(message.Timestamp, now) {
+		return s.reject("immutable")
+	}
+
+	// Matching the old content makes concurrent edits of the same message
+	// apply one at a time instead of losing a history entry
+	filter = append(filter, bson.E{Key: "content", Value: message.Content})
+	set := bson.D{
+		{Key: "content", Value: content},
+		{Key: "editedAt", Value: now.Unix()},
+	}
+	update := bson.D{
+		{Key: "$push", Value: bson.D{{Key: "edits", Value: EditRecord{Content: message.Content, ReplacedAt: now.Unix()}}}},
+	}
+	// A signature over the old content no longer verifies
+	if req.Signature != "" {
+		set = append(set, bson.E{Key: "signature", Value: req.Signature})
+	} else {
+		update = append(update, bson.E{Key: "$unset", Value: bson.D{{Key: "signature", Value: ""}}})
+	}
+	update = append(update, bson.E{Key: "$set", Value: set})
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	recentHistory.forget(s.claims.TenantID(), []int64{message.ID})
+	if err != nil {
+		slog.Error("Edit update error", "error", err)
+		return s.reject("edit_failed")
+	}
+	if result.MatchedCount == 0 {
+		return s.reject("edit_conflict")
+	}
+
+	frame := Frame{Type: envelopeEdit, Data: editEvent{ID: message.ID, Content: content, Signature: req.Signature, EditedAt: now.Unix()}}
+	notifyParticipants(message, frame)
+	sendToSockets(s.claims.TenantID(), s.claims.ID, s.client, frame) // The sender's other devices
+	return s.reply(frame)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithinEditWindow(t *testing.T) {
+	saved := editWindow
+	t.Cleanup(func() { editWindow = saved })
+	editWindow = 15 * time.Minute
+
+	sent := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  bool
+	}{
+		{"just sent", 0, true},
+		{"one second before the end", editWindow - time.Second, true},
+		{"at the end", editWindow, true},
+		{"one nanosecond past the end", editWindow + time.Nanosecond, false},
+		{"one second past the end", editWindow + time.Second, false},
+		{"a day later", 24 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withinEditWindow(sent.Unix(), sent.Add(tt.after)); got != tt.want {
+				t.Errorf("withinEditWindow(sent, sent+%s) = %v, want %v", tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleEditLimitAfterSanitizing(t *testing.T) {
+	saved := contentPolicy
+	t.Cleanup(func() { contentPolicy = saved })
+	contentPolicy = contentPolicySanitize
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+
+	// Within the limit as sent, but every "<" becomes "&lt;" when sanitized
+	content := strings.Repeat("<", MaxContentBytes/2)
+	data, _ := json.Marshal(editRequest{ID: 1, Content: content})
+	if !s.handleEdit(data) {
+		t.Fatal("handleEdit ended the session")
+	}
+	if reason := readErrorReason(t, client); reason != "content_too_long" {
+		t.Errorf("reason = %q, want content_too_long", reason)
+	}
+}
+
+func TestEditByNonAuthor(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	stored, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "original"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+
+	// Neither the recipient nor an outsider may edit it
+	for _, userID := range []int64{1, 3} {
+		claims := &JWTClaims{ID: userID}
+		entry, client := newTestConn(t, claims, nil)
+		s := newSession(ctx, entry, claims)
+		data, _ := json.Marshal(editRequest{ID: stored.ID, Content: "rewritten"})
+		if !s.handleEdit(data) {
+			t.Fatal("handleEdit ended the session")
+		}
+		if reason := readErrorReason(t, client); reason != "not_sender" {
+			t.Errorf("user %d: reason = %q, want not_sender", userID, reason)
+		}
+	}
+	if message := storedMessage(t, stored.ID); message.Content != "original" || len(message.Edits) != 0 {
+		t.Errorf("stored %q with %d edits, want the original untouched", message.Content, len(message.Edits))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// FallbackDelivery hands a message to an out-of-band channel (SMS, email, ...)
+// when the recipient has not picked it up within the configured delay.
+type FallbackDelivery interface {
+	Deliver(ctx context.Context, message Message) error
+}
+
+// noopFallback is the default provider and silently drops fallback requests.
+type noopFallback struct{}
+
+func (noopFallback) Deliver(ctx context.Context, message Message) error { return nil }
+
+// loggingFallback only logs the fallback, useful to verify the scanner before
+// wiring a real SMS/email provider.
+type loggingFallback struct{}
+
+func (loggingFallback) Deliver(ctx context.Context, message Message) error {
+	slog.Info("Fallback delivery", "message_id", message.ID, "recipient_id", message.RecipientID)
+	return nil
+}
+
+var (
+	fallbackDelay        = envDuration("FALLBACK_DELAY", 0) // Zero disables the fallback scanner
+	fallbackScanInterval = envDuration("FALLBACK_SCAN_INTERVAL", time.Minute)
+	fallbackDelivery     = newFallbackDelivery(envString("FALLBACK_PROVIDER", "noop"))
+)
+
+const fallbackScanBatch = 100 // Maximum messages handed to the provider per scan
+
+func newFallbackDelivery(name string) FallbackDelivery {
+	switch name {
+	case "noop":
+		return noopFallback{}
+	case "log":
+		return loggingFallback{}
+	default:
+		log.Fatalf("Unknown FALLBACK_PROVIDER %q", name)
+		return nil
+	}
+}
+
+// runFallbackScanner periodically looks for messages older than the fallback
+// delay and hands them to the fallback provider until ctx is canceled.
+func runFallbackScanner(ctx context.Context) {
+	slog.Info("Fallback scanner started", "delay", fallbackDelay.String(), "interval", fallbackScanInterval.String())
+
+	ticker := time.NewTicker(fallbackScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scanForFallback(ctx)
+		}
+	}
+}
+
+// scanForFallback claims aged messages still in the sent status one at a
+// time by stamping fallbackAt before invoking the provider, so a message
+// triggers fallback at most once even with several server instances
+// scanning the same collection.
+func scanForFallback(ctx context.Context) {
+	cutoff := time.Now().Add(-fallbackDelay).Unix()
+	filter := bson.D{
+		{Key: "timestamp", Value: bson.D{{Key: "$lte", Value: cutoff}}},
+		{Key: "fallbackAt", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "status", Value: statusSent}, // Matches the partial index
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+		{Key: "roomId", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+
+	for i := 0; i < fallbackScanBatch; i++ {
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "fallbackAt", Value: time.Now().Unix()}}}}
+
+		var message Message
+		err := collection.FindOneAndUpdate(ctx, filter, update).Decode(&message)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return
+		}
+		if err != nil {
+			slog.Error("Fallback scan error", "error", err)
+			return
+		}
+
+		// Providers only get a preview; full content stays in the app
+		message.Content = previewContent(message.Content, previewLength)
+		if err := fallbackDelivery.Deliver(ctx, message); err != nil {
+			slog.Error("Fallback delivery error", "message_id", message.ID, "error", err)
+		}
+	}
+}
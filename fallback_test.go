@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// recordingFallback records the IDs of the messages handed to it.
+type recordingFallback struct{ ids []int64 }
+
+func (r *recordingFallback) Deliver(ctx context.Context, message Message) error {
+	r.ids = append(r.ids, message.ID)
+	return nil
+}
+
+func TestScanForFallbackSentOnly(t *testing.T) {
+	useTestDB(t)
+	recorder := &recordingFallback{}
+	saved := fallbackDelivery
+	fallbackDelivery = recorder
+	t.Cleanup(func() { fallbackDelivery = saved })
+
+	ctx := context.Background()
+	sent, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "still sent"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	delivered, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "picked up"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	if err := markDelivered(ctx, delivered.Tenant, []int64{delivered.ID}); err != nil {
+		t.Fatalf("markDelivered: %v", err)
+	}
+
+	scanForFallback(ctx)
+	scanForFallback(ctx) // A claimed message is not handed over again
+	if len(recorder.ids) != 1 || recorder.ids[0] != sent.ID {
+		t.Errorf("fallback got %v, want only message %d once", recorder.ids, sent.ID)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// fanOutWorkers bounds how many deliveries to room members run at once
+// across the whole server, so a message to a large room uses a fixed number
+// of goroutines instead of one per member.
+var fanOutWorkers = envInt("FANOUT_WORKERS", 32)
+
+var fanOutSlots chan struct{} // Held by each running fan-out delivery
+
+func init() {
+	if fanOutWorkers <= 0 {
+		log.Fatalf("FANOUT_WORKERS (%d) must be positive", fanOutWorkers)
+	}
+	fanOutSlots = make(chan struct{}, fanOutWorkers)
+}
+
+// fanOut calls deliver once for each of n recipients, running at most
+// fanOutWorkers of them concurrently server-wide, and returns once all have
+// finished. deliver must not call fanOut itself, or a full pool deadlocks.
+func fanOut(n int, deliver func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		fanOutSlots <- struct{}{} // Waits for a free worker before starting another goroutine
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-fanOutSlots
+				wg.Done()
+			}()
+			deliver(i)
+		}()
+	}
+	wg.Wait()
+}
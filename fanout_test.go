@@ -0,0 +1,43 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOutBoundsWorkers(t *testing.T) {
+	savedWorkers, savedSlots := fanOutWorkers, fanOutSlots
+	fanOutWorkers, fanOutSlots = 4, make(chan struct{}, 4)
+	t.Cleanup(func() { fanOutWorkers, fanOutSlots = savedWorkers, savedSlots })
+
+	const recipients = 10000
+	baseline := runtime.NumGoroutine()
+	var running, peak, peakGoroutines, calls atomic.Int64
+	fanOut(recipients, func(i int) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		calls.Add(1)
+		storeMax(&peak, n)
+		storeMax(&peakGoroutines, int64(runtime.NumGoroutine()))
+		time.Sleep(10 * time.Microsecond)
+	})
+
+	if calls.Load() != recipients {
+		t.Errorf("deliver called %d times, want %d", calls.Load(), recipients)
+	}
+	if peak.Load() > 4 {
+		t.Errorf("%d deliveries ran at once, want at most 4", peak.Load())
+	}
+	// Other tests' goroutines may come and go; allow a little slack
+	if grown := peakGoroutines.Load() - int64(baseline); grown > 4+8 {
+		t.Errorf("goroutines grew by %d during fan-out", grown)
+	}
+}
+
+// storeMax raises v to n if n is larger.
+func storeMax(v *atomic.Int64, n int64) {
+	for old := v.Load(); n > old && !v.CompareAndSwap(old, n); old = v.Load() {
+	}
+}
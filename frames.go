@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrorFrame is sent to the client when a frame is rejected without closing the socket.
+type ErrorFrame struct {
+	Type      string   `json:"type"`                // Always "error"
+	RequestID string   `json:"requestId,omitempty"` // Echoed from the rejected frame, if it had one
+	Reason    string   `json:"reason"`              // Machine-readable reason code
+	Details   []string `json:"details,omitempty"`   // Optional specifics, e.g. failed schema constraints
+}
+
+// Envelope wraps every inbound frame. Type selects the handler and Data
+// carries its payload. A frame without a type is a bare chat message.
+// RequestID is optional and chosen by the client; the ack or error frame
+// answering the frame echoes it, so replies can be matched to requests.
+type Envelope struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"requestId,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Envelope types understood by the server.
+const (
+	envelopeMessage     = "message"     // Chat message
+	envelopeTyping      = "typing"      // Ephemeral typing indicator, never stored
+	envelopeRead        = "read"        // Read receipt for received messages
+	envelopeReceived    = "received"    // Confirms messages reached a client with delivery acks
+	envelopeAck         = "ack"         // Outbound only: confirms a stored message to its sender
+	envelopeJoin        = "join"        // Join a room
+	envelopeLeave       = "leave"       // Leave a room
+	envelopeEdit        = "edit"        // Edit one of the sender's messages
+	envelopeDelete      = "delete"      // Soft-delete one of the sender's messages
+	envelopePresence    = "presence"    // Outbound only: a contact came online or went offline
+	envelopeAttachment  = "attachment"  // Announces the binary frame that follows
+	envelopeUndo        = "undo"        // Takes back a message still held for undo
+	envelopeHeld        = "held"        // Outbound only: a message waits out its undo window before it is stored
+	envelopeSubscribe   = "subscribe"   // Receive live messages of a conversation
+	envelopeUnsubscribe = "unsubscribe" // Stop receiving live messages of a conversation
+	envelopeResync      = "resync"      // Ask for the messages of a conversation after a checkpoint gap
+	envelopeCheckpoint  = "checkpoint"  // Outbound only: the highest message ID sent in a conversation
+	envelopeMessages    = "messages"    // Outbound only: the live messages of one batch window
+
+	envelopeUnreadSummary = "unreadSummary" // Outbound only: conversations and unread counts on connect
+	envelopeStatus        = "status"        // Outbound only: messages of the sender advanced to delivered or read
+	envelopeFeatures      = "features"      // Outbound only: the optional events the connection negotiated
+)
+
+// Close codes the server sends when it ends a connection:
+//
+//	1001 going away          server shutting down; reconnect later
+//	1003 unsupported data    disallowed frame type (ALLOWED_FRAME_TYPES)
+//	1008 policy violation    sustained abuse
+//	4001 token_expired       token was valid but has expired; refresh and reconnect
+//
+// Missing or malformed tokens are still refused with a 401 before the upgrade.
+const closeTokenExpired = 4001
+
+// Frame is a typed server-to-client frame with the same shape as Envelope.
+// RequestID is only set on the reply to the frame that carried it.
+type Frame struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"requestId,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// BackpressureFrame is sent when the server throttles a connection, right
+// before the error frame of the refused write. Clients should hold every
+// write that changes state (messages, reads, edits, deletes, joins, leaves)
+// for RetryAfterMs and then resend the refused one, which was not applied.
+type BackpressureFrame struct {
+	Type         string `json:"type"`         // Always "backpressure"
+	RetryAfterMs int64  `json:"retryAfterMs"` // Until the connection accepts writes again
+}
+
+// DeliveryFailedFrame tells a sender that a message can never be delivered,
+// as opposed to waiting for an offline recipient. A message refused before
+// it was stored has no messageId; its clientMsgId and clientTempId identify it.
+type DeliveryFailedFrame struct {
+	Type         string `json:"type"` // Always "deliveryFailed"
+	MessageID    int64  `json:"messageId,omitempty"`
+	ClientMsgID  string `json:"clientMsgId,omitempty"`
+	ClientTempID string `json:"clientTempId,omitempty"`
+	Reason       string `json:"reason"` // See deliveryFailureReason
+}
+
+// deliveryFailureReasons are the terminal failures a sender may learn the
+// cause of.
+var deliveryFailureReasons = map[string]bool{
+	"unknown_recipient": true, // No such user in the sender's tenant
+	"expired":           true, // Not delivered by its deliverBy deadline
+}
+
+// deliveryFailureReason is the reason a deliveryFailed frame gives for an
+// internal one. Causes that reveal a recipient's choices, like blocking the
+// sender, are masked as the generic "undeliverable".
+func deliveryFailureReason(reason string) string {
+	if deliveryFailureReasons[reason] {
+		return reason
+	}
+	return "undeliverable"
+}
+
+// writeErrorFrame sends an error frame with the given reason to the client.
+func writeErrorFrame(c *connEntry, reason string) error {
+	return writeErrorFrameDetails(c, reason, nil)
+}
+
+// writeErrorFrameDetails sends an error frame carrying additional details.
+func writeErrorFrameDetails(c *connEntry, reason string, details []string) error {
+	return c.writeJSON(ErrorFrame{Type: "error", Reason: reason, Details: details})
+}
+
+var (
+	allowedFrameTypes = parseFrameTypes(envString("ALLOWED_FRAME_TYPES", "text"))
+	closeOnFrameType  = envBool("CLOSE_ON_DISALLOWED_FRAME", false) // Close the socket instead of just replying with an error frame
+
+	// maxMessageBytes bounds every inbound message but binary attachments,
+	// see frameLimit. The limit counts the reassembled message, summing every
+	// continuation frame, so a fragmented message can never grow past it no
+	// matter how many fragments it is split into. Gorilla does not expose
+	// individual frames, so the fragment count itself cannot be limited
+	// separately.
+	// The default leaves room for JSON escaping of a MaxContentBytes body
+	// plus the envelope and other fields, so frames far over the content
+	// limit are refused before they are buffered.
+	maxMessageBytes = int64(envInt("MAX_MESSAGE_BYTES", 2*MaxContentBytes+1024))
+)
+
+// errFrameTooLarge reports an inbound message over the limit for its type.
+var errFrameTooLarge = errors.New("frame too large")
+
+// frameLimit is the largest inbound message of messageType the read loop
+// accepts: maxBlobBytes for binary frames when attachments are allowed, and
+// maxMessageBytes for everything else.
+func frameLimit(messageType int) int64 {
+	if messageType == websocket.BinaryMessage && allowedFrameTypes[websocket.BinaryMessage] {
+		return maxBlobBytes
+	}
+	return maxMessageBytes
+}
+
+// readLimit is passed to conn.SetReadLimit: the largest frameLimit of any
+// type. Gorilla fails a read that passes it with a 1009 close.
+func readLimit() int64 {
+	return max(frameLimit(websocket.TextMessage), frameLimit(websocket.BinaryMessage))
+}
+
+// readInbound reads the next message from conn, holding it to the limit for
+// its type. Gorilla's read limit is the same for every type, so a text
+// message is cut off here once it passes maxMessageBytes, before the rest
+// of it is buffered, even while binary frames may be far larger. A message
+// over its limit returns errFrameTooLarge.
+func readInbound(conn *websocket.Conn) (int, []byte, error) {
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	limit := frameLimit(messageType)
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return messageType, nil, err
+	}
+	if int64(len(data)) > limit {
+		return messageType, nil, errFrameTooLarge
+	}
+	return messageType, data, nil
+}
+
+// MaxContentBytes is the largest message content InsertMessage accepts.
+const MaxContentBytes = 4096
+
+// parseFrameTypes turns a comma-separated list of "text"/"binary" into the
+// set of accepted WebSocket message types.
+func parseFrameTypes(list string) map[int]bool {
+	types := make(map[int]bool)
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "text":
+			types[websocket.TextMessage] = true
+		case "binary":
+			types[websocket.BinaryMessage] = true
+		case "":
+		default:
+			log.Fatalf("Unknown frame type %q in ALLOWED_FRAME_TYPES", name)
+		}
+	}
+	if len(types) == 0 {
+		log.Fatal("ALLOWED_FRAME_TYPES must allow at least one frame type")
+	}
+	return types
+}
+
+// checkFrameType rejects frames whose type is not allowed. It returns false
+// when the frame must be dropped; keepOpen reports whether the read loop may
+// continue afterwards.
+func checkFrameType(c *connEntry, messageType int) (ok bool, keepOpen bool) {
+	if allowedFrameTypes[messageType] {
+		return true, true
+	}
+
+	slog.Warn("Rejected disallowed frame type", "user_id", c.userID, "frame_type", messageType)
+	if closeOnFrameType {
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "unsupported_frame_type")
+		c.writeMessage(websocket.CloseMessage, closeMsg)
+		return false, false
+	}
+	if err := writeErrorFrame(c, "unsupported_frame_type"); err != nil {
+		slog.Warn("Write error", "error", err)
+		return false, false
+	}
+	return false, true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeFragmented sends a text message of size bytes as continuation
+// frames of at most chunk bytes each.
+func writeFragmented(client *websocket.Conn, size, chunk int) error {
+	w, err := client.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	data := bytes.Repeat([]byte("x"), chunk)
+	for sent := 0; sent < size; sent += chunk {
+		n := min(chunk, size-sent)
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func TestFragmentedMessageOverReadLimit(t *testing.T) {
+	limit := readLimit()
+	_, client := newTestConn(t, &JWTClaims{ID: 1}, func(conn *websocket.Conn) {
+		conn.SetReadLimit(limit)
+		go func() {
+			// Reassembly fails once the running total passes the limit
+			_, _, err := conn.ReadMessage()
+			if !errors.Is(err, websocket.ErrReadLimit) {
+				t.Errorf("server read: err = %v, want ErrReadLimit", err)
+			}
+		}()
+	})
+
+	// The client flushes a fragment each time its 4 KiB write buffer fills.
+	// The server may close before the last fragment is written.
+	writeFragmented(client, int(limit)*2, 1024)
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+		t.Fatalf("client read: err = %v, want close %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestFragmentedMessageUnderReadLimit(t *testing.T) {
+	limit := readLimit()
+	received := make(chan int, 1)
+	_, client := newTestConn(t, &JWTClaims{ID: 1}, func(conn *websocket.Conn) {
+		conn.SetReadLimit(limit)
+		go func() {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Errorf("server read: %v", err)
+			}
+			received <- len(data)
+		}()
+	})
+
+	size := int(limit) - 10
+	if err := writeFragmented(client, size, 512); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	select {
+	case n := <-received:
+		if n != size {
+			t.Errorf("reassembled %d bytes, want %d", n, size)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was never reassembled")
+	}
+}
+
+func TestReadInboundLimitsByType(t *testing.T) {
+	savedTypes, savedBlob := allowedFrameTypes, maxBlobBytes
+	t.Cleanup(func() { allowedFrameTypes, maxBlobBytes = savedTypes, savedBlob })
+	allowedFrameTypes = parseFrameTypes("text,binary")
+	maxBlobBytes = 4 * maxMessageBytes
+
+	type result struct {
+		messageType, n int
+		err            error
+	}
+	results := make(chan result, 3)
+	_, client := newTestConn(t, &JWTClaims{ID: 1}, func(conn *websocket.Conn) {
+		conn.SetReadLimit(readLimit())
+		go func() {
+			for {
+				messageType, data, err := readInbound(conn)
+				results <- result{messageType, len(data), err}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+
+	writes := []struct {
+		messageType int
+		size        int64
+		wantErr     error
+	}{
+		{websocket.TextMessage, maxMessageBytes, nil},
+		{websocket.BinaryMessage, maxBlobBytes, nil},
+		// Far below the read limit, but over the limit for text
+		{websocket.TextMessage, maxMessageBytes + 1, errFrameTooLarge},
+	}
+	for _, w := range writes {
+		if err := client.WriteMessage(w.messageType, bytes.Repeat([]byte("x"), int(w.size))); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		select {
+		case got := <-results:
+			if !errors.Is(got.err, w.wantErr) || got.messageType != w.messageType {
+				t.Errorf("%d bytes of type %d: got type %d, err %v; want err %v", w.size, w.messageType, got.messageType, got.err, w.wantErr)
+			}
+			if w.wantErr == nil && int64(got.n) != w.size {
+				t.Errorf("%d bytes of type %d: read %d bytes", w.size, w.messageType, got.n)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message was never read")
+		}
+	}
+}
+
+func TestCheckFrameType(t *testing.T) {
+	savedTypes, savedClose := allowedFrameTypes, closeOnFrameType
+	t.Cleanup(func() { allowedFrameTypes, closeOnFrameType = savedTypes, savedClose })
+
+	for _, allowed := range []string{"text", "binary", "text,binary"} {
+		allowedFrameTypes = parseFrameTypes(allowed)
+		for _, messageType := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+			entry, client := newTestConn(t, &JWTClaims{ID: 1}, nil)
+			ok, keepOpen := checkFrameType(entry, messageType)
+			if ok != allowedFrameTypes[messageType] || !keepOpen {
+				t.Errorf("%s allowed, type %d: ok = %t, keepOpen = %t", allowed, messageType, ok, keepOpen)
+			}
+			if !ok {
+				if reason := readErrorReason(t, client); reason != "unsupported_frame_type" {
+					t.Errorf("%s allowed, type %d: reason = %q, want unsupported_frame_type", allowed, messageType, reason)
+				}
+			}
+		}
+	}
+
+	// Optionally the socket is closed instead
+	allowedFrameTypes, closeOnFrameType = parseFrameTypes("text"), true
+	entry, client := newTestConn(t, &JWTClaims{ID: 1}, nil)
+	if ok, keepOpen := checkFrameType(entry, websocket.BinaryMessage); ok || keepOpen {
+		t.Errorf("closing: ok = %t, keepOpen = %t, want both false", ok, keepOpen)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseUnsupportedData {
+		t.Errorf("client read: err = %v, want close %d", err, websocket.CloseUnsupportedData)
+	}
+}
+
+func TestReadLimitBoundary(t *testing.T) {
+	savedTypes := allowedFrameTypes
+	t.Cleanup(func() { allowedFrameTypes = savedTypes })
+	allowedFrameTypes = parseFrameTypes("text")
+
+	type result struct {
+		n   int
+		err error
+	}
+	results := make(chan result, 2)
+	_, client := newTestConn(t, &JWTClaims{ID: 1}, func(conn *websocket.Conn) {
+		conn.SetReadLimit(readLimit())
+		go func() {
+			for {
+				_, data, err := readInbound(conn)
+				results <- result{len(data), err}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+
+	limit := int(readLimit())
+	for _, size := range []int{limit, limit + 1} {
+		if err := client.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatalf("writing %d bytes: %v", size, err)
+		}
+		select {
+		case got := <-results:
+			switch {
+			case size == limit && (got.err != nil || got.n != size):
+				t.Errorf("%d bytes, at the limit: read %d bytes, err %v", size, got.n, got.err)
+			case size > limit && !errors.Is(got.err, websocket.ErrReadLimit) && !errors.Is(got.err, errFrameTooLarge):
+				t.Errorf("%d bytes, over the limit: err = %v, want a read limit error", size, got.err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d bytes were never read", size)
+		}
+	}
+}
+
+func TestContentLimitBoundary(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	if _, err := InsertMessage(ctx, Message{SenderID: 1, RecipientID: 2, Content: strings.Repeat("x", MaxContentBytes)}); err != nil {
+		t.Errorf("content at the limit: %v", err)
+	}
+	_, err := InsertMessage(ctx, Message{SenderID: 1, RecipientID: 2, Content: strings.Repeat("x", MaxContentBytes+1)})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Reason != "content_too_long" {
+		t.Errorf("content over the limit: err = %v, want content_too_long", err)
+	}
+	if n := storedCount(t); n != 1 {
+		t.Errorf("%d messages stored, want only the one at the limit", n)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// GeoIPProvider resolves an IP address to an ISO 3166-1 alpha-2 country code.
+// It returns "" when the country is unknown.
+type GeoIPProvider interface {
+	Country(ip net.IP) (string, error)
+}
+
+// noopGeoIP is the default provider and never knows the country.
+type noopGeoIP struct{}
+
+func (noopGeoIP) Country(ip net.IP) (string, error) { return "", nil }
+
+var (
+	geoIP            GeoIPProvider = noopGeoIP{}
+	allowedCountries               = parseCountries(envString("GEO_ALLOWED_COUNTRIES", "")) // Empty allows every country
+	blockedCountries               = parseCountries(envString("GEO_BLOCKED_COUNTRIES", ""))
+)
+
+func init() {
+	if (len(allowedCountries) > 0 || len(blockedCountries) > 0) && geoIP == (noopGeoIP{}) {
+		slog.Warn("Geofencing configured without a GeoIP provider; all countries resolve as unknown")
+	}
+}
+
+func parseCountries(list string) map[string]bool {
+	countries := make(map[string]bool)
+	for _, code := range strings.Split(list, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			countries[code] = true
+		}
+	}
+	return countries
+}
+
+// geofenceAllows reports whether a client at ip may connect. Blocked
+// countries are always refused; when an allow list is configured, only
+// those countries are admitted, which also refuses unknown countries.
+func geofenceAllows(ip net.IP) bool {
+	if len(allowedCountries) == 0 && len(blockedCountries) == 0 {
+		return true
+	}
+	if ip == nil {
+		return len(allowedCountries) == 0
+	}
+
+	country, err := geoIP.Country(ip)
+	if err != nil {
+		slog.Error("GeoIP lookup error", "ip", ip.String(), "error", err)
+	}
+	country = strings.ToUpper(country)
+
+	if blockedCountries[country] {
+		return false
+	}
+	if len(allowedCountries) > 0 {
+		return allowedCountries[country]
+	}
+	return true
+}
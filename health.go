@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// healthzHandler reports liveness and whether maintenance mode is active. It
+// answers 200 whenever the process is serving requests.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "ok",
+		"maintenance": maintenanceMode.Load(),
+	})
+}
+
+// readyzHandler reports readiness to take traffic: 200 when MongoDB answers
+// a ping within two seconds, 503 otherwise so the load balancer drains us.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := mongoClient.Ping(ctx, nil); err != nil {
+		slog.Error("Readiness check failed, MongoDB ping error", "error", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status":  "unavailable",
+			"mongodb": "unreachable",
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":  "ready",
+		"mongodb": "ok",
+	})
+}
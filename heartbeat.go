@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	pingInterval = envDuration("PING_INTERVAL", 30*time.Second) // How often the server pings each client
+	readTimeout  = envDuration("READ_TIMEOUT", 60*time.Second)  // Silence after which a connection is considered dead
+)
+
+// heartbeatStatsInterval controls the optional diagnostic heartbeat frame,
+// sent only to connections that opt in with the heartbeatStats capability.
+// Zero disables it.
+var heartbeatStatsInterval = envDuration("HEARTBEAT_STATS_INTERVAL", 0)
+
+// HeartbeatFrame gives clients a periodic view of their connection's health.
+type HeartbeatFrame struct {
+	Type         string `json:"type"`         // Always "heartbeat"
+	ServerTime   int64  `json:"serverTime"`   // Unix time in milliseconds
+	QueuedForYou int32  `json:"queuedForYou"` // Writes to this connection still waiting to be sent
+	ConnID       string `json:"connId"`       // ID of this connection
+}
+
+func init() {
+	if pingInterval <= 0 || pingInterval >= readTimeout {
+		log.Fatalf("PING_INTERVAL (%s) must be positive and shorter than READ_TIMEOUT (%s)", pingInterval, readTimeout)
+	}
+}
+
+// extendReadDeadline gives the client another readTimeout to send a frame or pong.
+func (c *connEntry) extendReadDeadline() {
+	c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+}
+
+// startHeartbeat pings the client every pingInterval and extends the read
+// deadline whenever a pong arrives, so a half-open connection makes the
+// read loop fail once readTimeout passes without any traffic. When enabled
+// and the client opted in, it also sends a HeartbeatFrame every
+// heartbeatStatsInterval, and checkpoints every checkpointInterval to
+// connections tracking them. onDead is called when a write fails, so work tied
+// to the connection can be canceled before the read loop notices. The
+// returned function stops the pinger.
+func (c *connEntry) startHeartbeat(onDead func()) (stop func()) {
+	c.extendReadDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+
+	// Tickers are made before the goroutine starts, so the settings are read
+	// once, here. A nil channel never fires, leaving stats heartbeats off.
+	ticker := time.NewTicker(pingInterval)
+	var stats, checkpoints <-chan time.Time
+	var statsTicker, checkpointTicker *time.Ticker
+	if heartbeatStatsInterval > 0 && c.caps[capHeartbeatStats] {
+		statsTicker = time.NewTicker(heartbeatStatsInterval)
+		stats = statsTicker.C
+	}
+	if c.tracksCheckpoints() {
+		checkpointTicker = time.NewTicker(checkpointInterval)
+		checkpoints = checkpointTicker.C
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		if statsTicker != nil {
+			defer statsTicker.Stop()
+		}
+		if checkpointTicker != nil {
+			defer checkpointTicker.Stop()
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-checkpoints:
+				if err := c.sendCheckpoints(); err != nil {
+					slog.Warn("Checkpoint failed", "user_id", c.userID, "error", err)
+					onDead()
+					return
+				}
+			case <-stats:
+				frame := HeartbeatFrame{
+					Type:         "heartbeat",
+					ServerTime:   time.Now().UnixMilli(),
+					QueuedForYou: c.queued.Load(),
+					ConnID:       c.connID,
+				}
+				if err := c.writeJSON(frame); err != nil {
+					slog.Warn("Heartbeat failed", "user_id", c.userID, "error", err)
+					onDead()
+					return
+				}
+			case <-ticker.C:
+				// WriteControl may be called concurrently with other writes
+				if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					slog.Warn("Ping failed", "user_id", c.userID, "error", err)
+					onDead()
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultHistoryLimit = 50  // Page size when limit is not given
+	maxHistoryLimit     = 200 // Largest page a client may request
+)
+
+// historyHandler serves GET /messages?with={otherUserId}&limit=&before=&cursor=,
+// returning the conversation between the caller and another user, newest
+// first. before is a unix timestamp; only older messages are returned. A full
+// page carries the position of its last message in the X-Next-Cursor header,
+// and as a Link with rel="next"; passing it back as cursor returns the next
+// older page. The cursor is signed, so clients cannot forge a position.
+// Members of a room may pass room={roomId} instead of with. Deleted messages
+// are kept in place with a tombstone as their content.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET")
+		return
+	}
+
+	claims, err := validateJWTToken(bearerToken(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	var otherID, roomID int64
+	if v := query.Get("room"); v != "" {
+		roomID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || roomID <= 0 {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "room", "room must be a positive room ID")
+			return
+		}
+	} else {
+		otherID, err = strconv.ParseInt(query.Get("with"), 10, 64)
+		if err != nil || otherID <= 0 {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "with", "with must be a positive user ID")
+			return
+		}
+	}
+
+	limit := defaultHistoryLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "limit", "limit must be between 1 and 200")
+			return
+		}
+	}
+
+	// Cursors only resume the conversation and caller they were issued for
+	scope := fmt.Sprintf("%s|%d|with:%d", claims.TenantID(), claims.ID, otherID)
+	if roomID != 0 {
+		scope = fmt.Sprintf("%s|%d|room:%d", claims.TenantID(), claims.ID, roomID)
+	}
+	var after *pageCursor
+	if v := query.Get("cursor"); v != "" {
+		c, err := parseCursor(scope, v)
+		if err != nil {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "cursor", "cursor is invalid")
+			return
+		}
+		after = &c
+	}
+
+	// Bound how many queries the user runs at once
+	if !queryLimits.acquire(claims.TenantID(), claims.ID) {
+		writeError(w, http.StatusTooManyRequests, "too_many_queries", "Too many queries in flight; retry when one completes")
+		return
+	}
+	defer queryLimits.release(claims.TenantID(), claims.ID)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.D{
+		{Key: "tenant", Value: claims.TenantID()},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "senderId", Value: claims.ID}, {Key: "recipientId", Value: otherID}},
+			bson.D{{Key: "senderId", Value: otherID}, {Key: "recipientId", Value: claims.ID}},
+		}},
+	}
+	if roomID != 0 {
+		// Room history is only visible to members
+		member, err := isRoomMember(ctx, claims.TenantID(), claims.ID, roomID)
+		if err != nil {
+			slog.Error("Room membership check error", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load messages")
+			return
+		}
+		if !member {
+			writeError(w, http.StatusForbidden, "forbidden", "Not a member of this room")
+			return
+		}
+		filter = bson.D{{Key: "tenant", Value: claims.TenantID()}, {Key: "roomId", Value: roomID}}
+	}
+	if v := query.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "before", "before must be a unix timestamp")
+			return
+		}
+		filter = append(filter, bson.E{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: before}}})
+	}
+	// The newest page of an active conversation may come from memory
+	if after == nil && query.Get("before") == "" && recentHistory.enabled(limit) {
+		page, err := recentPage(ctx, historyKey(claims.TenantID(), claims.ID, otherID, roomID), filter, limit)
+		if err != nil {
+			slog.Error("History query error", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load messages")
+			return
+		}
+		if len(page) == limit {
+			setNextPage(w, r, scope, page[limit-1])
+		}
+		for i := range page {
+			applyTombstone(&page[i])
+		}
+		writeJSON(w, http.StatusOK, append([]Message{}, page...))
+		return
+	}
+
+	// Page bounds, in the page order below
+	var bounds bson.A
+	if after != nil {
+		// Strictly after the cursor
+		bounds = append(bounds, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: after.Timestamp}}}},
+			bson.D{{Key: "timestamp", Value: after.Timestamp}, {Key: "_id", Value: bson.D{{Key: "$lt", Value: after.ID}}}},
+		}}})
+	}
+
+	// Newest first; the sequence ID breaks ties within the same second
+	sort := bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}
+	opts := options.Find().SetSort(sort).SetLimit(int64(limit))
+
+	// The last message of a full page is where the next page starts. Looking
+	// it up first lets the cursor go out in a header ahead of the streamed body.
+	var last Message
+	err = historyColl.FindOne(ctx, withBounds(filter, bounds), options.FindOne().
+		SetSort(sort).
+		SetSkip(int64(limit-1)).
+		SetProjection(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})).
+		Decode(&last)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		// A short page is the last one
+	case err != nil:
+		slog.Error("History query error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load messages")
+		return
+	default:
+		setNextPage(w, r, scope, last)
+		// Ending the page at that message rather than after limit messages
+		// keeps the body and the cursor in step if messages arrive in between
+		bounds = append(bounds, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "timestamp", Value: bson.D{{Key: "$gt", Value: last.Timestamp}}}},
+			bson.D{{Key: "timestamp", Value: last.Timestamp}, {Key: "_id", Value: bson.D{{Key: "$gte", Value: last.ID}}}},
+		}}})
+		opts.SetLimit(0)
+	}
+
+	cursor, err := historyColl.Find(ctx, withBounds(filter, bounds), opts)
+	if err != nil {
+		slog.Error("History query error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load messages")
+		return
+	}
+	defer cursor.Close(ctx)
+
+	started, err := streamMessages(ctx, w, cursor, applyTombstone)
+	if err != nil && !started {
+		slog.Error("History decode error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to load messages")
+		return
+	}
+	if err != nil {
+		// The status is already sent; the cut-off array tells the client
+		slog.Error("History stream error", "error", err)
+	}
+}
+
+// withBounds returns filter narrowed by the conditions in bounds.
+func withBounds(filter bson.D, bounds bson.A) bson.D {
+	if len(bounds) == 0 {
+		return filter
+	}
+	return append(filter[:len(filter):len(filter)], bson.E{Key: "$and", Value: bounds})
+}
+
+// setNextPage points the client at the page after last, the final message
+// of a full page.
+func setNextPage(w http.ResponseWriter, r *http.Request, scope string, last Message) {
+	next := signCursor(scope, pageCursor{Timestamp: last.Timestamp, ID: last.ID})
+	w.Header().Set("X-Next-Cursor", next)
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPageURL(r, next)))
+}
+
+// nextPageURL returns the URL of the request with cursor set to next.
+func nextPageURL(r *http.Request, next string) string {
+	query := r.URL.Query()
+	query.Set("cursor", next)
+	u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// streamFlushEvery is how many messages streamMessages writes between flushes.
+const streamFlushEvery = 50
+
+// messageCursor is the part of a *mongo.Cursor that streamMessages reads.
+type messageCursor interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+}
+
+// streamMessages writes the messages of cursor as a JSON array, encoding each
+// one as it is fetched instead of holding the whole result in memory. prepare
+// is applied to every message before it is written. Until started is true
+// nothing has been sent, so the caller can still answer an error with an
+// error status; a later error can only cut the array short.
+func streamMessages(ctx context.Context, w http.ResponseWriter, cursor messageCursor, prepare func(*Message)) (started bool, err error) {
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err := io.WriteString(w, "[")
+		return err
+	}
+
+	for n := 0; cursor.Next(ctx); n++ {
+		var message Message
+		if err := cursor.Decode(&message); err != nil {
+			return started, err
+		}
+		prepare(&message)
+
+		if n == 0 {
+			err = start()
+		} else {
+			_, err = io.WriteString(w, ",")
+		}
+		if err == nil {
+			err = enc.Encode(message)
+		}
+		if err != nil {
+			return started, err
+		}
+		if flusher != nil && (n+1)%streamFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return started, err
+	}
+
+	if !started {
+		if err := start(); err != nil {
+			return started, err
+		}
+	}
+	if _, err := io.WriteString(w, "]\n"); err != nil {
+		return started, err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return started, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// sliceCursor is a messageCursor over messages, failing with err once
+// failAt messages have been read when err is set.
+type sliceCursor struct {
+	messages []Message
+	pos      int
+	failAt   int
+	err      error
+}
+
+func (c *sliceCursor) Next(context.Context) bool {
+	if c.err != nil && c.pos == c.failAt {
+		return false
+	}
+	if c.pos >= len(c.messages) {
+		return false
+	}
+	c.pos++
+	return true
+}
+
+func (c *sliceCursor) Decode(val interface{}) error {
+	*val.(*Message) = c.messages[c.pos-1]
+	return nil
+}
+
+func (c *sliceCursor) Err() error {
+	if c.pos == c.failAt {
+		return c.err
+	}
+	return nil
+}
+
+func TestStreamMessagesMany(t *testing.T) {
+	const count = 10000
+	messages := make([]Message, count)
+	for i := range messages {
+		messages[i] = Message{ID: int64(count - i), Content: "hello", Deleted: i%3 == 0}
+	}
+
+	rec := httptest.NewRecorder()
+	started, err := streamMessages(context.Background(), rec, &sliceCursor{messages: messages}, applyTombstone)
+	if err != nil || !started {
+		t.Fatalf("streamMessages = %v, %v", started, err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !rec.Flushed {
+		t.Error("response was never flushed")
+	}
+
+	var got []Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body is not a JSON array: %v", err)
+	}
+	if len(got) != count {
+		t.Fatalf("got %d messages, want %d", len(got), count)
+	}
+	for i, m := range got {
+		if m.ID != messages[i].ID {
+			t.Fatalf("message %d has ID %d, want %d", i, m.ID, messages[i].ID)
+		}
+		if want := "hello"; messages[i].Deleted {
+			if m.Content != deletedTombstone {
+				t.Fatalf("deleted message %d content = %q, want the tombstone", i, m.Content)
+			}
+		} else if m.Content != want {
+			t.Fatalf("message %d content = %q, want %q", i, m.Content, want)
+		}
+	}
+}
+
+func TestStreamMessagesEmpty(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if _, err := streamMessages(context.Background(), rec, &sliceCursor{}, applyTombstone); err != nil {
+		t.Fatal(err)
+	}
+	var got []Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("body = %q, want an empty array", rec.Body.String())
+	}
+}
+
+func TestStreamMessagesError(t *testing.T) {
+	boom := errors.New("cursor failed")
+
+	rec := httptest.NewRecorder()
+	started, err := streamMessages(context.Background(), rec, &sliceCursor{err: boom}, applyTombstone)
+	if !errors.Is(err, boom) || started {
+		t.Errorf("error before the first message: started = %v, err = %v", started, err)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("wrote %q before failing; the caller could not send an error status", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	cursor := &sliceCursor{messages: make([]Message, 5), failAt: 2, err: boom}
+	started, err = streamMessages(context.Background(), rec, cursor, applyTombstone)
+	if !errors.Is(err, boom) || !started {
+		t.Errorf("error mid-stream: started = %v, err = %v", started, err)
+	}
+	if json.Valid(rec.Body.Bytes()) {
+		t.Errorf("a cut-off stream must not look like a complete array: %q", rec.Body.String())
+	}
+}
+
+func TestHistoryPages(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	for i := int64(1); i <= 5; i++ {
+		message := Message{ID: i, Tenant: defaultTenant, SenderID: 1, RecipientID: 2, Content: "hello", Timestamp: 1_700_000_000 + i/2}
+		if _, err := collection.InsertOne(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := testToken(t, 1, time.Now().Add(time.Hour))
+	get := func(query string) ([]Message, string, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/messages?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		historyHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /messages?%s: status = %d, body %s", query, rec.Code, rec.Body)
+		}
+		var page []Message
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("body is not a JSON array: %v", err)
+		}
+		return page, rec.Header().Get("X-Next-Cursor"), rec.Header().Get("Link")
+	}
+	ids := func(page []Message) []int64 {
+		var out []int64
+		for _, m := range page {
+			out = append(out, m.ID)
+		}
+		return out
+	}
+
+	page, next, link := get("with=2&limit=2")
+	if got := ids(page); !slices.Equal(got, []int64{5, 4}) || next == "" {
+		t.Fatalf("first page = %v, cursor %q", got, next)
+	}
+	if want := `</messages?cursor=` + url.QueryEscape(next) + `&limit=2&with=2>; rel="next"`; link != want {
+		t.Errorf("Link = %s, want %s", link, want)
+	}
+	page, next, _ = get("with=2&limit=2&cursor=" + url.QueryEscape(next))
+	if got := ids(page); !slices.Equal(got, []int64{3, 2}) || next == "" {
+		t.Fatalf("second page = %v, cursor %q", got, next)
+	}
+	page, next, link = get("with=2&limit=2&cursor=" + url.QueryEscape(next))
+	if got := ids(page); !slices.Equal(got, []int64{1}) || next != "" || link != "" {
+		t.Errorf("last page = %v, cursor %q, link %q", got, next, link)
+	}
+
+	page, _, _ = get("with=2&before=1700000002")
+	if got := ids(page); !slices.Equal(got, []int64{3, 2, 1}) {
+		t.Errorf("before page = %v, want [3 2 1]", got)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// The first history page of an active conversation can be served from memory.
+// The cache holds the newest historyCacheMessages of up to
+// historyCacheConversations conversations, evicting the least recently read,
+// so it holds at most their product in messages, each up to MaxContentBytes.
+// It is off by default. Every change on this instance updates or drops the
+// affected entry; changes made through another instance show up once the
+// entry is older than historyCacheTTL.
+var (
+	historyCacheMessages      = envInt("HISTORY_CACHE_MESSAGES", 0)              // Newest messages cached per conversation; zero disables the cache
+	historyCacheConversations = envInt("HISTORY_CACHE_CONVERSATIONS", 1000)      // Conversations cached at once
+	historyCacheTTL           = envDuration("HISTORY_CACHE_TTL", 30*time.Second) // Age after which an entry is reloaded
+)
+
+func init() {
+	if historyCacheMessages < 0 || historyCacheMessages > maxHistoryLimit {
+		log.Fatalf("HISTORY_CACHE_MESSAGES (%d) must be between 0 and %d", historyCacheMessages, maxHistoryLimit)
+	}
+	if historyCacheMessages > 0 && (historyCacheConversations <= 0 || historyCacheTTL <= 0) {
+		log.Fatalf("HISTORY_CACHE_CONVERSATIONS (%d) and HISTORY_CACHE_TTL (%s) must be positive", historyCacheConversations, historyCacheTTL)
+	}
+}
+
+var recentHistory = newHistoryCache(historyCacheConversations, historyCacheMessages)
+
+// historyKey identifies a conversation in the history cache.
+func historyKey(tenant string, userID, otherID, roomID int64) string {
+	if roomID != 0 {
+		return tenant + "|" + roomConversationID(roomID)
+	}
+	return tenant + "|" + directConversationID(userID, otherID)
+}
+
+// messageHistoryKey returns the cache key of the conversation of message.
+func messageHistoryKey(message Message) string {
+	return historyKey(message.Tenant, message.SenderID, message.RecipientID, message.RoomID)
+}
+
+// cachedID names a cached message across tenants.
+type cachedID struct {
+	tenant string
+	id     int64
+}
+
+// historyEntry is the newest part of one conversation, newest first. Holding
+// fewer than the cache's per-conversation limit means it is the whole
+// conversation.
+type historyEntry struct {
+	key      string
+	messages []Message
+	loadedAt time.Time
+}
+
+// historyLoad is a read of a conversation from MongoDB on a cache miss. A
+// change while it runs makes it stale, and its result is then not cached.
+type historyLoad struct {
+	key   string
+	stale bool
+}
+
+// historyCache is an LRU of recent conversation history.
+type historyCache struct {
+	mu          sync.Mutex
+	maxEntries  int
+	maxMessages int
+	entries     map[string]*list.Element // Key -> element holding a *historyEntry
+	lru         *list.List               // Most recently read at the front
+	byID        map[cachedID]string      // Cached message -> key of its entry
+	loads       map[*historyLoad]struct{}
+}
+
+func newHistoryCache(maxEntries, maxMessages int) *historyCache {
+	return &historyCache{
+		maxEntries:  maxEntries,
+		maxMessages: maxMessages,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		byID:        make(map[cachedID]string),
+		loads:       make(map[*historyLoad]struct{}),
+	}
+}
+
+// enabled reports whether pages of limit messages can be served from the cache.
+func (c *historyCache) enabled(limit int) bool {
+	return c.maxMessages > 0 && limit <= c.maxMessages
+}
+
+// get returns the newest limit messages of the conversation with key, or
+// false when it is not cached or its entry is older than historyCacheTTL.
+func (c *historyCache) get(key string, limit int, now time.Time) ([]Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem := c.entries[key]
+	if elem == nil {
+		return nil, false
+	}
+	entry := elem.Value.(*historyEntry)
+	if now.Sub(entry.loadedAt) > historyCacheTTL {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return append([]Message{}, entry.messages[:min(limit, len(entry.messages))]...), true
+}
+
+// begin registers a load of the conversation with key from MongoDB.
+func (c *historyCache) begin(key string) *historyLoad {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	load := &historyLoad{key: key}
+	c.loads[load] = struct{}{}
+	return load
+}
+
+// finish caches what load read, the newest messages of its conversation
+// newest first, unless something changed while it ran.
+func (c *historyCache) finish(load *historyLoad, messages []Message, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.loads, load)
+	if load.stale {
+		return
+	}
+	if elem := c.entries[load.key]; elem != nil {
+		c.remove(elem)
+	}
+	entry := &historyEntry{key: load.key, messages: slices.Clone(messages[:min(len(messages), c.maxMessages)]), loadedAt: now}
+	c.entries[load.key] = c.lru.PushFront(entry)
+	for _, message := range entry.messages {
+		c.byID[cachedID{message.Tenant, message.ID}] = load.key
+	}
+	if c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// abandon unregisters a load that failed.
+func (c *historyCache) abandon(load *historyLoad) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.loads, load)
+}
+
+// add puts a newly stored message into its conversation's entry, if cached.
+// Conversations not cached stay so; they are loaded when next read.
+func (c *historyCache) add(message Message) {
+	if c.maxMessages == 0 {
+		return
+	}
+	message.ClientTempID = "" // History never carries it
+	key := messageHistoryKey(message)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.staleLoads(func(load *historyLoad) bool { return load.key == key })
+	elem := c.entries[key]
+	id := cachedID{message.Tenant, message.ID}
+	if elem == nil || c.byID[id] != "" {
+		return
+	}
+	entry := elem.Value.(*historyEntry)
+	// Keep history order, newest first with the ID breaking timestamp ties
+	pos := 0
+	for pos < len(entry.messages) && olderThan(message, entry.messages[pos]) {
+		pos++
+	}
+	if pos == c.maxMessages {
+		return // Older than everything cached
+	}
+	entry.messages = append(entry.messages[:pos], append([]Message{message}, entry.messages[pos:]...)...)
+	c.byID[id] = key
+	if len(entry.messages) > c.maxMessages {
+		last := entry.messages[len(entry.messages)-1]
+		delete(c.byID, cachedID{last.Tenant, last.ID})
+		entry.messages = entry.messages[:c.maxMessages]
+	}
+}
+
+// olderThan reports whether a comes before b in the conversation, by
+// timestamp and then by sequence ID.
+func olderThan(a, b Message) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.ID < b.ID
+}
+
+// forget drops the entries holding any of the given messages after they
+// changed in MongoDB, and keeps loads running meanwhile from being cached.
+func (c *historyCache) forget(tenant string, ids []int64) {
+	if c.maxMessages == 0 || len(ids) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A load does not know its messages until it ends, so any of them may
+	// have read the old version
+	c.staleLoads(func(*historyLoad) bool { return true })
+	for _, id := range ids {
+		if key := c.byID[cachedID{tenant, id}]; key != "" {
+			c.remove(c.entries[key])
+		}
+	}
+}
+
+// staleLoads marks the running loads that match as stale. c.mu must be held.
+func (c *historyCache) staleLoads(match func(*historyLoad) bool) {
+	for load := range c.loads {
+		if match(load) {
+			load.stale = true
+		}
+	}
+}
+
+// remove drops an entry and its messages. c.mu must be held.
+func (c *historyCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*historyEntry)
+	delete(c.entries, entry.key)
+	for _, message := range entry.messages {
+		delete(c.byID, cachedID{message.Tenant, message.ID})
+	}
+}
+
+// recentPage returns the newest limit messages matching filter, the history
+// of the conversation with key, from the cache or else from MongoDB, caching
+// the newest messages read.
+func recentPage(ctx context.Context, key string, filter bson.D, limit int) ([]Message, error) {
+	if page, ok := recentHistory.get(key, limit, time.Now()); ok {
+		return page, nil
+	}
+	load := recentHistory.begin(key)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(recentHistory.maxMessages))
+	cursor, err := historyColl.Find(ctx, filter, opts)
+	if err != nil {
+		recentHistory.abandon(load)
+		return nil, err
+	}
+	var messages []Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		recentHistory.abandon(load)
+		return nil, err
+	}
+	recentHistory.finish(load, messages, time.Now())
+	return messages[:min(limit, len(messages))], nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// cachedIDs returns the IDs of a page served by the cache, or nil on a miss.
+func cachedIDs(c *historyCache, key string, limit int) []int64 {
+	page, ok := c.get(key, limit, time.Now())
+	if !ok {
+		return nil
+	}
+	ids := []int64{}
+	for _, message := range page {
+		ids = append(ids, message.ID)
+	}
+	return ids
+}
+
+func TestHistoryCache(t *testing.T) {
+	c := newHistoryCache(2, 3)
+	now := time.Now()
+	message := func(id int64, ts int64) Message {
+		return Message{ID: id, Tenant: defaultTenant, SenderID: 1, RecipientID: 2, Timestamp: ts}
+	}
+	key := messageHistoryKey(message(0, 0))
+	if key != historyKey(defaultTenant, 2, 1, 0) {
+		t.Fatal("both sides of a conversation must share a key")
+	}
+
+	if ids := cachedIDs(c, key, 2); ids != nil {
+		t.Fatalf("cold cache hit with %v", ids)
+	}
+	// Inserts into a conversation not cached leave it cold
+	c.add(message(1, 100))
+	if ids := cachedIDs(c, key, 2); ids != nil {
+		t.Fatalf("insert warmed the cache with %v", ids)
+	}
+
+	c.finish(c.begin(key), []Message{message(2, 101), message(1, 100)}, now)
+	if ids := cachedIDs(c, key, 2); !slices.Equal(ids, []int64{2, 1}) {
+		t.Errorf("after load: %v, want [2 1]", ids)
+	}
+	c.add(message(4, 103))
+	c.add(message(3, 103))
+	if ids := cachedIDs(c, key, 3); !slices.Equal(ids, []int64{4, 3, 2}) {
+		t.Errorf("after inserts: %v, want [4 3 2], trimmed to three", ids)
+	}
+	c.add(message(0, 50))
+	if ids := cachedIDs(c, key, 3); !slices.Equal(ids, []int64{4, 3, 2}) {
+		t.Errorf("after an older insert: %v, want [4 3 2]", ids)
+	}
+
+	// A change to a message trimmed off the entry leaves it alone
+	c.forget(defaultTenant, []int64{1})
+	if ids := cachedIDs(c, key, 1); !slices.Equal(ids, []int64{4}) {
+		t.Errorf("after forgetting a message not cached: %v, want [4]", ids)
+	}
+	c.forget("other", []int64{3})
+	if ids := cachedIDs(c, key, 1); !slices.Equal(ids, []int64{4}) {
+		t.Errorf("after a change in another tenant: %v, want [4]", ids)
+	}
+	c.forget(defaultTenant, []int64{3})
+	if ids := cachedIDs(c, key, 1); ids != nil {
+		t.Errorf("after an edit: served %v from a dropped entry", ids)
+	}
+
+	// A change while a load runs keeps the load from being cached
+	load := c.begin(key)
+	c.forget(defaultTenant, []int64{99})
+	c.finish(load, []Message{message(2, 101)}, now)
+	if ids := cachedIDs(c, key, 1); ids != nil {
+		t.Errorf("stale load cached as %v", ids)
+	}
+	load = c.begin(key)
+	c.add(message(5, 104))
+	c.finish(load, []Message{message(2, 101)}, now)
+	if ids := cachedIDs(c, key, 1); ids != nil {
+		t.Errorf("load overtaken by an insert cached as %v", ids)
+	}
+
+	// The least recently read conversation goes first
+	keys := []string{historyKey(defaultTenant, 1, 2, 0), historyKey(defaultTenant, 0, 0, 7), historyKey(defaultTenant, 0, 0, 8)}
+	for _, k := range keys[:2] {
+		c.finish(c.begin(k), []Message{}, now)
+	}
+	cachedIDs(c, keys[0], 1)
+	c.finish(c.begin(keys[2]), []Message{}, now)
+	for i, want := range []bool{true, false, true} {
+		if _, ok := c.get(keys[i], 1, now); ok != want {
+			t.Errorf("%s cached = %v, want %v", keys[i], ok, want)
+		}
+	}
+
+	if _, ok := c.get(keys[0], 1, now.Add(historyCacheTTL+time.Second)); ok {
+		t.Error("entry served past historyCacheTTL")
+	}
+}
+
+func TestHistoryCacheServesRecentPage(t *testing.T) {
+	useTestDB(t)
+	saved := recentHistory
+	recentHistory = newHistoryCache(10, 5)
+	t.Cleanup(func() { recentHistory = saved })
+
+	ctx := context.Background()
+	var stored []Message
+	for i := 0; i < 3; i++ {
+		message, err := InsertMessage(ctx, Message{SenderID: 1, RecipientID: 2, Content: fmt.Sprint("hello ", i)})
+		if err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+		stored = append(stored, message)
+	}
+	token := testToken(t, 2, time.Now().Add(time.Hour))
+	get := func(query string) ([]Message, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/messages?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		historyHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /messages?%s: status = %d, body %s", query, rec.Code, rec.Body)
+		}
+		var page []Message
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("body is not a JSON array: %v", err)
+		}
+		return page, rec.Header().Get("X-Next-Cursor")
+	}
+	// Changing the stored copy behind the cache's back shows which one is served
+	tamper := func(id int64) {
+		t.Helper()
+		filter := bson.D{{Key: "_id", Value: id}}
+		if _, err := collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "content", Value: "tampered"}}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, next := get("with=1&limit=2")
+	if len(page) != 2 || page[0].ID != stored[2].ID || next == "" {
+		t.Fatalf("first read: %d messages, newest %d, cursor %q", len(page), page[0].ID, next)
+	}
+	tamper(stored[2].ID)
+	if page, _ = get("with=1&limit=2"); page[0].Content != stored[2].Content {
+		t.Errorf("second read got %q, want the cached %q", page[0].Content, stored[2].Content)
+	}
+
+	// A new message joins the cached entry, and an edit drops it
+	newest, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "reply"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	if page, _ = get("with=1&limit=2"); page[0].ID != newest.ID || page[1].Content != stored[2].Content {
+		t.Errorf("after insert: got %d %q, want %d then the cached message", page[0].ID, page[1].Content, newest.ID)
+	}
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(ctx, entry, claims)
+	s.handleFrame([]byte(fmt.Sprintf(`{"type":"edit","data":{"id":%d,"content":"edited"}}`, stored[1].ID)))
+	readFrame(t, client)
+	page, _ = get("with=1&limit=5")
+	if len(page) != 4 || page[1].Content != "tampered" || page[2].Content != "edited" {
+		t.Errorf("after edit: %+v, want all four reloaded", page)
+	}
+
+	// Older pages and larger ones than the cache holds always go to MongoDB
+	tamper(stored[0].ID)
+	if page, _ = get("with=1&limit=6"); len(page) != 4 || page[3].Content != "tampered" {
+		t.Errorf("limit over the cache size: %+v", page)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// APIError is the machine-readable error body returned by REST endpoints.
+type APIError struct {
+	Code    string `json:"code"`            // Stable error code clients can switch on
+	Message string `json:"message"`         // Human-readable description
+	Field   string `json:"field,omitempty"` // Offending request field, when applicable
+}
+
+type errorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Response write error", "error", err)
+	}
+}
+
+// writeError writes the standard {"error":{...}} envelope.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, errorEnvelope{Error: APIError{Code: code, Message: msg}})
+}
+
+// writeFieldError writes the standard error envelope naming the offending field.
+func writeFieldError(w http.ResponseWriter, status int, code, field, msg string) {
+	writeJSON(w, status, errorEnvelope{Error: APIError{Code: code, Message: msg, Field: field}})
+}
+
+// writeAuthError writes a 401 telling the client whether its token expired
+// or is invalid, so it knows whether refreshing the token can help.
+func writeAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTokenExpired) {
+		writeError(w, http.StatusUnauthorized, "token_expired", "Token has expired")
+		return
+	}
+	writeError(w, http.StatusUnauthorized, "token_invalid", "Missing or invalid token")
+}
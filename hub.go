@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const writeWait = 10 * time.Second // Time allowed to write a frame to a client
+
+// connEntry wraps an authenticated connection. Gorilla supports only one
+// concurrent writer per connection, and besides the connection's own read
+// loop any sender may deliver to it, so every write goes through writeMu.
+// Long-poll requests register a pseudo-connection with pollCh set instead
+// of conn.
+type connEntry struct {
+	userID   int64
+	tenant   string
+	connID   string          // Random ID for correlating logs and client diagnostics
+	deviceID string          // Client-chosen stable device ID; empty if not given
+	caps     map[string]bool // Client capabilities the connection opted into
+	events   map[string]bool // Optional event frames negotiated, see negotiateEvents; nil for all
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+	queued   atomic.Int32 // Writes waiting for or holding writeMu
+	pollCh   chan Message // Non-nil for long-poll pseudo-connections
+	acks     *ackTracker  // Messages awaiting a received frame; nil without the deliveryAcks capability
+
+	statusWindow time.Duration // Coalescing window for receipts, see statusWindowFor
+	statuses     statusBatch   // Receipts held for the window
+
+	batch messageBatch // Live messages held for the batch window, see batches
+
+	checkpointMu sync.Mutex
+	sentLast     map[string]int64 // Highest message ID written per conversation since the last checkpoint; nil without checkpoints
+
+	subsMu sync.Mutex
+	subs   map[string]bool // Explicit subscribe (true) or unsubscribe (false) by conversation ID, see subscribedTo
+
+	replayMu  sync.Mutex
+	replaying bool           // Catching up on connect; live messages wait in held, see holdLive
+	held      []Message      // Live messages kept back during catch-up
+	replayed  map[int64]bool // IDs of messages the catch-up has written
+}
+
+func newConnEntry(claims *JWTClaims, conn *websocket.Conn) *connEntry {
+	return &connEntry{userID: claims.ID, tenant: claims.TenantID(), connID: newConnID(), conn: conn}
+}
+
+// newConnID returns a random 16-character hex connection ID.
+func newConnID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeMessage serializes writes to the connection and bounds them with a deadline.
+func (c *connEntry) writeMessage(messageType int, data []byte) error {
+	c.queued.Add(1)
+	defer c.queued.Add(-1)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// writeJSON marshals v and sends it as a text frame.
+func (c *connEntry) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := c.writeMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	if message, ok := v.(Message); ok {
+		c.noteSent(message)
+	}
+	return nil
+}
+
+// Hub tracks the live connections of every online user. A user may be
+// connected from several devices at once; each connection is its own entry.
+type Hub struct {
+	mu    sync.RWMutex
+	conns map[int64][]*connEntry // Keyed by user ID
+}
+
+func newHub() *Hub {
+	return &Hub{conns: make(map[int64][]*connEntry)}
+}
+
+var hub = newHub() // Registry of online users
+
+// Register adds entry to the user's connections.
+func (h *Hub) Register(entry *connEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns[entry.userID] = append(h.conns[entry.userID], entry)
+	slog.Info("Connection registered in hub", "user_id", entry.userID, "conn_id", entry.connID, "devices", len(h.conns[entry.userID]), "online", len(h.conns))
+}
+
+// Unregister removes entry, leaving the user's other connections in place.
+func (h *Hub) Unregister(entry *connEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := h.conns[entry.userID]
+	for i, e := range entries {
+		if e != entry {
+			continue
+		}
+		entries = append(entries[:i:i], entries[i+1:]...)
+		if len(entries) == 0 {
+			delete(h.conns, entry.userID)
+		} else {
+			h.conns[entry.userID] = entries
+		}
+		slog.Info("Connection removed from hub", "user_id", entry.userID, "conn_id", entry.connID, "devices", len(entries), "online", len(h.conns))
+		return
+	}
+}
+
+// Conns returns the connections of a user in tenant, long-poll entries included.
+func (h *Hub) Conns(tenant string, userID int64) []*connEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var entries []*connEntry
+	for _, entry := range h.conns[userID] {
+		if entry.tenant == tenant {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Sockets returns the live WebSockets of a user in tenant, for events that
+// long-poll clients do not receive.
+func (h *Hub) Sockets(tenant string, userID int64) []*connEntry {
+	var sockets []*connEntry
+	for _, entry := range h.Conns(tenant, userID) {
+		if entry.conn != nil {
+			sockets = append(sockets, entry)
+		}
+	}
+	return sockets
+}
+
+// sendToSockets writes frame to every live WebSocket of a user in tenant
+// except skip, which may be nil, and reports how many writes succeeded.
+// Optional event frames skip sockets that did not negotiate them.
+func sendToSockets(tenant string, userID int64, skip *connEntry, v interface{}) int {
+	frame, isFrame := v.(Frame)
+	sent := 0
+	for _, entry := range hub.Sockets(tenant, userID) {
+		if isFrame && !entry.accepts(frame.Type) {
+			continue
+		}
+		if entry != skip && writeToSocket(entry, v) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// accepts reports whether a frame of frameType may be sent to the
+// connection. Only optional events the connection did not negotiate are
+// refused.
+func (c *connEntry) accepts(frameType string) bool {
+	if _, optional := eventCaps[frameType]; !optional || c.events == nil {
+		return true
+	}
+	return c.events[frameType]
+}
+
+// writeToSocket writes v to one WebSocket and reports whether it succeeded.
+// A socket that fails is closed, which makes the device's read loop exit and
+// unregister the connection. Messages of conversations the connection is
+// not subscribed to are not written. A message held back while the
+// connection catches up is not written yet; markReady delivers and settles
+// it later. So is a message batched for the connection, which flushBatch
+// delivers and settles.
+func writeToSocket(entry *connEntry, v interface{}) bool {
+	if message, ok := v.(Message); ok {
+		if !entry.subscribedTo(message) || entry.hold(message) {
+			return false
+		}
+		if entry.batches() {
+			entry.batchMessage(message)
+			return false
+		}
+	} else if frame, ok := v.(Frame); entry.batches() && !(ok && (frame.Type == envelopeTyping || frame.Type == envelopePresence)) {
+		entry.flushBatch() // Nothing but typing and presence overtakes batched messages
+	}
+	if err := entry.writeJSON(v); err != nil {
+		slog.Warn("Write to device failed", "user_id", entry.userID, "conn_id", entry.connID, "error", err)
+		entry.conn.Close()
+		return false
+	}
+	return true
+}
+
+// deliverMessage pushes a stored message to every connection of its
+// recipient in the same tenant. Offline recipients keep the message in
+// MongoDB. It counts as delivered once any socket has taken it, or for a
+// socket with delivery acks, once its client confirms it. A message
+// already past its delivery deadline expires instead.
+func deliverMessage(message Message) {
+	if message.pastDeadline(time.Now()) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		expireMessage(ctx, message, time.Now())
+		return
+	}
+
+	entries := hub.Conns(message.Tenant, message.RecipientID)
+	if len(entries) == 0 {
+		slog.Info("Recipient offline, message left in MongoDB", "recipient_id", message.RecipientID, "message_id", message.ID)
+		return
+	}
+
+	// Long-poll pseudo-connections take deliveries on their channel
+	for _, entry := range entries {
+		if entry.pollCh == nil {
+			continue
+		}
+		select {
+		case entry.pollCh <- message:
+			slog.Info("Message handed to long-poll", "message_id", message.ID, "recipient_id", message.RecipientID)
+		default:
+			slog.Warn("Long-poll buffer full, message left in MongoDB", "recipient_id", message.RecipientID, "message_id", message.ID)
+		}
+	}
+
+	message.markStatus(statusDelivered, time.Now())
+	var reached []*connEntry
+	for _, entry := range hub.Sockets(message.Tenant, message.RecipientID) {
+		if !writeToSocket(entry, message) {
+			continue
+		}
+		if entry.acks != nil {
+			entry.acks.track(entry, message) // Delivered once the client confirms it
+			continue
+		}
+		reached = append(reached, entry)
+	}
+	if len(reached) == 0 {
+		return
+	}
+	slog.Info("Message delivered", "message_id", message.ID, "recipient_id", message.RecipientID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := markDelivered(ctx, message.Tenant, []int64{message.ID}); err != nil {
+		slog.Error("Mark delivered error", "error", err)
+	} else {
+		notifyStatus(message.Tenant, map[int64][]int64{message.SenderID: {message.ID}}, statusDelivered, time.Now())
+	}
+	for _, entry := range reached {
+		recordDeviceDelivery(ctx, deliveryTracker, entry, message.ID)
+	}
+}
+
+// CloseAll sends a close frame with the given code to every live WebSocket
+// and returns how many were notified. Each read loop exits once its client
+// answers the close, which is what unregisters it. Long-poll entries have no
+// socket and are skipped.
+func (h *Hub) CloseAll(code int, text string) int {
+	h.mu.RLock()
+	var entries []*connEntry
+	for _, userEntries := range h.conns {
+		for _, entry := range userEntries {
+			if entry.conn != nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	msg := websocket.FormatCloseMessage(code, text)
+	for _, entry := range entries {
+		// WriteControl may be called concurrently with other writes
+		if err := entry.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+			slog.Warn("Close frame failed", "user_id", entry.userID, "error", err)
+		}
+	}
+	return len(entries)
+}
+
+// notifyParticipants sends frame to every device of the participants of a
+// stored message other than its sender: the recipient of a direct message,
+// or the members of its room through the bounded fan-out pool.
+func notifyParticipants(message Message, frame Frame) {
+	userIDs := []int64{message.RecipientID}
+	if message.RoomID != 0 {
+		members, err := roomMembers(message.Tenant, message.RoomID)
+		if err != nil {
+			slog.Error("Room member lookup error", "room_id", message.RoomID, "error", err)
+			return
+		}
+		userIDs = members
+	}
+
+	fanOut(len(userIDs), func(i int) {
+		if userIDs[i] != message.SenderID {
+			sendToSockets(message.Tenant, userIDs[i], nil, frame)
+		}
+	})
+}
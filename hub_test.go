@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMessageReachesEveryDevice(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	phone, phoneClient := newTestConn(t, &JWTClaims{ID: 1}, nil)
+	laptop, laptopClient := newTestConn(t, &JWTClaims{ID: 1}, nil)
+	for _, entry := range []*connEntry{phone, laptop} {
+		hub.Register(entry)
+		t.Cleanup(func() { hub.Unregister(entry) })
+	}
+
+	claims := &JWTClaims{ID: 2}
+	sender, senderClient := newTestConn(t, claims, nil)
+	s := newSession(ctx, sender, claims)
+	if !s.handleFrame([]byte(`{"recipientId":1,"content":"to both"}`)) {
+		t.Fatal("send ended the session")
+	}
+	readReply(t, senderClient)
+	phoneGot, laptopGot := readMessage(t, phoneClient), readMessage(t, laptopClient)
+	if phoneGot.ID == 0 || phoneGot.ID != laptopGot.ID || laptopGot.Content != "to both" {
+		t.Errorf("phone got %+v and laptop %+v, want the same message on both", phoneGot, laptopGot)
+	}
+
+	// Disconnecting one device leaves the other registered
+	hub.Unregister(phone)
+	if conns := hub.Conns(defaultTenant, 1); len(conns) != 1 || conns[0] != laptop {
+		t.Errorf("after the phone left, hub holds %d connections, want only the laptop", len(conns))
+	}
+}
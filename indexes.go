@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// messageIndexes backs the history and inbox queries. Every message query is
+// scoped by tenant, so tenant leads each key.
+var messageIndexes = []mongo.IndexModel{
+	{
+		// Conversation history between two users
+		Keys: bson.D{
+			{Key: "tenant", Value: 1},
+			{Key: "senderId", Value: 1},
+			{Key: "recipientId", Value: 1},
+			{Key: "timestamp", Value: -1},
+		},
+		Options: options.Index().SetName("tenant_sender_recipient_timestamp"),
+	},
+	{
+		// Inbox: everything addressed to a user
+		Keys: bson.D{
+			{Key: "tenant", Value: 1},
+			{Key: "recipientId", Value: 1},
+			{Key: "timestamp", Value: -1},
+		},
+		Options: options.Index().SetName("tenant_recipient_timestamp"),
+	},
+	{
+		// Room history and catch-up
+		Keys: bson.D{
+			{Key: "tenant", Value: 1},
+			{Key: "roomId", Value: 1},
+			{Key: "_id", Value: 1},
+		},
+		Options: options.Index().SetName("tenant_room_id"),
+	},
+	{
+		// Full-text search; tenant is a prefix, so every $text query must match it exactly
+		Keys: bson.D{
+			{Key: "tenant", Value: 1},
+			{Key: "content", Value: "text"},
+		},
+		Options: options.Index().SetName("tenant_content_text"),
+	},
+	{
+		// Fallback scanner. MongoDB rejects $exists: false in a partial filter,
+		// so the index covers messages still sent and leads with fallbackAt,
+		// whose missing value the scanner matches as null.
+		Keys: bson.D{
+			{Key: "fallbackAt", Value: 1},
+			{Key: "timestamp", Value: 1},
+		},
+		Options: options.Index().SetName("fallback_sent_timestamp").
+			SetPartialFilterExpression(bson.D{{Key: "status", Value: statusSent}}),
+	},
+	{
+		// Expiry scanner: only messages with a deadline that are still sent
+		Keys: bson.D{{Key: "deliverBy", Value: 1}},
+		Options: options.Index().SetName("expiry_sent_deliver_by").
+			SetPartialFilterExpression(bson.D{
+				{Key: "status", Value: statusSent},
+				{Key: "deliverBy", Value: bson.D{{Key: "$exists", Value: true}}},
+			}),
+	},
+}
+
+// ensureIndexes creates the message and room member indexes. CreateMany is a
+// no-op for indexes that already exist with the same spec, so this is safe on
+// every boot.
+func ensureIndexes(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	names, err := collection.Indexes().CreateMany(ctx, messageIndexes)
+	if err != nil {
+		slog.Error("MongoDB index creation error", "error", err)
+		return
+	}
+	slog.Info("MongoDB indexes ensured", "indexes", names)
+
+	names, err = roomMembersColl.Indexes().CreateMany(ctx, roomMemberIndexes)
+	if err != nil {
+		slog.Error("MongoDB room member index creation error", "error", err)
+		return
+	}
+	slog.Info("MongoDB room member indexes ensured", "indexes", names)
+}
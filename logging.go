@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is the minimum level written, from LOG_LEVEL. Setting it up as a
+// package variable installs the JSON logger before main runs; the standard
+// log package is routed through it as well, so log.Fatal output stays JSON.
+var logLevel = initLogging(envString("LOG_LEVEL", "info"))
+
+func initLogging(name string) slog.Level {
+	var level slog.Level
+	switch strings.ToLower(name) {
+	case "debug":
+		level = slog.LevelDebug
+	case "info":
+		level = slog.LevelInfo
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		log.Fatalf("Unknown LOG_LEVEL %q", name)
+	}
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	return level
+}
+
+// redactSensitive keeps message contents and raw frames out of the logs,
+// even at debug. Turn it off only on a development machine.
+var redactSensitive = envBool("REDACT_SENSITIVE", true)
+
+// tokenFingerprint identifies a JWT in logs without revealing it: the first
+// 12 hex characters of its SHA-256. Tokens are bearer credentials and are
+// never written out in full.
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// sensitiveAttr logs value under key only when REDACT_SENSITIVE is off.
+func sensitiveAttr(key, value string) slog.Attr {
+	if redactSensitive {
+		return slog.String(key, "[REDACTED]")
+	}
+	return slog.String(key, value)
+}
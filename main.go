@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -16,6 +22,8 @@ import (
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/connstring"
 )
 
 // Message represents the structure of a message document in MongoDB.
@@ -28,21 +36,61 @@ func init() {
 	if secretKey == "" {
 		log.Fatal("JWT_SECRET_KEY environment variable not set")
 	}
-	jwtSecretKey = []byte(secretKey)                        // Convert to byte slice
-	log.Println("JWT secret key has been set successfully") // Log confirmation
+	jwtSecretKey = []byte(secretKey) // Convert to byte slice
+
+	// Keys generated as random bytes are usually shipped base64-encoded
+	if envBool("JWT_SECRET_B64", false) {
+		decodedKey, err := base64.StdEncoding.DecodeString(secretKey)
+		if err != nil {
+			log.Fatal("JWT_SECRET_KEY is not valid base64: ", err)
+		}
+		jwtSecretKey = decodedKey
+	}
+	slog.Info("JWT secret key has been set")
 }
 
 type JWTClaims struct {
-	ID    int64  `json:"id"`    // Custom claim for user ID
-	Level string `json:"level"` // Custom claim for user level
+	ID       int64  `json:"id"`                 // Custom claim for user ID
+	Level    string `json:"level"`              // Custom claim for user level
+	Tenant   string `json:"tenant"`             // Custom claim for tenant; optional
+	Platform string `json:"platform,omitempty"` // Client platform hint, e.g. mobile or desktop; optional
 	jwt.RegisteredClaims
 }
+
+// defaultTenant scopes users whose token carries no tenant claim.
+var defaultTenant = envString("DEFAULT_TENANT", "default")
+
+// TenantID returns the tenant the claims belong to, falling back to defaultTenant.
+func (c *JWTClaims) TenantID() string {
+	if c.Tenant == "" {
+		return defaultTenant
+	}
+	return c.Tenant
+}
+
 type Message struct {
-	ID          int64  `bson:"_id"`         // Custom sequence ID
-	SenderID    int64  `bson:"senderId"`    // Sender of the message
-	RecipientID int64  `bson:"recipientId"` // Recipient of the message
-	Content     string `bson:"content"`     // The message content
-	Timestamp   int64  `bson:"timestamp"`   // Timestamp when the message is sent
+	ID              int64          `bson:"_id" json:"id"`                                              // Custom sequence ID
+	Tenant          string         `bson:"tenant" json:"-"`                                            // Tenant the message belongs to
+	SenderID        int64          `bson:"senderId" json:"senderId"`                                   // Sender of the message
+	ClientMsgID     string         `bson:"clientMsgId,omitempty" json:"clientMsgId,omitempty"`         // Client-generated ID, unique per connection
+	ClientTempID    string         `bson:"-" json:"clientTempId,omitempty"`                            // Client correlation ID echoed in the ack, never stored
+	RecipientID     int64          `bson:"recipientId" json:"recipientId"`                             // Recipient of the message
+	RoomID          int64          `bson:"roomId,omitempty" json:"roomId,omitempty"`                   // Room the message was posted to, instead of a recipient
+	ConversationID  string         `bson:"conversationId,omitempty" json:"conversationId,omitempty"`   // Stable ID of the direct conversation or room
+	ConversationKey string         `bson:"conversationKey,omitempty" json:"conversationKey,omitempty"` // Normalized participant pair, used as shard key
+	Content         string         `bson:"content" json:"content"`                                     // The message content
+	Signature       string         `bson:"signature,omitempty" json:"signature,omitempty"`             // Client signature over the content, passed through unchanged
+	Timestamp       int64          `bson:"timestamp" json:"timestamp"`                                 // Timestamp when the message is sent
+	Status          MessageStatus  `bson:"status,omitempty" json:"status,omitempty"`                   // Lifecycle status: sent, delivered or read
+	StatusHistory   []StatusChange `bson:"statusHistory,omitempty" json:"statusHistory,omitempty"`     // When each status was reached, oldest first
+	Delivered       bool           `bson:"delivered" json:"delivered"`                                 // Whether the message reached the recipient's socket; kept alongside status for older clients
+	ReadAt          int64          `bson:"readAt,omitempty" json:"readAt,omitempty"`                   // When the recipient read the message; kept alongside status for older clients
+	EditedAt        int64          `bson:"editedAt,omitempty" json:"editedAt,omitempty"`               // When the content was last edited
+	Edits           []EditRecord   `bson:"edits,omitempty" json:"edits,omitempty"`                     // Previous versions of the content, oldest first
+	Deleted         bool           `bson:"deleted,omitempty" json:"deleted,omitempty"`                 // Soft-deleted by the sender; content is cleared
+	Type            string         `bson:"type,omitempty" json:"type,omitempty"`                       // typeAttachment for blob messages, empty for text
+	DeliverBy       int64          `bson:"deliverBy,omitempty" json:"deliverBy,omitempty"`             // Unix time after which the message expires undelivered; zero for none
+	Attachment      *Attachment    `bson:"attachment,omitempty" json:"attachment,omitempty"`           // Reference to the stored blob of an attachment message
 }
 
 type IncomingMessage struct {
@@ -54,96 +102,319 @@ type IncomingMessage struct {
 
 var (
 	mongoClient *mongo.Client
+	mongoDB     *mongo.Database   // Database selected by MONGO_DB
 	collection  *mongo.Collection // Global variable for collection
+	historyColl *mongo.Collection // Messages collection for history/search reads, honoring READ_PREFERENCE
 	seqColl     *mongo.Collection // Collection for sequence handling
 )
 
-// InsertMessage validates the message and inserts it into MongoDB.
-func InsertMessage(message Message) error {
-	// Validate that SenderID, RecipientID, and Content are non-empty.
-	if message.SenderID == 0 || message.RecipientID == 0 || message.Content == "" {
-		return errors.New("validation error: senderId, recipientId, and content are required")
-	}
+// ValidationError reports a message rejected before storage. Reason is the
+// machine-readable code sent to the client in the error frame.
+type ValidationError struct {
+	Reason string
+	Msg    string
+}
 
-	// Retrieve the next value in the sequence for message ID.
-	seq, err := getNextSequence("message_sequence")
+func (e *ValidationError) Error() string {
+	return "validation error: " + e.Msg
+}
+
+// typeAttachment is the type of messages whose body is a stored blob.
+const typeAttachment = "attachment"
+
+// InsertMessage validates the message and inserts it into MongoDB, returning
+// the stored message with its assigned ID and timestamp. Validation and the
+// insert share one 5s timeout derived from ctx.
+func InsertMessage(ctx context.Context, message Message) (Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	message, err := validateMessage(ctx, message)
 	if err != nil {
-		return err
+		return Message{}, err
 	}
+	return insertValidated(ctx, message)
+}
 
-	// Set the message ID to the next sequence value.
-	message.ID = seq
-	message.Timestamp = time.Now().Unix()
+// insertValidated inserts a message that already passed validateMessage,
+// assigning its ID and timestamp. Sequence allocation and the insert share
+// one 5s timeout derived from ctx.
+func insertValidated(ctx context.Context, message Message) (Message, error) {
+	start := time.Now()
+	defer func() { metrics.InsertLatency.Observe(time.Since(start).Seconds()) }()
 
-	// Insert the validated message into MongoDB.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err = collection.InsertOne(ctx, message)
+	isRoom := message.RoomID != 0
+
+	// Give the message the stable ID of its direct conversation or room.
+	if assignConversationIDs {
+		if isRoom {
+			message.ConversationID = roomConversationID(message.RoomID)
+		} else {
+			message.ConversationID = directConversationID(message.SenderID, message.RecipientID)
+		}
+	}
+
+	// Tag the message with its conversation so a sharded collection keeps it co-located.
+	if storeConversationKey && !isRoom {
+		message.ConversationKey = conversationKey(message.SenderID, message.RecipientID)
+	}
+
+	// Retrieve the next value in the sequence for message ID, together with
+	// a timestamp that never runs behind earlier IDs when ordering is strict.
+	if strictTimestampOrder {
+		seq, ts, err := getNextSequenceWithTimestamp(ctx, messageSequenceName)
+		if err != nil {
+			metrics.InsertErrors.WithLabelValues(tenantLabel(message.Tenant)).Inc()
+			return Message{}, err
+		}
+		message.ID = seq
+		message.Timestamp = ts
+	} else {
+		seq, err := getNextSequence(ctx, messageSequenceName)
+		if err != nil {
+			metrics.InsertErrors.WithLabelValues(tenantLabel(message.Tenant)).Inc()
+			return Message{}, err
+		}
+
+		// Set the message ID to the next sequence value.
+		message.ID = seq
+		message.Timestamp = time.Now().Unix()
+	}
+
+	// Every message starts its lifecycle as sent
+	message.Status = statusSent
+	message.StatusHistory = []StatusChange{{Status: statusSent, At: message.Timestamp}}
+
+	// Insert the validated message into MongoDB.
+	_, err := collection.InsertOne(ctx, message)
 	if err != nil {
-		return err
+		metrics.InsertErrors.WithLabelValues(tenantLabel(message.Tenant)).Inc()
+		return Message{}, err
+	}
+	metrics.MessagesInserted.WithLabelValues(tenantLabel(message.Tenant)).Inc()
+	recentHistory.add(message)
+
+	slog.Info("Message inserted", "message_id", message.ID, "sender_id", message.SenderID, "recipient_id", message.RecipientID)
+	return message, nil
+}
+
+// validateMessage applies the checks a message must pass before it is stored
+// and returns it with server-owned fields reset and the content policy
+// applied. Senders with side effects before the insert, like an attachment
+// upload, run it first and then call insertValidated.
+func validateMessage(ctx context.Context, message Message) (Message, error) {
+	// Fields the server owns are never taken from the client frame
+	message.EditedAt = 0
+	message.Edits = nil
+	message.Delivered = false
+	message.ReadAt = 0
+	message.Deleted = false
+	message.ConversationID = ""
+	message.ConversationKey = ""
+
+	// Validate that SenderID, RecipientID, and Content are non-empty. Room
+	// messages carry a RoomID instead of a RecipientID, and attachments
+	// carry their body in the blob store instead of Content.
+	isRoom := message.RoomID != 0
+	hasTarget := (message.RecipientID != 0) != isRoom // Exactly one of the two
+	hasBody := message.Content != "" || message.Type == typeAttachment
+	if message.SenderID == 0 || !hasBody || !hasTarget {
+		return Message{}, &ValidationError{Reason: "missing_fields", Msg: "senderId, content, and exactly one of recipientId or roomId are required"}
+	}
+
+	// A delivery deadline must still be ahead, and only applies to direct
+	// messages; rooms track each member's progress separately.
+	if message.DeliverBy != 0 && (isRoom || message.DeliverBy <= time.Now().Unix()) {
+		return Message{}, &ValidationError{Reason: "invalid_deliver_by", Msg: "deliverBy must be a future Unix time on a direct message"}
 	}
 
-	log.Printf("Message inserted successfully with ID: %d", message.ID)
+	// Reject messages to oneself unless self-chat is enabled.
+	if !isRoom && message.SenderID == message.RecipientID && !allowSelfChat {
+		return Message{}, &ValidationError{Reason: "self_message", Msg: "senderId and recipientId must differ"}
+	}
+
+	// Messages without an explicit tenant belong to the default tenant.
+	if message.Tenant == "" {
+		message.Tenant = defaultTenant
+	}
+
+	// Reject messages to users that do not exist in the sender's tenant when a validator is configured.
+	if recipientValidator != nil && !isRoom {
+		exists, err := recipientValidator(ctx, message.Tenant, message.RecipientID)
+		if err != nil {
+			metrics.InsertErrors.WithLabelValues(tenantLabel(message.Tenant)).Inc()
+			return Message{}, err
+		}
+		if !exists {
+			return Message{}, &ValidationError{Reason: "unknown_recipient", Msg: "recipientId does not refer to an existing user"}
+		}
+	}
+
+	// Apply the configured markup policy before anything is stored.
+	content, err := applyContentPolicy(message.Content)
+	if err != nil {
+		return Message{}, err
+	}
+	message.Content = content
+
+	// Bound the stored size of a single message. Sanitizing can grow the
+	// content, so this runs on what will actually be stored.
+	if len(message.Content) > MaxContentBytes {
+		return Message{}, &ValidationError{Reason: "content_too_long", Msg: fmt.Sprintf("content exceeds %d bytes", MaxContentBytes)}
+	}
+
+	return message, nil
+}
+
+// allowSelfChat permits messages whose sender and recipient are the same user
+// ("notes to self"). When disabled such messages fail validation.
+var allowSelfChat = envBool("ALLOW_SELF_CHAT", false)
+
+// storeConversationKey adds conversationKey to every inserted message so the
+// collection can be sharded by conversation.
+var storeConversationKey = envBool("STORE_CONVERSATION_KEY", false)
+
+// conversationKey returns "low:high" for a participant pair, so both
+// directions of a conversation share the same key.
+func conversationKey(a, b int64) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
+}
+
+const messageSequenceName = "message_sequence" // Sequence document used for message IDs
+
+// ensureSequence creates the sequence document initialized to 0 if it does
+// not exist yet. getNextSequence upserts as well, so this only moves write
+// problems on the sequences collection to startup instead of the first send.
+// It is idempotent: an existing sequence is left untouched.
+func ensureSequence(ctx context.Context, sequenceName string) error {
+	filter := bson.D{{Key: "_id", Value: sequenceName}}
+	update := bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "sequence", Value: int64(0)}}}}
+	opts := options.Update().SetUpsert(true)
+
+	result, err := seqColl.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return err
+	}
+	if result.UpsertedCount > 0 {
+		slog.Info("Initialized sequence", "sequence", sequenceName)
+	}
 	return nil
 }
 
-func getNextSequence(sequenceName string) (int64, error) {
-	log.Printf("Fetching next sequence for: %s\n", sequenceName)
+// assignConversationIDs stores a deterministic conversationId on every
+// direct message, which clients use as a stable grouping key.
+var assignConversationIDs = envBool("ASSIGN_CONVERSATION_IDS", true)
+
+// directConversationID returns "dm:low:high" for a participant pair. It is
+// the same whichever side sends, and the prefix keeps it distinct from IDs of
+// other conversation kinds.
+func directConversationID(a, b int64) string {
+	return "dm:" + conversationKey(a, b)
+}
+
+// getNextSequence increments and returns the named sequence. The upsert
+// creates a missing sequence document, so the first value is 1.
+func getNextSequence(ctx context.Context, sequenceName string) (int64, error) {
+	slog.Debug("Fetching next sequence", "sequence", sequenceName)
 
 	// Define the filter to find the sequence document
-	filter := bson.D{{"_id", sequenceName}}
+	filter := bson.D{{Key: "_id", Value: sequenceName}}
 
 	// Define the update to increment the sequence by 1
-	update := bson.D{{"$inc", bson.D{{"sequence", 1}}}}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "sequence", Value: 1}}}}
 
-	// Set the option to return the updated document
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	// Return the updated document, creating it on first use
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetUpsert(true)
 
-	// Create a map to hold the updated result
-	var result bson.M
+	// The driver converts whatever numeric type is stored into int64
+	var result struct {
+		Sequence int64 `bson:"sequence"`
+	}
 
 	// Execute the FindOneAndUpdate operation
-	err := seqColl.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&result)
+	err := seqColl.FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
 	if err != nil {
-		log.Printf("Error fetching sequence for %s: %v\n", sequenceName, err)
+		slog.Error("Error fetching sequence", "sequence", sequenceName, "error", err)
 		return 0, err
 	}
 
-	// Log the result of the update
-	log.Printf("Sequence document after update: %v\n", result)
+	// Log the successful retrieval of the sequence
+	slog.Debug("Retrieved next sequence value", "sequence", sequenceName, "value", result.Sequence)
 
-	// Extract the "sequence" field as a BSON number
-	sequenceVal := result["sequence"]
+	return result.Sequence, nil
+}
 
-	var sequence int64
-	switch v := sequenceVal.(type) {
-	case int32:
-		sequence = int64(v)
-	case int64:
-		sequence = v
-	case float64:
-		sequence = int64(v)
-	default:
-		log.Println("Error: Sequence value is not a recognized numeric type")
-		return 0, errors.New("sequence value is not a recognized numeric type")
+// strictTimestampOrder makes message timestamps non-decreasing in ID order,
+// so sorting by timestamp and by ID never disagree.
+var strictTimestampOrder = envBool("STRICT_TIMESTAMP_ORDER", true)
+
+// getNextSequenceWithTimestamp increments the sequence and, in the same
+// atomic update, advances the timestamp stored on the sequence document to
+// max(previous, now). The pair is allocated together, so a higher sequence
+// never gets an earlier timestamp, even across server instances.
+func getNextSequenceWithTimestamp(ctx context.Context, sequenceName string) (int64, int64, error) {
+	filter := bson.D{{Key: "_id", Value: sequenceName}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "sequence", Value: bson.D{{Key: "$add", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$sequence", 0}}}, 1}}}},
+			{Key: "timestamp", Value: bson.D{{Key: "$max", Value: bson.A{"$timestamp", time.Now().Unix()}}}},
+		}}},
 	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetUpsert(true)
 
-	// Log the successful retrieval of the sequence
-	log.Printf("Successfully retrieved next sequence value: %d\n", sequence)
+	var result struct {
+		Sequence  int64 `bson:"sequence"`
+		Timestamp int64 `bson:"timestamp"`
+	}
+	if err := seqColl.FindOneAndUpdate(ctx, filter, update, opts).Decode(&result); err != nil {
+		slog.Error("Error fetching sequence", "sequence", sequenceName, "error", err)
+		return 0, 0, err
+	}
+	return result.Sequence, result.Timestamp, nil
+}
 
-	return sequence, nil
+// MongoConfig holds the MongoDB connection settings.
+type MongoConfig struct {
+	URI          string // Connection string, may contain credentials
+	Database     string // Database holding all collections
+	MessagesColl string // Collection for messages
+	SeqColl      string // Collection for sequence counters
+	UsersColl    string // Collection of users, for recipient validation
 }
 
-func connectMongoDB() {
+// loadMongoConfig reads MONGO_URI, MONGO_DB, MONGO_MESSAGES_COLL,
+// MONGO_SEQ_COLL and MONGO_USERS_COLL, defaulting to a local server and the
+// historical names.
+func loadMongoConfig() MongoConfig {
+	return MongoConfig{
+		URI:          envString("MONGO_URI", "mongodb://localhost:27017"),
+		Database:     envString("MONGO_DB", "mydb"),
+		MessagesColl: envString("MONGO_MESSAGES_COLL", "messages"),
+		SeqColl:      envString("MONGO_SEQ_COLL", "sequences"),
+		UsersColl:    envString("MONGO_USERS_COLL", "users"),
+	}
+}
+
+func connectMongoDB(cfg MongoConfig) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 	defer cancel()
 
-	client, err := mongo.Connect(options.Client().ApplyURI("mongodb://localhost:27017"))
+	// Fail fast on a malformed URI; the URI itself is not logged as it may hold credentials
+	if _, err := connstring.ParseAndValidate(cfg.URI); err != nil {
+		log.Fatal("Invalid MONGO_URI: ", err)
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(cfg.URI))
 	if err != nil {
 		log.Fatal("MongoDB connection error:", err)
 	}
-	log.Println("MongoDB connected successfully")
+	slog.Info("MongoDB connected")
 
 	// Verify the connection.
 	err = client.Ping(ctx, nil)
@@ -152,108 +423,272 @@ func connectMongoDB() {
 	}
 
 	mongoClient = client
-	collection = client.Database("mydb").Collection("messages") // Initialize messages collection
-	seqColl = client.Database("mydb").Collection("sequences")   // Initialize sequences collection
+	mongoDB = client.Database(cfg.Database)
+	collection = mongoDB.Collection(cfg.MessagesColl)    // Initialize messages collection
+	seqColl = mongoDB.Collection(cfg.SeqColl)            // Initialize sequences collection
+	pubkeyColl = mongoDB.Collection("user_pubkeys")      // Initialize public keys collection
+	usersColl = mongoDB.Collection(cfg.UsersColl)        // Initialize users collection
+	roomMembersColl = mongoDB.Collection("room_members") // Initialize room memberships collection
+	blobStore = newGridFSBlobStore(mongoDB)              // Attachments live in GridFS
+	deliveryTracker = newMongoDeliveryTracker(mongoDB.Collection("device_deliveries"))
+	slog.Info("Using database", "database", cfg.Database, "messages", cfg.MessagesColl, "sequences", cfg.SeqColl)
+
+	// Seed the message sequence so the very first insert on a new database works
+	if err := ensureSequence(ctx, messageSequenceName); err != nil {
+		log.Fatal("MongoDB sequence bootstrap error:", err)
+	}
+
+	// Build indexes in the background so message handling is not held up
+	go ensureIndexes(context.Background())
+
+	// History and search read the same messages collection, optionally from secondaries
+	historyOpts := options.Collection().SetReadPreference(historyReadPreference())
+	historyColl = mongoDB.Collection(cfg.MessagesColl, historyOpts)
 }
 
+// historyReadPreference parses READ_PREFERENCE (primary, primaryPreferred,
+// secondary, secondaryPreferred, nearest) for history and search queries.
+// Inserts always go to the primary. Reads served by a secondary are
+// eventually consistent: a message that was just sent may not appear in
+// history until replication catches up, so clients should merge messages
+// they sent or received live rather than rely on an immediate refetch.
+func historyReadPreference() *readpref.ReadPref {
+	mode, err := readpref.ModeFromString(envString("READ_PREFERENCE", "primary"))
+	if err != nil {
+		log.Fatal("Invalid READ_PREFERENCE:", err)
+	}
+	rp, err := readpref.New(mode)
+	if err != nil {
+		log.Fatal("Invalid READ_PREFERENCE:", err)
+	}
+	slog.Info("History read preference", "mode", mode.String())
+	return rp
+}
+
+// listenAddr is the address the HTTP server binds to. Port 0 picks a free
+// port, which is logged at startup.
+var listenAddr = envString("LISTEN_ADDR", ":8081")
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true }, // Allow connections from any origin
+	CheckOrigin: checkOrigin, // Origins from ALLOWED_ORIGINS, see origins.go
+}
+
+// bearerProtocolPrefix marks a subprotocol that carries the JWT, for browser
+// clients that cannot set headers on the handshake: new WebSocket(url,
+// ["bearer." + token]).
+const bearerProtocolPrefix = "bearer."
+
+// websocketToken finds the JWT of a handshake. The Authorization header is
+// preferred, then a bearer subprotocol, then the token query parameter,
+// which leaks into access logs and is kept for older clients. protocol is
+// the subprotocol the token came from, if any.
+func websocketToken(r *http.Request) (token, protocol string) {
+	if token := bearerToken(r); token != "" {
+		return token, ""
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, bearerProtocolPrefix) {
+			return strings.TrimPrefix(p, bearerProtocolPrefix), p
+		}
+	}
+	return r.URL.Query().Get("token"), ""
+}
+
+// closeAfterUpgrade completes the handshake only to close the connection
+// with code and reason, which WebSocket clients can read from the close event.
+func closeAfterUpgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header, code int, reason string) {
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		slog.Error("WebSocket upgrade error", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+		slog.Warn("Close frame failed", "reason", reason, "error", err)
+	}
 }
 
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
-	tokenStr := r.URL.Query().Get("token")
-	log.Println("token : %s", tokenStr)
+	tokenStr, protocol := websocketToken(r)
+	slog.Debug("WebSocket connection attempt", "token_fp", tokenFingerprint(tokenStr))
+
+	// A token sent as a subprotocol must be echoed back as the chosen one
+	var responseHeader http.Header
+	if protocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
 
 	// Validate the token
 	claims, err := validateJWTToken(tokenStr)
+	if errors.Is(err, errTokenExpired) {
+		// Browsers cannot read a 401 body, so tell them with a close code
+		closeAfterUpgrade(w, r, responseHeader, closeTokenExpired, "token_expired")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeAuthError(w, err)
+		return
+	}
+
+	// Devices that name themselves get their own delivery position
+	deviceID := r.URL.Query().Get("device")
+	if deviceID != "" && !deviceIDPattern.MatchString(deviceID) {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "device", "device must be 1 to 64 letters, digits, '-' or '_'")
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Refuse regions excluded by the geofence before upgrading
+	if ip := clientIP(r); !geofenceAllows(ip) {
+		slog.Warn("Connection refused by geofence", "ip", ip.String())
+		writeError(w, http.StatusForbidden, "region_blocked", "Connections from your region are not allowed")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		log.Println("WebSocket Upgrade Error:", err)
+		slog.Error("WebSocket upgrade error", "error", err)
 		return
 	}
+	activeConns.Add(1)
+	defer activeConns.Done()
 	defer conn.Close()
 
-	for {
-		_, messageData, err := conn.ReadMessage()
-		if err != nil {
-			log.Println("Read Error:", err)
-			break
+	connected := metrics.ConnectedClients.WithLabelValues(tenantLabel(claims.TenantID()))
+	connected.Inc()
+	defer connected.Dec()
+
+	// Register the connection so other users' messages can be routed to it
+	client := newConnEntry(claims, conn)
+	client.deviceID = deviceID
+	client.caps = parseClientCaps(r.URL.Query().Get("caps"))
+	client.events = negotiateEvents(client.caps)
+	// The token's platform claim takes precedence over the client's own hint
+	platform := claims.Platform
+	if platform == "" {
+		platform = r.URL.Query().Get("platform")
+	}
+	client.statusWindow = statusWindowFor(platform)
+	client.trackCheckpoints()
+	if client.caps[capDeliveryAcks] {
+		client.acks = newAckTracker()
+		defer client.acks.stop()
+	}
+	sendFeatures(client) // Before any event can reach the connection
+	client.holdLive()    // Until the catch-up below has run
+	hub.Register(client)
+	go broadcastPresence(client.tenant, client.userID, true)
+	defer func() {
+		hub.Unregister(client)
+		// Another device of the same user keeps them online
+		if !isOnline(client.tenant, client.userID) {
+			go broadcastPresence(client.tenant, client.userID, false)
 		}
+	}()
 
-		//	Parse the incoming message into the Message struct
+	// Cap the reassembled size of every inbound message, fragmented or not;
+	// readInbound holds each one to the limit for its type
+	conn.SetReadLimit(readLimit())
 
-		// Log the raw incoming message data
-		log.Printf("Received message data: %s\n", messageData)
+	// Canceled when the read loop exits or the connection is found dead,
+	// aborting any database work still running on its behalf
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Per-connection state of the read loop
+	sess := newSession(ctx, client, claims)
+	defer sess.commitAllHeld() // Nothing can be undone once the connection is gone
+
+	// Ping the client and drop it if it stops answering
+	stopHeartbeat := client.startHeartbeat(cancel)
+	defer stopHeartbeat()
+
+	// Let the client draw its chat list before the catch-up below
+	if client.caps[capUnreadSummary] {
+		sendUnreadSummary(ctx, client)
+	}
 
-		// Parse the incoming message into the Message struct
-		var message Message
-		err = json.Unmarshal(messageData, &message)
+	// Catch up on messages stored while the user was offline
+	catchUp(ctx, client)
+
+	for {
+		// Any frame from the client proves it is alive
+		client.extendReadDeadline()
+
+		messageType, messageData, err := readInbound(conn)
+		if errors.Is(err, errFrameTooLarge) {
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+			client.writeMessage(websocket.CloseMessage, closeMsg)
+			break
+		}
 		if err != nil {
-			log.Println("Error parsing message JSON:", err)
-			log.Printf("Invalid message data: %s\n", messageData)
+			// Read errors are connection-level and end the session; a clean close is not worth logging
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Warn("Read error", "user_id", claims.ID, "error", err)
+			}
 			break
 		}
 
-		// Log the parsed message details
-		log.Printf("Parsed message: %+v\n", message)
+		// Drop frame types this deployment does not accept
+		if ok, keepOpen := checkFrameType(client, messageType); !ok {
+			if !keepOpen {
+				break
+			}
+			continue
+		}
 
-		// Set SenderID from JWT claims
-		message.SenderID = claims.ID
-		log.Printf("Assigned SenderID from claims: %d\n", claims.ID)
+		// Log the raw incoming message data
+		slog.Debug("Received frame", "user_id", claims.ID, "bytes", len(messageData), sensitiveAttr("data", string(messageData)))
 
-		// Insert the validated message into MongoDB
-		err = InsertMessage(message)
-		if err != nil {
-			log.Println("MongoDB Insert Error:", err)
-			break
+		if messageType == websocket.BinaryMessage {
+			if !sess.handleAttachment(messageData) {
+				break
+			}
+			continue
 		}
 
-		// Echo the message back to the WebSocket client
-		if err := conn.WriteMessage(websocket.TextMessage, messageData); err != nil {
-			log.Println("Write Error:", err)
+		if !sess.handleFrame(messageData) {
 			break
 		}
 	}
 }
 
-func validateJWTToken(tokenString string) (*JWTClaims, error) {
-	log.Printf("Validating token: %s", tokenString) // Log the token for debugging
+// Token validation failures, distinguished so clients know whether to refresh.
+var (
+	errTokenExpired = errors.New("token expired")
+	errTokenInvalid = errors.New("invalid token")
+)
 
-	// Decode the base64 encoded secret key
-	decodedKey, err := base64.StdEncoding.DecodeString("2Pmtk92MEFb4Mi1ppbEwTRIutN89xTG4GB6S/blXZVA=")
-	if err != nil {
-		log.Printf("Error decoding secret key: %v", err) // Log decoding errors
-		return nil, err
-	}
+func validateJWTToken(tokenString string) (*JWTClaims, error) {
+	slog.Debug("Validating token", "token_fp", tokenFingerprint(tokenString))
 
+	// Only HMAC-SHA256 is accepted, which rules out alg:none, and every token must expire
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return decodedKey, nil // Use the decoded key here
-	})
+		return jwtSecretKey, nil // Key loaded from JWT_SECRET_KEY at init
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
 
 	if err != nil {
-		log.Printf("Token parsing error: %v", err) // Log parsing errors
-		return nil, err
+		slog.Info("Token rejected", "token_fp", tokenFingerprint(tokenString), "error", err)
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, errTokenExpired
+		}
+		return nil, errTokenInvalid
 	}
 
 	// Validate the token and check claims
 	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
-		log.Printf("User ID from JWT: %d", claims.ID)
-		log.Printf("User Level from JWT: %s", claims.Level)
+		slog.Debug("Token valid", "user_id", claims.ID, "level", claims.Level)
 		return claims, nil
 	} else {
-		log.Println("Invalid token claims") // Log invalid claims case
-		return nil, errors.New("invalid token")
+		slog.Info("Token rejected: invalid claims")
+		return nil, errTokenInvalid
 	}
 }
 
 func main() {
-	connectMongoDB()
+	connectMongoDB(loadMongoConfig())
 	defer func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
@@ -262,8 +697,77 @@ func main() {
 		}
 	}()
 
+	// Verify the MongoDB round-trip before serving traffic
+	if startupSelfTest {
+		if err := runSelfTest(context.Background()); err != nil {
+			log.Fatal("Startup self-test failed: ", err)
+		}
+	}
+
+	// Only accept messages to known users when asked to
+	if envBool("VALIDATE_RECIPIENTS", false) {
+		recipientValidator = userExists
+	}
+
+	// Canceled on SIGINT/SIGTERM to begin a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Feed message events to the analytics sink
+	if analyticsEnabled() {
+		go runAnalytics(ctx)
+	}
+
+	// Start the fallback scanner for messages the recipient never picked up
+	if fallbackDelay > 0 {
+		go runFallbackScanner(ctx)
+	}
+
+	// Expire messages not delivered by their deadline
+	if expiryScanInterval > 0 {
+		go runExpiryScanner(ctx)
+	}
+
 	http.HandleFunc("/ws", websocketHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.Handle("/metrics", metricsHandler())
+	http.HandleFunc("/capabilities", capabilitiesHandler)
+	http.HandleFunc("/admin/maintenance", maintenanceHandler)
+	http.HandleFunc("/users/pubkey", pubkeyHandler)
+	http.HandleFunc("/poll", pollHandler)
+	http.HandleFunc("/presence", presenceHandler)
+	http.HandleFunc("/attachments", attachmentHandler)
+	http.HandleFunc("/messages", historyHandler)
+	http.HandleFunc("/conversations", conversationsHandler)
+	http.HandleFunc("/search", searchHandler)
+
+	// Development-only endpoints are never registered unless DEV_MODE=true
+	if devMode {
+		slog.Warn("DEV_MODE enabled: registering /dev/seed")
+		http.HandleFunc("/dev/seed", devSeedHandler)
+	}
+
+	// Bind before serving so the actual address is known, e.g. with port 0
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal("Listen error: ", err)
+	}
+	server := &http.Server{Addr: listenAddr, TLSConfig: &tls.Config{MinVersion: tlsMinVersion}}
+	go func() {
+		slog.Info("WebSocket server started", "addr", listener.Addr().String(), "tls", tlsEnabled)
+		var err error
+		if tlsEnabled {
+			err = server.ServeTLS(listener, tlsCertFile, tlsKeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 
-	log.Println("WebSocket server started on :8081")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	<-ctx.Done()
+	slog.Info("Shutting down")
+	shutdown(server)
 }
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func TestDirectConversationID(t *testing.T) {
+	pairs := [][2]int64{{1, 2}, {2, 1}, {42, 7}, {7, 7}, {1 << 40, 3}}
+	for _, p := range pairs {
+		ab, ba := directConversationID(p[0], p[1]), directConversationID(p[1], p[0])
+		if ab != ba {
+			t.Errorf("directConversationID(%d, %d) = %q but (%d, %d) = %q", p[0], p[1], ab, p[1], p[0], ba)
+		}
+	}
+	if got, want := directConversationID(42, 7), "dm:7:42"; got != want {
+		t.Errorf("directConversationID(42, 7) = %q, want %q", got, want)
+	}
+	// Distinct pairs never share an ID, nor clash with room IDs
+	if directConversationID(1, 23) == directConversationID(12, 3) {
+		t.Error("pairs (1, 23) and (12, 3) share an ID")
+	}
+	if directConversationID(1, 2) == roomConversationID(1) {
+		t.Error("a direct conversation shares its ID with a room")
+	}
+}
+
+func TestValidateJWTTokenUsesEnvKey(t *testing.T) {
+	claims, err := validateJWTToken(testToken(t, 42, time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("token signed with JWT_SECRET_KEY rejected: %v", err)
+	}
+	if claims.ID != 42 {
+		t.Errorf("claims.ID = %d, want 42", claims.ID)
+	}
+
+	// The key that used to be hardcoded must no longer be accepted
+	oldKey, err := base64.StdEncoding.DecodeString("2Pmtk92MEFb4Mi1ppbEwTRIutN89xTG4GB6S/blXZVA=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signTestClaims(t, jwt.SigningMethodHS256, oldKey, jwt.MapClaims{"id": 42, "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := validateJWTToken(token); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("token signed with the old hardcoded key: err = %v, want errTokenInvalid", err)
+	}
+}
+
+// signTestClaims signs claims with method and key.
+func signTestClaims(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return token
+}
+
+func TestValidateJWTTokenRejects(t *testing.T) {
+	secret := []byte(testSecret)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"expired", signTestClaims(t, jwt.SigningMethodHS256, secret, jwt.MapClaims{"id": 1, "exp": time.Now().Add(-time.Minute).Unix()}), errTokenExpired},
+		{"no exp", signTestClaims(t, jwt.SigningMethodHS256, secret, jwt.MapClaims{"id": 1}), errTokenInvalid},
+		{"RS256", signTestClaims(t, jwt.SigningMethodRS256, rsaKey, jwt.MapClaims{"id": 1, "exp": hour}), errTokenInvalid},
+		{"alg none", signTestClaims(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, jwt.MapClaims{"id": 1, "exp": hour}), errTokenInvalid},
+		{"HS384 with the right key", signTestClaims(t, jwt.SigningMethodHS384, secret, jwt.MapClaims{"id": 1, "exp": hour}), errTokenInvalid},
+		{"garbage", "not.a.token", errTokenInvalid},
+		{"empty", "", errTokenInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := validateJWTToken(tt.token); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthErrorBody(t *testing.T) {
+	expired := signTestClaims(t, jwt.SigningMethodHS256, []byte(testSecret), jwt.MapClaims{"id": 1, "exp": time.Now().Add(-time.Minute).Unix()})
+	noExp := signTestClaims(t, jwt.SigningMethodHS256, []byte(testSecret), jwt.MapClaims{"id": 1})
+	for token, want := range map[string]string{expired: "token_expired", noExp: "token_invalid"} {
+		req := httptest.NewRequest(http.MethodGet, "/presence?users=1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		presenceHandler(rec, req)
+
+		var body errorEnvelope
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+		}
+		if rec.Code != http.StatusUnauthorized || body.Error.Code != want {
+			t.Errorf("status %d, code %q; want 401, %q", rec.Code, body.Error.Code, want)
+		}
+	}
+}
+
+func TestConcurrentTimestampsMonotonic(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	// A clock running ahead on another instance: later messages must not go back
+	ahead := time.Now().Add(time.Hour).Unix()
+	if _, err := seqColl.UpdateOne(ctx, bson.D{{Key: "_id", Value: messageSequenceName}}, bson.D{{Key: "$set", Value: bson.D{{Key: "timestamp", Value: ahead}}}}); err != nil {
+		t.Fatalf("moving the sequence timestamp ahead: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "race"}); err != nil {
+				t.Errorf("InsertMessage: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var stored []Message
+	cursor, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil || cursor.All(ctx, &stored) != nil {
+		t.Fatalf("loading messages: %v", err)
+	}
+	if len(stored) != 20 {
+		t.Fatalf("stored %d messages, want 20", len(stored))
+	}
+	for i, message := range stored {
+		if message.Timestamp < ahead {
+			t.Errorf("message %d has timestamp %d, behind the sequence's %d", message.ID, message.Timestamp, ahead)
+		}
+		if i > 0 && message.Timestamp < stored[i-1].Timestamp {
+			t.Errorf("message %d has timestamp %d, earlier than message %d's %d", message.ID, message.Timestamp, stored[i-1].ID, stored[i-1].Timestamp)
+		}
+	}
+}
+
+func TestGetNextSequenceStartsAtOne(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+
+	for want := int64(1); want <= 2; want++ {
+		got, err := getNextSequence(ctx, "empty_sequence")
+		if err != nil {
+			t.Fatalf("getNextSequence: %v", err)
+		}
+		if got != want {
+			t.Errorf("getNextSequence = %d, want %d", got, want)
+		}
+	}
+
+	// Counters written by other tools as int32 still decode
+	if _, err := seqColl.InsertOne(ctx, bson.D{{Key: "_id", Value: "int32_sequence"}, {Key: "sequence", Value: int32(41)}}); err != nil {
+		t.Fatalf("inserting counter: %v", err)
+	}
+	if got, err := getNextSequence(ctx, "int32_sequence"); err != nil || got != 42 {
+		t.Errorf("getNextSequence = %d, %v, want 42", got, err)
+	}
+}
+
+func TestFirstInsertOnFreshDatabase(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	if err := seqColl.Drop(ctx); err != nil {
+		t.Fatalf("dropping sequences: %v", err)
+	}
+
+	// Seeding is idempotent, as every boot runs it
+	for i := 0; i < 2; i++ {
+		if err := ensureSequence(ctx, messageSequenceName); err != nil {
+			t.Fatalf("ensureSequence: %v", err)
+		}
+	}
+	first, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "first"})
+	if err != nil {
+		t.Fatalf("first InsertMessage: %v", err)
+	}
+	if first.ID != 1 {
+		t.Errorf("first message got ID %d, want 1", first.ID)
+	}
+
+	// Seeding again leaves the sequence where it is
+	if err := ensureSequence(ctx, messageSequenceName); err != nil {
+		t.Fatalf("ensureSequence: %v", err)
+	}
+	if second, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "second"}); err != nil || second.ID != 2 {
+		t.Errorf("second message got ID %d, %v, want 2", second.ID, err)
+	}
+}
+
+func TestWebSocketAuthCloseCodes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(websocketHandler))
+	t.Cleanup(srv.Close)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// An expired token completes the handshake and is closed with 4001
+	expired := testToken(t, 1, time.Now().Add(-time.Minute))
+	client, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+expired, nil)
+	if err != nil {
+		t.Fatalf("dial with an expired token: %v", err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = client.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeTokenExpired || closeErr.Text != "token_expired" {
+		t.Errorf("expired token: err = %v, want close %d token_expired", err, closeTokenExpired)
+	}
+
+	// Missing and malformed tokens are still refused before the upgrade
+	for _, query := range []string{"", "?token=not.a.token"} {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+query, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("dial%s: err = %v, want a 401 before the upgrade", query, err)
+		}
+	}
+}
+
+func TestWebSocketTokenSources(t *testing.T) {
+	tests := []struct {
+		name                 string
+		header, proto, query string
+		wantToken, wantProto string
+	}{
+		{"header", "Bearer h", "", "", "h", ""},
+		{"subprotocol", "", "chat, bearer.p", "", "p", "bearer.p"},
+		{"query", "", "", "q", "q", ""},
+		{"header over the others", "Bearer h", "bearer.p", "q", "h", ""},
+		{"subprotocol over query", "", "bearer.p", "q", "p", "bearer.p"},
+		{"none", "", "chat", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ws?token="+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.proto != "" {
+				req.Header.Set("Sec-WebSocket-Protocol", tt.proto)
+			}
+			if token, protocol := websocketToken(req); token != tt.wantToken || protocol != tt.wantProto {
+				t.Errorf("websocketToken = %q, %q; want %q, %q", token, protocol, tt.wantToken, tt.wantProto)
+			}
+		})
+	}
+
+	// A token taken from a subprotocol is echoed as the chosen one
+	srv := httptest.NewServer(http.HandlerFunc(websocketHandler))
+	t.Cleanup(srv.Close)
+	protocol := bearerProtocolPrefix + testToken(t, 1, time.Now().Add(-time.Minute))
+	dialer := websocket.Dialer{Subprotocols: []string{protocol}}
+	client, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial with a subprotocol token: %v", err)
+	}
+	defer client.Close()
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != protocol {
+		t.Errorf("chosen subprotocol = %q, want the bearer one", got)
+	}
+}
+
+func TestInsertMessageCanceled(t *testing.T) {
+	useTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // The connection went away before the insert ran
+
+	if _, err := InsertMessage(ctx, Message{SenderID: 1, RecipientID: 2, Content: "too late"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("InsertMessage: err = %v, want context.Canceled", err)
+	}
+	if n := storedCount(t); n != 0 {
+		t.Errorf("%d messages stored after cancellation, want none", n)
+	}
+}
+
+func TestInsertMessageRecipientValidator(t *testing.T) {
+	useTestDB(t)
+	saved := recipientValidator
+	t.Cleanup(func() { recipientValidator = saved })
+	var asked []int64
+	recipientValidator = func(_ context.Context, tenant string, id int64) (bool, error) {
+		asked = append(asked, id)
+		return tenant == defaultTenant && id == 2, nil
+	}
+	ctx := context.Background()
+
+	_, err := InsertMessage(ctx, Message{SenderID: 1, RecipientID: 99, Content: "anyone there?"})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Reason != "unknown_recipient" {
+		t.Errorf("InsertMessage to an unknown user: err = %v, want unknown_recipient", err)
+	}
+	if n := storedCount(t); n != 0 {
+		t.Errorf("%d messages stored for an unknown recipient, want none", n)
+	}
+
+	stored, err := InsertMessage(ctx, Message{SenderID: 1, RecipientID: 2, Content: "hello"})
+	if err != nil {
+		t.Fatalf("InsertMessage to a known user: %v", err)
+	}
+	if n := storedCount(t); n != 1 || stored.ID == 0 {
+		t.Errorf("%d messages stored with ID %d, want the message stored", n, stored.ID)
+	}
+	if len(asked) != 2 || asked[0] != 99 || asked[1] != 2 {
+		t.Errorf("validator asked about %v, want [99 2]", asked)
+	}
+}
+
+func TestSelfChatConfigurations(t *testing.T) {
+	saved, savedValidator := allowSelfChat, recipientValidator
+	t.Cleanup(func() { allowSelfChat, recipientValidator = saved, savedValidator })
+	recipientValidator = nil
+	note := Message{SenderID: 7, RecipientID: 7, Content: "buy milk"}
+
+	allowSelfChat = false
+	_, err := validateMessage(context.Background(), note)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Reason != "self_message" {
+		t.Errorf("self-chat off: err = %v, want self_message", err)
+	}
+
+	allowSelfChat = true
+	if _, err := validateMessage(context.Background(), note); err != nil {
+		t.Errorf("self-chat on: err = %v, want the note accepted", err)
+	}
+
+	// Either way a room message is not a message to oneself
+	allowSelfChat = false
+	if _, err := validateMessage(context.Background(), Message{SenderID: 7, RoomID: 7, Content: "hi"}); err != nil {
+		t.Errorf("room message with matching IDs: err = %v, want it accepted", err)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	// Both tenants have users 1 and 2, talking to each other
+	acme, err := InsertMessage(ctx, Message{Tenant: "acme", SenderID: 2, RecipientID: 1, Content: "acme secret"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	globex, err := InsertMessage(ctx, Message{Tenant: "globex", SenderID: 2, RecipientID: 1, Content: "globex secret"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+
+	// History only holds the caller's tenant
+	claims := JWTClaims{ID: 1, Tenant: "globex", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/messages?with=2", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	historyHandler(rec, req)
+	var page []Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || len(page) != 1 || page[0].ID != globex.ID {
+		t.Errorf("globex history = %s, want only message %d", rec.Body, globex.ID)
+	}
+
+	// Receipts and edits cannot reach another tenant's message
+	recipientClaims := &JWTClaims{ID: 1, Tenant: "globex"}
+	recipient, recipientClient := newTestConn(t, recipientClaims, nil)
+	s := newSession(ctx, recipient, recipientClaims)
+	data, _ := json.Marshal(readRequest{MessageIDs: []int64{acme.ID}})
+	if !s.handleRead(data) {
+		t.Fatal("handleRead ended the session")
+	}
+	if reason := readErrorReason(t, recipientClient); reason != "not_recipient" {
+		t.Errorf("read across tenants: reason = %q, want not_recipient", reason)
+	}
+	senderClaims := &JWTClaims{ID: 2, Tenant: "globex"}
+	sender, senderClient := newTestConn(t, senderClaims, nil)
+	s = newSession(ctx, sender, senderClaims)
+	data, _ = json.Marshal(editRequest{ID: acme.ID, Content: "rewritten"})
+	if !s.handleEdit(data) {
+		t.Fatal("handleEdit ended the session")
+	}
+	if reason := readErrorReason(t, senderClient); reason != "not_found" {
+		t.Errorf("edit across tenants: reason = %q, want not_found", reason)
+	}
+	if stored := storedMessage(t, acme.ID); stored.Content != "acme secret" || stored.ReadAt != 0 {
+		t.Errorf("acme message = %+v, want it untouched", stored)
+	}
+
+	// Live delivery stays within the tenant
+	hub.Register(recipient)
+	t.Cleanup(func() { hub.Unregister(recipient) })
+	acmeEntry, acmeClient := newTestConn(t, &JWTClaims{ID: 1, Tenant: "acme"}, nil)
+	hub.Register(acmeEntry)
+	t.Cleanup(func() { hub.Unregister(acmeEntry) })
+	deliverMessage(acme)
+	if message := readMessage(t, acmeClient); message.ID != acme.ID {
+		t.Errorf("acme recipient got message %d, want %d", message.ID, acme.ID)
+	}
+	expectNoFrame(t, recipientClient)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// maintenanceMode rejects new sends while keeping connections and reads up.
+// It starts from MAINTENANCE_MODE and can be toggled at runtime by an admin.
+var maintenanceMode atomic.Bool
+
+func init() {
+	maintenanceMode.Store(envBool("MAINTENANCE_MODE", false))
+}
+
+const adminLevel = "admin" // JWT level allowed to call admin endpoints
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
+
+// maintenanceHandler toggles maintenance mode. Only admins may call it.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use POST")
+		return
+	}
+
+	claims, err := validateJWTToken(bearerToken(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if claims.Level != adminLevel {
+		writeError(w, http.StatusForbidden, "forbidden", "Admin level required")
+		return
+	}
+
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Request body must be valid JSON")
+		return
+	}
+	if req.Enabled == nil {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "enabled", "enabled is required")
+		return
+	}
+
+	maintenanceMode.Store(*req.Enabled)
+	slog.Info("Maintenance mode changed", "enabled", *req.Enabled, "user_id", claims.ID)
+	writeJSON(w, http.StatusOK, map[string]bool{"maintenance": *req.Enabled})
+}
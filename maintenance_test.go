@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceBlocksSendsNotReads(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	earlier, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "before maintenance"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+
+	maintenanceMode.Store(true)
+	t.Cleanup(func() { maintenanceMode.Store(false) })
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(ctx, entry, claims)
+	if !s.handleFrame([]byte(`{"recipientId":2,"content":"during maintenance"}`)) {
+		t.Fatal("refused send ended the session")
+	}
+	if reason := readErrorReason(t, client); reason != "maintenance" {
+		t.Errorf("send: reason = %q, want maintenance", reason)
+	}
+	if n := storedCount(t); n != 1 {
+		t.Errorf("%d messages stored, want only the earlier one", n)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/messages?with=2", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, 1, time.Now().Add(time.Hour)))
+	rec := httptest.NewRecorder()
+	historyHandler(rec, req)
+	var page []Message
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &page) != nil || len(page) != 1 || page[0].ID != earlier.ID {
+		t.Errorf("history during maintenance: status %d, body %s; want the earlier message", rec.Code, rec.Body)
+	}
+
+	// The connection stays up and sends again once maintenance ends
+	maintenanceMode.Store(false)
+	if !s.handleFrame([]byte(`{"recipientId":2,"content":"after maintenance"}`)) {
+		t.Fatal("send ended the session")
+	}
+	if reply := readReply(t, client); reply.Type != envelopeAck {
+		t.Errorf("send after maintenance got %s, want an ack", reply.Type)
+	}
+}
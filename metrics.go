@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors of the server. The vectors are
+// labeled by tenant; use tenantLabel for the label value.
+type Metrics struct {
+	ConnectedClients *prometheus.GaugeVec   // Open WebSocket connections
+	MessagesInserted *prometheus.CounterVec // Messages stored in MongoDB
+	InsertErrors     *prometheus.CounterVec // Failed inserts, excluding validation rejections
+	InsertLatency    prometheus.Histogram   // Duration of message inserts in seconds
+}
+
+// newMetrics creates the collectors and registers them with reg. Tests pass
+// their own registry to read counter values in isolation.
+func newMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		ConnectedClients: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "websocket_connected_clients",
+			Help: "Number of currently connected WebSocket clients.",
+		}, []string{"tenant"}),
+		MessagesInserted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "messages_inserted_total",
+			Help: "Total number of messages stored in MongoDB.",
+		}, []string{"tenant"}),
+		InsertErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "message_insert_errors_total",
+			Help: "Total number of message inserts that failed, excluding validation rejections.",
+		}, []string{"tenant"}),
+		InsertLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "message_insert_duration_seconds",
+			Help:    "Time taken to insert a validated message, including sequence allocation.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	reg.MustRegister(m.ConnectedClients, m.MessagesInserted, m.InsertErrors, m.InsertLatency)
+	return m
+}
+
+// otherTenantsLabel is the tenant label shared by every tenant beyond
+// metricsMaxTenants.
+const otherTenantsLabel = "other"
+
+// metricsMaxTenants bounds the tenant label's cardinality: the first tenants
+// seen get their own label value, later ones share otherTenantsLabel.
+var metricsMaxTenants = envInt("METRICS_MAX_TENANTS", 50)
+
+// tenantLabels assigns tenant label values. A tenant keeps its value for the
+// life of the process, so gauges go up and down on the same series.
+type tenantLabels struct {
+	mu      sync.Mutex
+	max     int
+	tenants map[string]bool
+}
+
+func newTenantLabels(max int) *tenantLabels {
+	return &tenantLabels{max: max, tenants: make(map[string]bool)}
+}
+
+// label returns the label value for tenant.
+func (l *tenantLabels) label(tenant string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tenants[tenant] {
+		return tenant
+	}
+	if len(l.tenants) < l.max {
+		l.tenants[tenant] = true
+		return tenant
+	}
+	return otherTenantsLabel
+}
+
+var metricsTenants = newTenantLabels(metricsMaxTenants)
+
+// tenantLabel returns the metrics label value for tenant.
+func tenantLabel(tenant string) string {
+	return metricsTenants.label(tenant)
+}
+
+var (
+	metricsRegistry = prometheus.NewRegistry() // Registry served on /metrics
+	metrics         = newMetrics(metricsRegistry)
+)
+
+func init() {
+	metricsRegistry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// metricsHandler serves the registry in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
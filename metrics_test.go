@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTenantLabelsBounded(t *testing.T) {
+	labels := newTenantLabels(2)
+	if got := labels.label("a"); got != "a" {
+		t.Errorf("label(a) = %q", got)
+	}
+	if got := labels.label("b"); got != "b" {
+		t.Errorf("label(b) = %q", got)
+	}
+	for i := 0; i < 100; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		if got := labels.label(tenant); got != otherTenantsLabel {
+			t.Fatalf("label(%s) = %q, want %q once the cap is reached", tenant, got, otherTenantsLabel)
+		}
+	}
+	// Tenants seen before the cap keep their own label
+	if got := labels.label("a"); got != "a" {
+		t.Errorf("label(a) after the cap = %q", got)
+	}
+}
+
+func TestMetricsPerTenant(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	m.MessagesInserted.WithLabelValues("a").Inc()
+	m.MessagesInserted.WithLabelValues("a").Inc()
+	m.MessagesInserted.WithLabelValues("b").Inc()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	got := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "messages_inserted_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "tenant" {
+					got[label.GetValue()] = metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if len(got) != 2 || got["a"] != 2 || got["b"] != 1 {
+		t.Errorf("messages_inserted_total by tenant = %v, want map[a:2 b:1]", got)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// allowedOrigins lists the scheme://host[:port] origins browsers may open
+// WebSockets from, from ALLOWED_ORIGINS. "*" allows any origin. Unset, only
+// same-origin handshakes are accepted, except in DEV_MODE where any origin is.
+var allowedOrigins = parseOrigins(envString("ALLOWED_ORIGINS", ""))
+
+type originList struct {
+	any     bool            // "*" was given
+	origins map[string]bool // Normalized scheme://host[:port]
+}
+
+func parseOrigins(list string) originList {
+	var allowed originList
+	allowed.origins = make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "":
+			continue
+		case "*":
+			allowed.any = true
+			continue
+		}
+		origin, ok := normalizeOrigin(entry)
+		if !ok {
+			log.Fatalf("Invalid ALLOWED_ORIGINS entry %q: want scheme://host[:port]", entry)
+		}
+		allowed.origins[origin] = true
+	}
+	if list == "" && devMode {
+		allowed.any = true
+	}
+	return allowed
+}
+
+// normalizeOrigin lowercases an origin and strips anything after the host.
+func normalizeOrigin(origin string) (string, bool) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), true
+}
+
+// checkOrigin is the upgrader's CheckOrigin. Requests without an Origin
+// header come from non-browser clients and are not subject to CSRF.
+func checkOrigin(r *http.Request) bool {
+	header := r.Header.Get("Origin")
+	if header == "" || allowedOrigins.any {
+		return true
+	}
+	origin, ok := normalizeOrigin(header)
+	if !ok {
+		slog.Warn("Rejected malformed Origin", "origin", header)
+		return false
+	}
+	if allowedOrigins.origins[origin] {
+		return true
+	}
+	// Same-origin handshakes are always fine
+	if u, _ := url.Parse(origin); strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	slog.Warn("Rejected cross-origin handshake", "origin", header)
+	return false
+}
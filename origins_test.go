@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseOrigins(t *testing.T) {
+	got := parseOrigins(" https://App.example.com , http://localhost:3000/path,")
+	if got.any {
+		t.Error("explicit list allows any origin")
+	}
+	for _, origin := range []string{"https://app.example.com", "http://localhost:3000"} {
+		if !got.origins[origin] {
+			t.Errorf("%s missing from %v", origin, got.origins)
+		}
+	}
+	if len(got.origins) != 2 {
+		t.Errorf("origins = %v, want 2 entries", got.origins)
+	}
+
+	if !parseOrigins("https://a.example.com,*").any {
+		t.Error(`"*" does not allow any origin`)
+	}
+
+	saved := devMode
+	t.Cleanup(func() { devMode = saved })
+	devMode = false
+	if parseOrigins("").any {
+		t.Error("unset list allows any origin outside dev mode")
+	}
+	devMode = true
+	if !parseOrigins("").any {
+		t.Error("unset list does not allow any origin in dev mode")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	saved := allowedOrigins
+	t.Cleanup(func() { allowedOrigins = saved })
+
+	tests := []struct {
+		name    string
+		allowed string
+		origin  string
+		want    bool
+	}{
+		{"no Origin header", "https://app.example.com", "", true},
+		{"listed", "https://app.example.com", "https://app.example.com", true},
+		{"listed, different case", "https://app.example.com", "HTTPS://APP.EXAMPLE.COM", true},
+		{"other host", "https://app.example.com", "https://evil.example.com", false},
+		{"other scheme", "https://app.example.com", "http://app.example.com", false},
+		{"other port", "https://app.example.com", "https://app.example.com:8443", false},
+		{"suffix lookalike", "https://app.example.com", "https://app.example.com.evil.net", false},
+		{"malformed", "https://app.example.com", "not an origin", false},
+		{"null origin", "https://app.example.com", "null", false},
+		{"same origin without a list", "", "http://chat.example.com", true},
+		{"cross origin without a list", "", "http://elsewhere.example.com", false},
+		{"wildcard", "*", "https://anything.example.net", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			savedDev := devMode
+			devMode = false
+			allowedOrigins = parseOrigins(tt.allowed)
+			devMode = savedDev
+
+			r := httptest.NewRequest("GET", "http://chat.example.com/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkOrigin(r); got != tt.want {
+				t.Errorf("checkOrigin(Origin %q, allowed %q) = %v, want %v", tt.origin, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
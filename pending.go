@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// undeliveredFilter matches messages to a user that never reached them.
+// Documents written before delivery tracking have no delivered field and
+// count as undelivered.
+func undeliveredFilter(tenant string, userID int64) bson.D {
+	return bson.D{
+		{Key: "tenant", Value: tenant},
+		{Key: "recipientId", Value: userID},
+		{Key: "delivered", Value: bson.D{{Key: "$ne", Value: true}}},
+	}
+}
+
+// markDelivered flags the given messages as delivered, advancing the status
+// of those not yet delivered or read.
+func markDelivered(ctx context.Context, tenant string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	filter := bson.D{
+		{Key: "tenant", Value: tenant},
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}},
+	}
+	clause, update := advanceStatus(statusDelivered, time.Now(), bson.D{{Key: "delivered", Value: true}})
+	_, err := collection.UpdateMany(ctx, append(filter, clause), update)
+	recentHistory.forget(tenant, ids)
+	return err
+}
+
+// recordDelivered marks direct messages that reached c as delivered,
+// notifies their senders and advances c's device past them.
+func recordDelivered(c *connEntry, messages []Message) {
+	if len(messages) == 0 {
+		return
+	}
+	ids := make([]int64, 0, len(messages))
+	var newest int64
+	bySender := make(map[int64][]int64)
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+		newest = max(newest, message.ID)
+		bySender[message.SenderID] = append(bySender[message.SenderID], message.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := markDelivered(ctx, c.tenant, ids); err != nil {
+		slog.Error("Mark delivered error", "error", err)
+	} else {
+		notifyStatus(c.tenant, bySender, statusDelivered, time.Now())
+	}
+	recordDeviceDelivery(ctx, deliveryTracker, c, newest)
+}
+
+// deliverPending pushes messages stored while the user, or the connection's
+// device, was offline, oldest first, and marks the ones written successfully
+// as delivered, or waits for the client to confirm them with delivery acks. Messages past their delivery deadline are left for the
+// expiry scanner. It runs after the connection is registered; live messages
+// sent meanwhile are held, and markReady skips those already sent here.
+func deliverPending(ctx context.Context, c *connEntry) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	filter, err := pendingFilter(ctx, deliveryTracker, c)
+	if err != nil {
+		slog.Error("Device delivery lookup error", "user_id", c.userID, "error", err)
+		return
+	}
+	filter = append(filter, deliverableClause(time.Now())) // Expired messages are never replayed
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetBatchSize(int32(replayBatch))
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("Pending messages query error", "error", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	sent := 0
+	var delivered []int64
+	advanced := make(map[int64][]int64) // Newly delivered, by sender
+	for cursor.Next(ctx) {
+		var message Message
+		if err := cursor.Decode(&message); err != nil {
+			slog.Error("Pending message decode error", "error", err)
+			continue
+		}
+		applyTombstone(&message)
+		isNew := validStatusTransition(message.Status, statusDelivered)
+		message.markStatus(statusDelivered, time.Now())
+		if err := c.writeReplayed(message); err != nil {
+			slog.Warn("Pending delivery failed", "user_id", c.userID, "error", err)
+			break
+		}
+		sent++
+		if c.acks != nil {
+			c.acks.track(c, message) // Delivered once the client confirms it
+		} else {
+			delivered = append(delivered, message.ID)
+			if isNew {
+				advanced[message.SenderID] = append(advanced[message.SenderID], message.ID)
+			}
+		}
+		if !pauseReplay(ctx, sent) {
+			break
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		slog.Error("Pending messages cursor error", "error", err)
+	}
+	// A new device starts at the newest message, past everything sent above
+	startDeviceTracking(ctx, deliveryTracker, c)
+	if len(delivered) > 0 {
+		recordDeviceDelivery(ctx, deliveryTracker, c, delivered[len(delivered)-1])
+	}
+
+	if err := markDelivered(ctx, c.tenant, delivered); err != nil {
+		slog.Error("Mark delivered error", "error", err)
+		return
+	}
+	notifyStatus(c.tenant, advanced, statusDelivered, time.Now())
+	if len(delivered) > 0 {
+		slog.Info("Delivered pending messages", "user_id", c.userID, "count", len(delivered))
+	}
+}
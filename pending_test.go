@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestDeliverPendingMarksDelivered(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	var queued []Message
+	for _, content := range []string{"while away 1", "while away 2"} {
+		stored, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: content})
+		if err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+		queued = append(queued, stored)
+	}
+
+	entry, client := newTestConn(t, &JWTClaims{ID: 1}, nil)
+	deliverPending(ctx, entry)
+
+	for _, want := range queued {
+		if got := readMessage(t, client); got.ID != want.ID || got.Content != want.Content {
+			t.Errorf("got message %d (%q), want %d (%q)", got.ID, got.Content, want.ID, want.Content)
+		}
+	}
+	for _, want := range queued {
+		var stored Message
+		if err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: want.ID}}).Decode(&stored); err != nil {
+			t.Fatalf("loading message %d: %v", want.ID, err)
+		}
+		if !stored.Delivered || stored.Status != statusDelivered {
+			t.Errorf("message %d stored with delivered %t and status %s, want delivered", want.ID, stored.Delivered, stored.Status)
+		}
+	}
+	expectNoFrame(t, client)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var pollTimeout = envDuration("POLL_TIMEOUT", 25*time.Second) // How long GET /poll waits for new messages
+
+const pollBatchLimit = 100 // Maximum messages returned by a single poll
+
+// pollResponse is returned by GET /poll. Clients pass nextCursor as "since"
+// on their next request.
+type pollResponse struct {
+	Messages   []Message `json:"messages"`
+	NextCursor int64     `json:"nextCursor"`
+}
+
+// newPollEntry creates a pseudo-connection that receives deliveries on a
+// channel instead of a socket.
+func newPollEntry(claims *JWTClaims) *connEntry {
+	return &connEntry{userID: claims.ID, tenant: claims.TenantID(), connID: newConnID(), pollCh: make(chan Message, pollBatchLimit)}
+}
+
+// fetchMessagesSince returns messages addressed to the user with an ID above since.
+func fetchMessagesSince(ctx context.Context, claims *JWTClaims, since int64) ([]Message, error) {
+	filter := bson.D{
+		{Key: "tenant", Value: claims.TenantID()},
+		{Key: "recipientId", Value: claims.ID},
+		{Key: "_id", Value: bson.D{{Key: "$gt", Value: since}}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(pollBatchLimit)
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	messages := []Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		applyTombstone(&messages[i])
+	}
+	return messages, nil
+}
+
+// pollHandler serves GET /poll?since=<id>, a long-polling fallback for
+// clients that cannot hold a WebSocket. It answers immediately when stored
+// messages newer than since exist, otherwise waits up to pollTimeout for a
+// live delivery through the hub.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET")
+		return
+	}
+
+	claims, err := validateJWTToken(bearerToken(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "since", "since must be a non-negative message ID")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), pollTimeout+5*time.Second)
+	defer cancel()
+
+	messages, err := fetchMessagesSince(ctx, claims, since)
+	if err != nil {
+		slog.Error("Poll query error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to fetch messages")
+		return
+	}
+
+	// Nothing stored yet: register for live deliveries, alongside any other
+	// devices of the user
+	if len(messages) == 0 {
+		entry := newPollEntry(claims)
+		hub.Register(entry)
+		defer hub.Unregister(entry)
+
+		// Re-check now that deliveries are routed here, so a message stored in between is not missed
+		messages, err = fetchMessagesSince(ctx, claims, since)
+		if err != nil {
+			slog.Error("Poll query error", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "Failed to fetch messages")
+			return
+		}
+
+		if len(messages) == 0 {
+			timer := time.NewTimer(pollTimeout)
+			defer timer.Stop()
+			select {
+			case message := <-entry.pollCh:
+				messages = append(messages, message)
+			case <-timer.C:
+			case <-shuttingDown:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	next := since
+	ids := make([]int64, 0, len(messages))
+	advanced := make(map[int64][]int64) // Newly delivered, by sender
+	for i := range messages {
+		if validStatusTransition(messages[i].Status, statusDelivered) {
+			advanced[messages[i].SenderID] = append(advanced[messages[i].SenderID], messages[i].ID)
+		}
+		messages[i].markStatus(statusDelivered, time.Now())
+		ids = append(ids, messages[i].ID)
+		if messages[i].ID > next {
+			next = messages[i].ID
+		}
+	}
+	writeJSON(w, http.StatusOK, pollResponse{Messages: messages, NextCursor: next})
+
+	// Handed to the client, so a later WebSocket session does not replay them
+	if err := markDelivered(ctx, claims.TenantID(), ids); err != nil {
+		slog.Error("Mark delivered error", "error", err)
+		return
+	}
+	notifyStatus(claims.TenantID(), advanced, statusDelivered, time.Now())
+}
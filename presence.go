@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const maxPresenceQuery = 100 // Most user IDs one /presence request may ask about
+
+// presenceMaxContacts caps how many correspondents are told when a user
+// comes online or goes offline, so prolific users do not fan out to everyone.
+var presenceMaxContacts = envInt("PRESENCE_MAX_CONTACTS", 200)
+
+// presenceEvent is the data of a presence frame and one entry of /presence.
+type presenceEvent struct {
+	UserID int64 `json:"userId"`
+	Online bool  `json:"online"`
+}
+
+// isOnline reports whether a user of tenant has a live WebSocket on any
+// device. Long-polling users are not counted.
+func isOnline(tenant string, userID int64) bool {
+	return len(hub.Sockets(tenant, userID)) > 0
+}
+
+// recentContacts returns up to presenceMaxContacts users that userID has
+// exchanged direct messages with, most recent first.
+func recentContacts(ctx context.Context, tenant string, userID int64) ([]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "tenant", Value: tenant},
+			{Key: "roomId", Value: bson.D{{Key: "$exists", Value: false}}},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "senderId", Value: userID}},
+				bson.D{{Key: "recipientId", Value: userID}},
+			}},
+		}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{"$senderId", userID}}}, "$recipientId", "$senderId",
+			}}}},
+			{Key: "last", Value: bson.D{{Key: "$max", Value: "$timestamp"}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: bson.D{{Key: "$ne", Value: userID}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "last", Value: -1}}}},
+		{{Key: "$limit", Value: presenceMaxContacts}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		UserID int64 `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	contacts := make([]int64, 0, len(results))
+	for _, result := range results {
+		contacts = append(contacts, result.UserID)
+	}
+	return contacts, nil
+}
+
+// broadcastPresence tells the online contacts of a user that they came
+// online or went offline. It runs detached from the connection, which may
+// already be gone when going offline.
+func broadcastPresence(tenant string, userID int64, online bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	contacts, err := recentContacts(ctx, tenant, userID)
+	if err != nil {
+		slog.Error("Presence contact lookup error", "user_id", userID, "error", err)
+		return
+	}
+
+	frame := Frame{Type: envelopePresence, Data: presenceEvent{UserID: userID, Online: online}}
+	for _, contactID := range contacts {
+		sendToSockets(tenant, contactID, nil, frame)
+	}
+}
+
+// presenceHandler serves GET /presence?users=1,2,3, reporting which of the
+// given users of the caller's tenant are connected.
+func presenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET")
+		return
+	}
+
+	claims, err := validateJWTToken(bearerToken(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	ids := strings.Split(r.URL.Query().Get("users"), ",")
+	if len(ids) > maxPresenceQuery {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "users", "At most 100 users per request")
+		return
+	}
+	presence := make([]presenceEvent, 0, len(ids))
+	for _, v := range ids {
+		userID, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil || userID <= 0 {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "users", "users must be a comma-separated list of positive user IDs")
+			return
+		}
+		presence = append(presence, presenceEvent{UserID: userID, Online: isOnline(claims.TenantID(), userID)})
+	}
+
+	writeJSON(w, http.StatusOK, presence)
+}
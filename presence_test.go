@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPresenceNotifiesCorrespondent(t *testing.T) {
+	useTestDB(t)
+	if _, err := InsertMessage(context.Background(), Message{SenderID: 2, RecipientID: 1, Content: "are you there?"}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	correspondent, correspondentClient := newTestConn(t, &JWTClaims{ID: 2}, nil)
+	stranger, strangerClient := newTestConn(t, &JWTClaims{ID: 3}, nil)
+	for _, entry := range []*connEntry{correspondent, stranger} {
+		hub.Register(entry)
+		t.Cleanup(func() { hub.Unregister(entry) })
+	}
+
+	broadcastPresence(defaultTenant, 1, true)
+	frameType, data := readFrame(t, correspondentClient)
+	var event presenceEvent
+	json.Unmarshal(data, &event)
+	if frameType != envelopePresence || event != (presenceEvent{UserID: 1, Online: true}) {
+		t.Errorf("correspondent got %s %s, want user 1 online", frameType, data)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/presence?users=2,4", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, 1, time.Now().Add(time.Hour)))
+	rec := httptest.NewRecorder()
+	presenceHandler(rec, req)
+	var presence []presenceEvent
+	json.Unmarshal(rec.Body.Bytes(), &presence)
+	if rec.Code != http.StatusOK || len(presence) != 2 || !presence[0].Online || presence[1].Online {
+		t.Errorf("GET /presence: status %d, body %s; want 2 online and 4 offline", rec.Code, rec.Body)
+	}
+	expectNoFrame(t, strangerClient)
+}
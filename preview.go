@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// previewLength is the maximum length, in runes, of message content shown in
+// previews such as notifications and conversation lists.
+var previewLength = envInt("PREVIEW_LENGTH", 80)
+
+const previewEllipsis = "…"
+
+// previewContent shortens s to at most maxRunes runes, cutting on a rune
+// boundary and ending with an ellipsis when anything was removed. A
+// non-positive maxRunes disables truncation.
+func previewContent(s string, maxRunes int) string {
+	if maxRunes <= 0 || utf8.RuneCountInString(s) <= maxRunes {
+		return s
+	}
+
+	// Keep room for the ellipsis so the preview never exceeds maxRunes
+	keep := maxRunes - 1
+	cut := 0
+	for i := range s {
+		if keep == 0 {
+			cut = i
+			break
+		}
+		keep--
+	}
+	return strings.TrimRight(s[:cut], " \t\n") + previewEllipsis
+}
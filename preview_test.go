@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPreviewContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		maxRunes int
+		want     string
+	}{
+		{"short ASCII unchanged", "hello", 10, "hello"},
+		{"exact length unchanged", "hello", 5, "hello"},
+		{"ASCII cut", "hello world", 6, "hello…"},
+		{"2-byte runes", "ééééé", 3, "éé…"},
+		{"3-byte runes", "日本語のテキスト", 4, "日本語…"},
+		{"4-byte runes", "😀😁😂🤣😃", 3, "😀😁…"},
+		{"mixed widths", "aé日😀b", 4, "aé日…"},
+		{"maxRunes 0 disables truncation", "hello world", 0, "hello world"},
+		{"negative maxRunes disables truncation", "hello world", -1, "hello world"},
+		{"maxRunes 1 leaves only the ellipsis", "hello", 1, "…"},
+		{"maxRunes 1 fits a single rune", "😀", 1, "😀"},
+		{"trailing space trimmed before the ellipsis", "hello   world", 8, "hello…"},
+		{"trailing tab and newline trimmed", "hi\t\n there", 5, "hi…"},
+		{"empty", "", 5, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := previewContent(tt.in, tt.maxRunes)
+			if got != tt.want {
+				t.Errorf("previewContent(%q, %d) = %q, want %q", tt.in, tt.maxRunes, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("previewContent(%q, %d) = %q is not valid UTF-8", tt.in, tt.maxRunes, got)
+			}
+			if tt.maxRunes > 0 && utf8.RuneCountInString(got) > tt.maxRunes {
+				t.Errorf("previewContent(%q, %d) = %q is longer than %d runes", tt.in, tt.maxRunes, got, tt.maxRunes)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// UserPublicKey is a user's signing key from the user_pubkeys collection.
+// Keys are provisioned out of band; the server only serves them so that
+// recipients can verify message signatures without trusting the server.
+type UserPublicKey struct {
+	UserID    int64  `bson:"userId" json:"userId"`                           // Owner of the key
+	Tenant    string `bson:"tenant" json:"-"`                                // Tenant the user belongs to
+	PublicKey string `bson:"publicKey" json:"publicKey"`                     // Encoded public key
+	Algorithm string `bson:"algorithm,omitempty" json:"algorithm,omitempty"` // Signature algorithm, e.g. "ed25519"
+}
+
+var pubkeyColl *mongo.Collection // Collection holding user public keys
+
+// pubkeyHandler serves GET /users/pubkey?userId=N for users of the caller's tenant.
+func pubkeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET")
+		return
+	}
+
+	claims, err := validateJWTToken(bearerToken(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	userID, err := strconv.ParseInt(r.URL.Query().Get("userId"), 10, 64)
+	if err != nil || userID <= 0 {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "userId", "userId must be a positive integer")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.D{{Key: "userId", Value: userID}, {Key: "tenant", Value: claims.TenantID()}}
+	var key UserPublicKey
+	err = pubkeyColl.FindOne(ctx, filter).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(w, http.StatusNotFound, "not_found", "No public key for this user")
+		return
+	}
+	if err != nil {
+		slog.Error("Public key lookup error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to look up public key")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, key)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// maxUserQueries caps the history and search queries one user may have in
+// flight at once, across all of their clients, so that many open tabs
+// cannot multiply the load a single user puts on the database.
+var maxUserQueries = envInt("MAX_USER_QUERIES", 3)
+
+func init() {
+	if maxUserQueries <= 0 {
+		log.Fatalf("MAX_USER_QUERIES (%d) must be positive", maxUserQueries)
+	}
+}
+
+// queryKey identifies a user across tenants.
+type queryKey struct {
+	tenant string
+	userID int64
+}
+
+// queryLimiter counts in-flight queries per user.
+type queryLimiter struct {
+	mu       sync.Mutex
+	max      int
+	inFlight map[queryKey]int
+}
+
+func newQueryLimiter(max int) *queryLimiter {
+	return &queryLimiter{max: max, inFlight: make(map[queryKey]int)}
+}
+
+var queryLimits = newQueryLimiter(maxUserQueries)
+
+// acquire claims a query slot for the user and reports whether one was
+// free. Every successful acquire must be paired with a release.
+func (l *queryLimiter) acquire(tenant string, userID int64) bool {
+	key := queryKey{tenant: tenant, userID: userID}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[key] >= l.max {
+		return false
+	}
+	l.inFlight[key]++
+	return true
+}
+
+// release frees a slot claimed by acquire. Idle users are dropped from the
+// map so it only holds users with queries running.
+func (l *queryLimiter) release(tenant string, userID int64) {
+	key := queryKey{tenant: tenant, userID: userID}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[key] <= 1 {
+		delete(l.inFlight, key)
+		return
+	}
+	l.inFlight[key]--
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	l := newQueryLimiter(3)
+	for i := 0; i < 3; i++ {
+		if !l.acquire("acme", 1) {
+			t.Fatalf("acquire %d refused under the limit", i+1)
+		}
+	}
+	if l.acquire("acme", 1) {
+		t.Error("fourth concurrent query was allowed")
+	}
+
+	// Other users, and the same ID in another tenant, have their own slots
+	if !l.acquire("acme", 2) {
+		t.Error("another user was refused")
+	}
+	if !l.acquire("other", 1) {
+		t.Error("the same user ID in another tenant was refused")
+	}
+
+	l.release("acme", 1)
+	if !l.acquire("acme", 1) {
+		t.Error("acquire after a release was refused")
+	}
+
+	for i := 0; i < 3; i++ {
+		l.release("acme", 1)
+	}
+	l.release("acme", 2)
+	l.release("other", 1)
+	if n := len(l.inFlight); n != 0 {
+		t.Errorf("%d users still tracked after every query completed", n)
+	}
+}
+
+func TestQueriesOverLimit(t *testing.T) {
+	saved := queryLimits
+	t.Cleanup(func() { queryLimits = saved })
+	queryLimits = newQueryLimiter(1)
+
+	claims := &JWTClaims{ID: 7}
+	if !queryLimits.acquire(claims.TenantID(), claims.ID) {
+		t.Fatal("could not take the only slot")
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"/messages?with=8": historyHandler,
+		"/conversations":   conversationsHandler,
+		"/search?q=hello":  searchHandler,
+	}
+	for path, handler := range handlers {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, claims.ID, time.Now().Add(time.Hour)))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("GET %s: status = %d, want 429", path, rec.Code)
+		}
+	}
+}
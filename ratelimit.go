@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+
+	"golang.org/x/time/rate"
+)
+
+// Per-connection token bucket for chat messages.
+var (
+	messageRate  = rate.Limit(envFloat("MESSAGE_RATE", 10)) // Sustained messages per second
+	messageBurst = envInt("MESSAGE_BURST", 20)              // Messages allowed in a burst
+)
+
+func init() {
+	if messageRate <= 0 || messageBurst <= 0 {
+		log.Fatalf("MESSAGE_RATE (%v) and MESSAGE_BURST (%d) must be positive", float64(messageRate), messageBurst)
+	}
+}
+
+// newMessageLimiter returns the rate limiter for one connection.
+func newMessageLimiter() *rate.Limiter {
+	return rate.NewLimiter(messageRate, messageBurst)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRapidMessagesRateLimited(t *testing.T) {
+	useTestDB(t)
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+	// The configured burst, without tokens refilling while the test runs
+	s.limiter = rate.NewLimiter(rate.Every(time.Hour), messageBurst)
+
+	const sent = 50
+	for i := 0; i < sent; i++ {
+		if !s.handleFrame([]byte(`{"recipientId":2,"content":"flood"}`)) {
+			t.Fatalf("message %d ended the session", i)
+		}
+	}
+
+	// Every refused message gets a backpressure frame, then its error
+	acks, refused := 0, 0
+	for acks+refused < sent {
+		switch reply := readReply(t, client); reply.Type {
+		case envelopeAck:
+			acks++
+		case "error":
+			refused++
+		case "backpressure":
+		default:
+			t.Fatalf("unexpected %s frame", reply.Type)
+		}
+	}
+	if acks != messageBurst || refused != sent-messageBurst {
+		t.Errorf("%d acked and %d refused, want %d and %d", acks, refused, messageBurst, sent-messageBurst)
+	}
+	if n := storedCount(t); n != int64(messageBurst) {
+		t.Errorf("%d messages reached MongoDB, want %d", n, messageBurst)
+	}
+}
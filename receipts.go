@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const maxReadBatch = 500 // Most message IDs a single read frame may acknowledge
+
+// readRequest is the data of an inbound read frame.
+type readRequest struct {
+	MessageIDs []int64 `json:"messageIds"`
+}
+
+// readEvent is the data of a read frame forwarded to the original sender.
+type readEvent struct {
+	MessageIDs []int64 `json:"messageIds"`
+	ReadAt     int64   `json:"readAt"`
+}
+
+// handleRead marks messages the caller received as read and notifies their
+// senders. Every ID must be a message addressed to the caller, otherwise the
+// whole frame is rejected and nothing is updated.
+func (s *session) handleRead(data []byte) bool {
+	if reason := s.checkWrite(); reason != "" {
+		return s.reject(reason)
+	}
+	var req readRequest
+	if err := json.Unmarshal(data, &req); err != nil || len(req.MessageIDs) == 0 {
+		return s.reject("invalid_read")
+	}
+	if len(req.MessageIDs) > maxReadBatch {
+		return s.reject("too_many_ids")
+	}
+
+	// Drop repeated IDs so the ownership count below is exact
+	seen := make(map[int64]bool, len(req.MessageIDs))
+	ids := make([]int64, 0, len(req.MessageIDs))
+	for _, id := range req.MessageIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	defer cancel()
+
+	filter := bson.D{
+		{Key: "tenant", Value: s.claims.TenantID()},
+		{Key: "recipientId", Value: s.claims.ID},
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}},
+	}
+	opts := options.Find().SetProjection(bson.D{{Key: "senderId", Value: 1}, {Key: "readAt", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("Read receipt query error", "error", err)
+		return s.reject("read_failed")
+	}
+	var owned []Message
+	if err := cursor.All(ctx, &owned); err != nil {
+		slog.Error("Read receipt decode error", "error", err)
+		return s.reject("read_failed")
+	}
+	if len(owned) != len(ids) {
+		slog.Warn("Read receipt for messages not received refused", "user_id", s.claims.ID)
+		return s.reject("not_recipient")
+	}
+
+	// Keep the first read time of messages that were already read
+	readAt := time.Now().Unix()
+	clause, update := advanceStatus(statusRead, time.Unix(readAt, 0), bson.D{{Key: "readAt", Value: readAt}, {Key: "delivered", Value: true}})
+	filter = append(filter, bson.E{Key: "readAt", Value: bson.D{{Key: "$exists", Value: false}}}, clause)
+	_, err = collection.UpdateMany(ctx, filter, update)
+	recentHistory.forget(s.claims.TenantID(), ids)
+	if err != nil {
+		slog.Error("Read receipt update error", "error", err)
+		return s.reject("read_failed")
+	}
+
+	// Notify each sender about their newly read messages
+	bySender := make(map[int64][]int64)
+	for _, message := range owned {
+		if message.ReadAt == 0 {
+			bySender[message.SenderID] = append(bySender[message.SenderID], message.ID)
+		}
+	}
+	notifyStatus(s.claims.TenantID(), bySender, statusRead, time.Unix(readAt, 0))
+
+	// Reads have no reply of their own; a client that asked to correlate
+	// one gets an ack
+	if s.requestID == "" {
+		return true
+	}
+	return s.reply(Frame{Type: envelopeAck, Data: readEvent{MessageIDs: ids, ReadAt: readAt}})
+}
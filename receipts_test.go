@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// storedMessage loads the message with id from the test database.
+func storedMessage(t *testing.T, id int64) Message {
+	t.Helper()
+	var message Message
+	if err := collection.FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&message); err != nil {
+		t.Fatalf("loading message %d: %v", id, err)
+	}
+	return message
+}
+
+func TestReadReceiptForOthersMessage(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	mine, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 1, Content: "to 1"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	theirs, err := InsertMessage(ctx, Message{SenderID: 2, RecipientID: 3, Content: "to 3"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(ctx, entry, claims)
+
+	// One foreign ID refuses the whole frame
+	for _, ids := range [][]int64{{theirs.ID}, {mine.ID, theirs.ID}} {
+		list, _ := json.Marshal(ids)
+		frame := fmt.Sprintf(`{"type":"read","data":{"messageIds":%s}}`, list)
+		if !s.handleFrame([]byte(frame)) {
+			t.Fatalf("%s ended the session", frame)
+		}
+		if reason := readErrorReason(t, client); reason != "not_recipient" {
+			t.Errorf("%s: reason = %q, want not_recipient", frame, reason)
+		}
+	}
+	for _, id := range []int64{mine.ID, theirs.ID} {
+		if message := storedMessage(t, id); message.ReadAt != 0 || message.Status == statusRead {
+			t.Errorf("message %d marked read by a refused receipt", id)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// RecipientValidator reports whether a user ID refers to an existing user
+// of tenant.
+type RecipientValidator func(ctx context.Context, tenant string, id int64) (bool, error)
+
+var (
+	usersColl *mongo.Collection // Collection holding user documents keyed by _id
+
+	// recipientValidator is consulted by InsertMessage when set. It is nil
+	// unless VALIDATE_RECIPIENTS=true; tests may replace it with a stub.
+	recipientValidator RecipientValidator
+)
+
+// userExists is the default RecipientValidator and looks the ID up in
+// usersColl within the tenant. Users of the default tenant may have been
+// stored without a tenant field, like tokens without a tenant claim.
+func userExists(ctx context.Context, tenant string, id int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tenantFilter := bson.D{{Key: "tenant", Value: tenant}}
+	if tenant == defaultTenant {
+		tenantFilter = bson.D{{Key: "tenant", Value: bson.D{{Key: "$in", Value: bson.A{tenant, nil}}}}}
+	}
+	filter := append(bson.D{{Key: "_id", Value: id}}, tenantFilter...)
+	n, err := usersColl.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Catch-up on connect is throttled so a wave of reconnects cannot flood
+// MongoDB with replay queries: at most replayWorkers connections replay at
+// once, and each may pause for replayPause after every replayBatch messages.
+var (
+	replayWorkers = envInt("REPLAY_WORKERS", 16)   // Connections replaying missed messages at once
+	replayBatch   = envInt("REPLAY_BATCH", 100)    // Messages replayed, and fetched, between pauses
+	replayPause   = envDuration("REPLAY_PAUSE", 0) // Pause after each batch; zero disables it
+	replaySlots   chan struct{}                    // Held by each connection while it replays
+)
+
+func init() {
+	if replayWorkers <= 0 || replayBatch <= 0 {
+		log.Fatalf("REPLAY_WORKERS (%d) and REPLAY_BATCH (%d) must be positive", replayWorkers, replayBatch)
+	}
+	replaySlots = make(chan struct{}, replayWorkers)
+}
+
+// catchUp replays the direct and room messages the connection missed while
+// offline once a replay slot is free, then makes it ready for live delivery.
+// The connection must have been set to hold live messages with holdLive
+// before it was registered.
+func catchUp(ctx context.Context, c *connEntry) {
+	defer c.markReady()
+	select {
+	case replaySlots <- struct{}{}:
+		defer func() { <-replaySlots }()
+	case <-ctx.Done():
+		return
+	}
+	deliverPending(ctx, c)
+	deliverPendingRooms(ctx, c)
+}
+
+// pauseReplay waits for replayPause after every replayBatch of sent
+// messages and reports whether the replay may go on.
+func pauseReplay(ctx context.Context, sent int) bool {
+	if replayPause <= 0 || sent%replayBatch != 0 {
+		return true
+	}
+	timer := time.NewTimer(replayPause)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// holdLive makes the connection keep live messages back until markReady, so
+// they cannot overtake or race the replay of what it missed.
+func (c *connEntry) holdLive() {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	c.replaying = true
+	c.replayed = make(map[int64]bool)
+}
+
+// writeReplayed writes a message replayed by the catch-up, remembering its
+// ID so the same message held as a live delivery is not sent twice.
+func (c *connEntry) writeReplayed(message Message) error {
+	if err := c.writeJSON(message); err != nil {
+		return err
+	}
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	if c.replayed != nil {
+		c.replayed[message.ID] = true
+	}
+	return nil
+}
+
+// hold keeps a live message back if the connection is still catching up and
+// reports whether it did.
+func (c *connEntry) hold(message Message) bool {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	if c.replaying {
+		c.held = append(c.held, message)
+	}
+	return c.replaying
+}
+
+// markReady ends catch-up. Held messages the replay did not already send are
+// written in stored sequence order, which is send order for each sender,
+// before any later live message, and settled like live deliveries. Those
+// whose delivery deadline passed meanwhile are left for the expiry scanner.
+func (c *connEntry) markReady() {
+	c.replayMu.Lock()
+	sort.SliceStable(c.held, func(i, j int) bool { return c.held[i].ID < c.held[j].ID })
+	now := time.Now()
+	var written []Message
+	for _, message := range c.held {
+		if c.replayed[message.ID] || message.pastDeadline(now) {
+			continue
+		}
+		if err := c.writeJSON(message); err != nil {
+			slog.Warn("Held delivery failed", "user_id", c.userID, "conn_id", c.connID, "error", err)
+			c.conn.Close()
+			break
+		}
+		written = append(written, message)
+	}
+	c.held, c.replayed, c.replaying = nil, nil, false
+	c.replayMu.Unlock()
+
+	settleHeld(c, written)
+}
+
+// settleHeld records the delivery of held or batched messages written to
+// the connection: direct messages to its user are settled like live
+// deliveries, and the user's room cursors move past the room messages.
+// deliverRoomMessage leaves the cursor alone for a held member, so it cannot
+// skip room messages the catch-up has yet to read.
+func settleHeld(c *connEntry, messages []Message) {
+	var direct []Message
+	rooms := make(map[int64]int64) // Newest held message, by room
+	for _, message := range messages {
+		switch {
+		case message.RoomID != 0 && message.SenderID != c.userID:
+			rooms[message.RoomID] = max(rooms[message.RoomID], message.ID)
+		case message.RoomID == 0 && message.RecipientID == c.userID:
+			direct = append(direct, message)
+		}
+	}
+
+	if len(rooms) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for roomID, last := range rooms {
+			if err := advanceRoomCursor(ctx, c.tenant, roomID, last, []int64{c.userID}); err != nil {
+				slog.Error("Room cursor update error", "error", err)
+			}
+		}
+	}
+	settleDirect(c, direct)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readMessage reads one message frame from a test client.
+func readMessage(t *testing.T, client *websocket.Conn) Message {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	var message Message
+	if err := client.ReadJSON(&message); err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+	return message
+}
+
+func TestHeldMessagesFollowReplay(t *testing.T) {
+	claims := &JWTClaims{ID: 31}
+	entry, client := newTestConn(t, claims, nil)
+	entry.holdLive()
+
+	// A message from the user's other device arrives during catch-up
+	if writeToSocket(entry, Message{ID: 9, SenderID: 31, RecipientID: 32, Content: "live"}) {
+		t.Error("message written during catch-up, want it held")
+	}
+
+	entry.writeJSON(Message{ID: 5, SenderID: 32, RecipientID: 31, Content: "missed"})
+	entry.markReady()
+	for _, want := range []int64{5, 9} {
+		if got := readMessage(t, client); got.ID != want {
+			t.Fatalf("got message %d, want %d", got.ID, want)
+		}
+	}
+
+	if !writeToSocket(entry, Message{ID: 10, SenderID: 31, RecipientID: 32}) {
+		t.Error("message held after catch-up")
+	}
+	if got := readMessage(t, client); got.ID != 10 {
+		t.Errorf("got message %d, want 10", got.ID)
+	}
+}
+
+func TestCatchUpWaitsForReplaySlot(t *testing.T) {
+	useTestDB(t)
+	saved := replaySlots
+	replaySlots = make(chan struct{}, 1)
+	t.Cleanup(func() { replaySlots = saved })
+
+	missed, err := InsertMessage(context.Background(), Message{SenderID: 2, RecipientID: 1, Content: "missed"})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+
+	entry, client := newTestConn(t, &JWTClaims{ID: 1}, nil)
+	entry.holdLive()
+	replaySlots <- struct{}{} // Another connection is replaying
+	done := make(chan struct{})
+	go func() {
+		catchUp(context.Background(), entry)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("catch-up ran without a free replay slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	<-replaySlots
+	if got := readMessage(t, client); got.ID != missed.ID {
+		t.Errorf("replayed message %d, want %d", got.ID, missed.ID)
+	}
+	<-done
+	if entry.hold(Message{}) {
+		t.Error("connection still holds live messages after catch-up")
+	}
+}
+
+func TestReplayAndLiveDeliveryKeepSendOrder(t *testing.T) {
+	useTestDB(t)
+	saved := replaySlots
+	replaySlots = make(chan struct{}, 1)
+	t.Cleanup(func() { replaySlots = saved })
+
+	send := func(content string) Message {
+		t.Helper()
+		stored, err := InsertMessage(context.Background(), Message{SenderID: 2, RecipientID: 1, Content: content})
+		if err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+		return stored
+	}
+	first, second := send("offline 1"), send("offline 2")
+
+	entry, client := newTestConn(t, &JWTClaims{ID: 1}, nil)
+	entry.holdLive()
+	hub.Register(entry)
+	t.Cleanup(func() { hub.Unregister(entry) })
+	replaySlots <- struct{}{}
+	done := make(chan struct{})
+	go func() {
+		catchUp(context.Background(), entry)
+		close(done)
+	}()
+
+	// Sent while the connection waits to replay: stored before the replay
+	// query runs, so it comes back from both paths
+	third := send("live 1")
+	deliverMessage(third)
+	// Live deliveries the replay cannot see, handed over out of order
+	later := Message{ID: third.ID + 2, Tenant: third.Tenant, SenderID: 2, RecipientID: 1, Content: "live 3"}
+	middle := Message{ID: third.ID + 1, Tenant: third.Tenant, SenderID: 2, RecipientID: 1, Content: "live 2"}
+	deliverMessage(later)
+	deliverMessage(middle)
+
+	<-replaySlots
+	for _, want := range []Message{first, second, third, middle, later} {
+		if got := readMessage(t, client); got.ID != want.ID {
+			t.Fatalf("got message %d (%q), want %d (%q)", got.ID, got.Content, want.ID, want.Content)
+		}
+	}
+	<-done
+	expectNoFrame(t, client)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// RoomMember is a persisted room membership from the room_members collection.
+type RoomMember struct {
+	Tenant          string `bson:"tenant"`          // Tenant the room belongs to
+	RoomID          int64  `bson:"roomId"`          // Room joined
+	UserID          int64  `bson:"userId"`          // Member
+	JoinedAt        int64  `bson:"joinedAt"`        // When the user joined; earlier messages are not queued for them
+	LastDeliveredID int64  `bson:"lastDeliveredId"` // Highest room message ID delivered to the member
+}
+
+var roomMembersColl *mongo.Collection // Collection holding room memberships
+
+// roomMemberIndexes backs membership lookups by room and by user. Tenant
+// leads like every other index; the unique key makes joins idempotent.
+var roomMemberIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "tenant", Value: 1},
+			{Key: "roomId", Value: 1},
+			{Key: "userId", Value: 1},
+		},
+		Options: options.Index().SetName("tenant_room_user").SetUnique(true),
+	},
+	{
+		// Rooms of a user, for catching up on connect
+		Keys: bson.D{
+			{Key: "tenant", Value: 1},
+			{Key: "userId", Value: 1},
+		},
+		Options: options.Index().SetName("tenant_user"),
+	},
+}
+
+// roomRequest is the data of inbound join and leave frames.
+type roomRequest struct {
+	RoomID int64 `json:"roomId"`
+}
+
+// roomConversationID returns the conversationId of a room's messages.
+func roomConversationID(roomID int64) string {
+	return "room:" + strconv.FormatInt(roomID, 10)
+}
+
+func memberFilter(tenant string, userID, roomID int64) bson.D {
+	return bson.D{
+		{Key: "tenant", Value: tenant},
+		{Key: "roomId", Value: roomID},
+		{Key: "userId", Value: userID},
+	}
+}
+
+// joinRoom records the user as a room member. Joining again keeps the
+// original membership.
+func joinRoom(ctx context.Context, tenant string, userID, roomID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	update := bson.D{{Key: "$setOnInsert", Value: bson.D{
+		{Key: "joinedAt", Value: time.Now().Unix()},
+		{Key: "lastDeliveredId", Value: int64(0)},
+	}}}
+	_, err := roomMembersColl.UpdateOne(ctx, memberFilter(tenant, userID, roomID), update, options.Update().SetUpsert(true))
+	return err
+}
+
+// leaveRoom removes the user's membership of a room.
+func leaveRoom(ctx context.Context, tenant string, userID, roomID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := roomMembersColl.DeleteOne(ctx, memberFilter(tenant, userID, roomID))
+	return err
+}
+
+// isRoomMember reports whether the user is a member of the room.
+func isRoomMember(ctx context.Context, tenant string, userID, roomID int64) (bool, error) {
+	n, err := roomMembersColl.CountDocuments(ctx, memberFilter(tenant, userID, roomID), options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// roomMembers lists the user IDs of a room's members.
+func roomMembers(tenant string, roomID int64) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.D{{Key: "tenant", Value: tenant}, {Key: "roomId", Value: roomID}}
+	cursor, err := roomMembersColl.Find(ctx, filter, options.Find().SetProjection(bson.D{{Key: "userId", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var members []RoomMember
+	if err := cursor.All(ctx, &members); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.UserID)
+	}
+	return ids, nil
+}
+
+// advanceRoomCursor records that the users received room messages up to messageID.
+func advanceRoomCursor(ctx context.Context, tenant string, roomID, messageID int64, userIDs []int64) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	filter := bson.D{
+		{Key: "tenant", Value: tenant},
+		{Key: "roomId", Value: roomID},
+		{Key: "userId", Value: bson.D{{Key: "$in", Value: userIDs}}},
+	}
+	update := bson.D{{Key: "$max", Value: bson.D{{Key: "lastDeliveredId", Value: messageID}}}}
+	_, err := roomMembersColl.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// deliverRoomMessage fans a stored room message out to the members who are
+// online, through the bounded fan-out pool. Offline members keep it queued
+// through their lastDeliveredId and receive it from deliverPendingRooms when
+// they next connect. So do members whose only sockets are still catching up:
+// their cursor moves once the held message is written, see settleHeld.
+func deliverRoomMessage(message Message) {
+	members, err := roomMembers(message.Tenant, message.RoomID)
+	if err != nil {
+		slog.Error("Room member lookup error", "room_id", message.RoomID, "error", err)
+		return
+	}
+
+	// Only online members need a worker
+	var online []int64
+	for _, userID := range members {
+		if userID != message.SenderID && hub.Sockets(message.Tenant, userID) != nil {
+			online = append(online, userID)
+		}
+	}
+
+	var mu sync.Mutex
+	delivered := []int64{message.SenderID}
+	fanOut(len(online), func(i int) {
+		if sendToSockets(message.Tenant, online[i], nil, message) > 0 {
+			mu.Lock()
+			delivered = append(delivered, online[i])
+			mu.Unlock()
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := advanceRoomCursor(ctx, message.Tenant, message.RoomID, message.ID, delivered); err != nil {
+		slog.Error("Room cursor update error", "error", err)
+	}
+}
+
+// deliverPendingRooms sends room messages posted since each of the user's
+// rooms last delivered to them, oldest first.
+func deliverPendingRooms(ctx context.Context, c *connEntry) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	cursor, err := roomMembersColl.Find(ctx, bson.D{{Key: "tenant", Value: c.tenant}, {Key: "userId", Value: c.userID}})
+	if err != nil {
+		slog.Error("Room membership query error", "error", err)
+		return
+	}
+	var memberships []RoomMember
+	if err := cursor.All(ctx, &memberships); err != nil {
+		slog.Error("Room membership decode error", "error", err)
+		return
+	}
+
+	sent := 0
+	for _, membership := range memberships {
+		filter := bson.D{
+			{Key: "tenant", Value: c.tenant},
+			{Key: "roomId", Value: membership.RoomID},
+			{Key: "_id", Value: bson.D{{Key: "$gt", Value: membership.LastDeliveredID}}},
+			{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: membership.JoinedAt}}},
+			{Key: "senderId", Value: bson.D{{Key: "$ne", Value: c.userID}}},
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		msgCursor, err := collection.Find(ctx, filter, opts)
+		if err != nil {
+			slog.Error("Room pending query error", "room_id", membership.RoomID, "error", err)
+			continue
+		}
+		var messages []Message
+		if err := msgCursor.All(ctx, &messages); err != nil {
+			slog.Error("Room pending decode error", "room_id", membership.RoomID, "error", err)
+			continue
+		}
+
+		var last int64
+		for _, message := range messages {
+			applyTombstone(&message)
+			if err := c.writeReplayed(message); err != nil {
+				slog.Warn("Pending room delivery failed", "user_id", c.userID, "error", err)
+				break
+			}
+			last = message.ID
+			sent++
+			if !pauseReplay(ctx, sent) {
+				break
+			}
+		}
+		if last > 0 {
+			if err := advanceRoomCursor(ctx, c.tenant, membership.RoomID, last, []int64{c.userID}); err != nil {
+				slog.Error("Room cursor update error", "error", err)
+			}
+		}
+	}
+}
+
+// handleJoin makes the user a member of a room and confirms with a join frame.
+func (s *session) handleJoin(data []byte) bool {
+	if reason := s.checkWrite(); reason != "" {
+		return s.reject(reason)
+	}
+	var req roomRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.RoomID <= 0 {
+		return s.reject("invalid_room")
+	}
+	if err := joinRoom(s.ctx, s.claims.TenantID(), s.claims.ID, req.RoomID); err != nil {
+		slog.Error("Room join error", "error", err)
+		return s.reject("room_failed")
+	}
+	slog.Info("User joined room", "user_id", s.claims.ID, "room_id", req.RoomID)
+	return s.confirmRoom(envelopeJoin, req.RoomID)
+}
+
+// handleLeave ends the user's membership of a room and confirms with a leave frame.
+func (s *session) handleLeave(data []byte) bool {
+	if reason := s.checkWrite(); reason != "" {
+		return s.reject(reason)
+	}
+	var req roomRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.RoomID <= 0 {
+		return s.reject("invalid_room")
+	}
+	if err := leaveRoom(s.ctx, s.claims.TenantID(), s.claims.ID, req.RoomID); err != nil {
+		slog.Error("Room leave error", "error", err)
+		return s.reject("room_failed")
+	}
+	slog.Info("User left room", "user_id", s.claims.ID, "room_id", req.RoomID)
+	return s.confirmRoom(envelopeLeave, req.RoomID)
+}
+
+// confirmRoom echoes a join or leave back to the client once applied.
+func (s *session) confirmRoom(frameType string, roomID int64) bool {
+	return s.reply(Frame{Type: frameType, Data: roomRequest{RoomID: roomID}})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// roomCursor returns the lastDeliveredId of a user's room membership.
+func roomCursor(t *testing.T, userID, roomID int64) int64 {
+	t.Helper()
+	var member RoomMember
+	if err := roomMembersColl.FindOne(context.Background(), memberFilter(defaultTenant, userID, roomID)).Decode(&member); err != nil {
+		t.Fatalf("loading membership: %v", err)
+	}
+	return member.LastDeliveredID
+}
+
+func TestLiveRoomMessageDuringCatchUp(t *testing.T) {
+	useTestDB(t)
+	saved := replaySlots
+	replaySlots = make(chan struct{}, 1)
+	t.Cleanup(func() { replaySlots = saved })
+
+	ctx := context.Background()
+	for _, userID := range []int64{1, 2} {
+		if err := joinRoom(ctx, defaultTenant, userID, 7); err != nil {
+			t.Fatalf("joinRoom: %v", err)
+		}
+	}
+	post := func(content string) Message {
+		t.Helper()
+		stored, err := InsertMessage(ctx, Message{SenderID: 2, RoomID: 7, Content: content})
+		if err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+		return stored
+	}
+	queued := []Message{post("queued 1"), post("queued 2")}
+
+	entry, client := newTestConn(t, &JWTClaims{ID: 1}, nil)
+	entry.holdLive()
+	hub.Register(entry)
+	t.Cleanup(func() { hub.Unregister(entry) })
+	replaySlots <- struct{}{}
+	done := make(chan struct{})
+	go func() {
+		catchUp(ctx, entry)
+		close(done)
+	}()
+
+	// Advancing the cursor here would make the catch-up skip the queued messages
+	live := post("live")
+	deliverRoomMessage(live)
+	// Posted after the catch-up read the room, so only the held copy reaches the user
+	unseen := Message{ID: live.ID + 1, Tenant: defaultTenant, SenderID: 2, RoomID: 7, Content: "unseen"}
+	deliverRoomMessage(unseen)
+	if cursor := roomCursor(t, 1, 7); cursor != 0 {
+		t.Fatalf("cursor moved to %d before catch-up", cursor)
+	}
+
+	<-replaySlots
+	for _, want := range append(queued, live, unseen) {
+		if got := readMessage(t, client); got.ID != want.ID {
+			t.Fatalf("got message %d (%q), want %d (%q)", got.ID, got.Content, want.ID, want.Content)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("catch-up did not finish")
+	}
+	if cursor := roomCursor(t, 1, 7); cursor != unseen.ID {
+		t.Errorf("cursor = %d after catch-up, want %d", cursor, unseen.ID)
+	}
+	expectNoFrame(t, client)
+}
+
+func TestRoomJoinPostLeave(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	sessions := make(map[int64]*session)
+	clients := make(map[int64]*websocket.Conn)
+	for _, userID := range []int64{1, 2, 3} {
+		claims := &JWTClaims{ID: userID}
+		entry, client := newTestConn(t, claims, nil)
+		hub.Register(entry)
+		t.Cleanup(func() { hub.Unregister(entry) })
+		sessions[userID], clients[userID] = newSession(ctx, entry, claims), client
+	}
+	send := func(userID int64, frame, wantType string) {
+		t.Helper()
+		if !sessions[userID].handleFrame([]byte(frame)) {
+			t.Fatalf("%s ended the session", frame)
+		}
+		if reply := readReply(t, clients[userID]); reply.Type != wantType {
+			t.Fatalf("user %d, %s: got %s frame, want %s", userID, frame, reply.Type, wantType)
+		}
+	}
+
+	send(1, `{"type":"join","data":{"roomId":5}}`, envelopeJoin)
+	send(2, `{"type":"join","data":{"roomId":5}}`, envelopeJoin)
+	send(1, `{"roomId":5,"content":"hello room"}`, envelopeAck)
+	if got := readMessage(t, clients[2]); got.RoomID != 5 || got.SenderID != 1 || got.Content != "hello room" {
+		t.Errorf("member got %+v, want the room message from 1", got)
+	}
+
+	// Only members may post
+	sessions[3].handleFrame([]byte(`{"roomId":5,"content":"let me in"}`))
+	if reason := readErrorReason(t, clients[3]); reason != "not_in_room" {
+		t.Errorf("outsider: reason = %q, want not_in_room", reason)
+	}
+
+	send(2, `{"type":"leave","data":{"roomId":5}}`, envelopeLeave)
+	send(1, `{"roomId":5,"content":"anyone?"}`, envelopeAck)
+	expectNoFrame(t, clients[2])
+	expectNoFrame(t, clients[3])
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// messageSchema validates inbound chat frames when MESSAGE_SCHEMA_PATH points
+// at a JSON schema file. It is nil when no schema is configured.
+var messageSchema = loadMessageSchema(envString("MESSAGE_SCHEMA_PATH", ""))
+
+func loadMessageSchema(path string) *jsonschema.Schema {
+	if path == "" {
+		return nil
+	}
+	schema, err := jsonschema.Compile(path)
+	if err != nil {
+		log.Fatalf("Error loading message schema %s: %v", path, err)
+	}
+	slog.Info("Inbound messages are validated against schema", "path", path)
+	return schema
+}
+
+// validateMessageSchema checks a raw inbound frame against the configured
+// schema and returns one description per failing constraint.
+func validateMessageSchema(data []byte) []string {
+	if messageSchema == nil {
+		return nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return []string{"invalid JSON: " + err.Error()}
+	}
+
+	err := messageSchema.Validate(doc)
+	if err == nil {
+		return nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []string{err.Error()}
+	}
+	return schemaErrorLeaves(ve, nil)
+}
+
+// schemaErrorLeaves flattens a validation error tree into its leaf causes,
+// which name the offending location and constraint.
+func schemaErrorLeaves(ve *jsonschema.ValidationError, out []string) []string {
+	if len(ve.Causes) == 0 {
+		location := ve.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		return append(out, fmt.Sprintf("%s: %s", location, ve.Message))
+	}
+	for _, cause := range ve.Causes {
+		out = schemaErrorLeaves(cause, out)
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSampleSchema validates inbound messages against testdata/message.schema.json
+// for the rest of the test.
+func useSampleSchema(t *testing.T) {
+	t.Helper()
+	saved := messageSchema
+	t.Cleanup(func() { messageSchema = saved })
+	messageSchema = loadMessageSchema("testdata/message.schema.json")
+}
+
+func TestValidateMessageSchema(t *testing.T) {
+	useSampleSchema(t)
+	for _, tc := range []struct {
+		data string
+		want []string // Sorted locations of the violations, none for a valid message
+	}{
+		{`{"recipientId":2,"content":"hi","clientMsgId":"c1"}`, nil},
+		{`{"recipientId":2}`, []string{"/"}},
+		{`{"recipientId":0,"content":"hi"}`, []string{"/recipientId"}},
+		{`{"recipientId":2,"content":"` + strings.Repeat("a", 281) + `"}`, []string{"/content"}},
+		{`{"recipientId":"2","content":""}`, []string{"/content", "/recipientId"}},
+	} {
+		var locations []string
+		for _, violation := range validateMessageSchema([]byte(tc.data)) {
+			location, _, _ := strings.Cut(violation, ": ")
+			locations = append(locations, location)
+		}
+		slices.Sort(locations)
+		if !slices.Equal(locations, tc.want) {
+			t.Errorf("validateMessageSchema(%.40s) failed at %q, want %q", tc.data, locations, tc.want)
+		}
+	}
+}
+
+func TestSchemaViolationRejectsMessage(t *testing.T) {
+	useSampleSchema(t)
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+
+	if !s.handleFrame([]byte(`{"type":"message","data":{"recipientId":2,"content":""}}`)) {
+		t.Fatal("handleFrame ended the session")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading error frame: %v", err)
+	}
+	var frame ErrorFrame
+	json.Unmarshal(data, &frame)
+	if frame.Reason != "schema_validation" || len(frame.Details) != 1 || !strings.HasPrefix(frame.Details[0], "/content: ") {
+		t.Errorf("got %s, want a schema_validation error naming /content", data)
+	}
+	expectNoFrame(t, client)
+}
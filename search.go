@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultSearchLimit = 20  // Results returned when limit is not given
+	maxSearchLimit     = 100 // Most results a client may request
+	maxSearchQuery     = 256 // Longest query accepted, in runes
+)
+
+// searchHandler serves GET /search?q=&limit=, a full-text search over the
+// messages the caller sent or received. Results are ordered by relevance,
+// then newest first. Deleted messages are never returned.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET")
+		return
+	}
+
+	claims, err := validateJWTToken(bearerToken(r))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "q", "q is required")
+		return
+	}
+	if utf8.RuneCountInString(q) > maxSearchQuery {
+		writeFieldError(w, http.StatusBadRequest, "validation_error", "q", "q must be at most 256 characters")
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxSearchLimit {
+			writeFieldError(w, http.StatusBadRequest, "validation_error", "limit", "limit must be between 1 and 100")
+			return
+		}
+	}
+
+	// Bound how many queries the user runs at once
+	if !queryLimits.acquire(claims.TenantID(), claims.ID) {
+		writeError(w, http.StatusTooManyRequests, "too_many_queries", "Too many queries in flight; retry when one completes")
+		return
+	}
+	defer queryLimits.release(claims.TenantID(), claims.ID)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// The text index leads with tenant, so it must be matched exactly
+	filter := bson.D{
+		{Key: "tenant", Value: claims.TenantID()},
+		{Key: "$text", Value: bson.D{{Key: "$search", Value: q}}},
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "senderId", Value: claims.ID}},
+			bson.D{{Key: "recipientId", Value: claims.ID}},
+		}},
+	}
+	score := bson.D{{Key: "$meta", Value: "textScore"}}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "score", Value: score}}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "timestamp", Value: -1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := historyColl.Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("Search query error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Search failed")
+		return
+	}
+	messages := []Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		slog.Error("Search decode error", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Search failed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, messages)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSearchHandler(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	for _, message := range []Message{
+		{SenderID: 1, RecipientID: 2, Content: "lunch at the harbour"},
+		{SenderID: 2, RecipientID: 1, Content: "see you tomorrow"},
+		{SenderID: 2, RecipientID: 3, Content: "harbour is closed"}, // Not the caller's
+	} {
+		if _, err := InsertMessage(ctx, message); err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+	}
+	search := func(q string) []Message {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/search?q="+url.QueryEscape(q), nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, 1, time.Now().Add(time.Hour)))
+		rec := httptest.NewRecorder()
+		searchHandler(rec, req)
+		var results []Message
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &results) != nil {
+			t.Fatalf("GET /search?q=%s: status %d, body %s", q, rec.Code, rec.Body)
+		}
+		return results
+	}
+
+	if results := search("harbour"); len(results) != 1 || results[0].Content != "lunch at the harbour" {
+		t.Errorf("harbour matched %+v, want only the caller's message", results)
+	}
+	if results := search("submarine"); results == nil || len(results) != 0 {
+		t.Errorf("submarine matched %+v, want an empty array", results)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// startupSelfTest runs runSelfTest before the server accepts clients.
+var startupSelfTest = envBool("STARTUP_SELFTEST", false)
+
+const (
+	selfTestCollection = "selftest"          // Scratch collection, never holds real messages
+	selfTestSequence   = "selftest_sequence" // Separate counter so message IDs are not consumed
+)
+
+// runSelfTest allocates a sequence value, inserts a marked test message into
+// a scratch collection, reads it back and deletes it, verifying the MongoDB
+// round-trip end to end.
+func runSelfTest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := ensureSequence(ctx, selfTestSequence); err != nil {
+		return fmt.Errorf("sequence bootstrap: %w", err)
+	}
+	seq, err := getNextSequence(ctx, selfTestSequence)
+	if err != nil {
+		return fmt.Errorf("sequence allocation: %w", err)
+	}
+
+	coll := mongoDB.Collection(selfTestCollection)
+	probe := Message{
+		ID:          seq,
+		Tenant:      defaultTenant,
+		SenderID:    -1, // Negative IDs mark the document as a self-test probe
+		RecipientID: -1,
+		Content:     "startup self-test",
+		Timestamp:   time.Now().Unix(),
+	}
+	if _, err := coll.InsertOne(ctx, probe); err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+
+	filter := bson.D{{Key: "_id", Value: probe.ID}}
+	var readBack Message
+	if err := coll.FindOne(ctx, filter).Decode(&readBack); err != nil {
+		return fmt.Errorf("read back: %w", err)
+	}
+	if readBack.Content != probe.Content || readBack.Timestamp != probe.Timestamp {
+		return fmt.Errorf("read back mismatch: got %+v, want %+v", readBack, probe)
+	}
+
+	if _, err := coll.DeleteOne(ctx, filter); err != nil {
+		return fmt.Errorf("cleanup: %w", err)
+	}
+
+	slog.Info("Startup self-test passed", "sequence", seq)
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// session holds the per-connection state of a WebSocket read loop.
+type session struct {
+	ctx           context.Context // Canceled when the connection ends, aborting in-flight work
+	client        *connEntry
+	claims        *JWTClaims
+	seenClientIDs *recentIDSet      // clientMsgIds already used on this connection
+	abuse         *abuseTracker     // Sustained send volume, for abuse escalation
+	limiter       *rate.Limiter     // Token bucket for chat messages
+	attachment    *attachmentHeader // Announced attachment awaiting its binary frame
+	requestID     string            // requestId of the frame being handled, echoed on its reply
+	held          *heldSends        // Messages waiting out their undo window
+}
+
+func newSession(ctx context.Context, client *connEntry, claims *JWTClaims) *session {
+	return &session{
+		ctx:           ctx,
+		client:        client,
+		claims:        claims,
+		seenClientIDs: newRecentIDSet(clientIDWindow),
+		abuse:         newAbuseTracker(),
+		limiter:       newMessageLimiter(),
+		held:          newHeldSends(),
+	}
+}
+
+// reject sends an error frame and reports whether the session may continue.
+func (s *session) reject(reason string) bool {
+	return s.rejectDetails(reason, nil)
+}
+
+// rejectDetails sends an error frame carrying additional details.
+func (s *session) rejectDetails(reason string, details []string) bool {
+	frame := ErrorFrame{Type: "error", RequestID: s.requestID, Reason: reason, Details: details}
+	if err := s.client.writeJSON(frame); err != nil {
+		slog.Warn("Write error", "error", err)
+		return false
+	}
+	return true
+}
+
+// reply answers the frame being handled, echoing its requestId, and reports
+// whether the session may continue.
+func (s *session) reply(frame Frame) bool {
+	frame.RequestID = s.requestID
+	if err := s.client.writeJSON(frame); err != nil {
+		slog.Warn("Write error", "error", err)
+		return false
+	}
+	return true
+}
+
+// checkWrite applies the gates every frame that changes stored state must
+// pass: maintenance mode and the connection's rate limit. It returns the
+// reason to reject the frame with, or "" when it may proceed.
+func (s *session) checkWrite() string {
+	// Writes are refused during maintenance, but the connection stays open
+	if maintenanceMode.Load() {
+		return "maintenance"
+	}
+	return s.checkRate()
+}
+
+// checkRate applies the connection's rate limit alone, for frames that
+// change nothing stored. It returns "rate_limited" when the frame must be
+// dropped, or "".
+func (s *session) checkRate() string {
+	// Drop frames beyond the connection's rate limit without applying them,
+	// telling the client how long to pause first
+	reservation := s.limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		s.sendBackpressure(delay)
+		return "rate_limited"
+	}
+	return ""
+}
+
+// sendBackpressure tells the client to hold off writing for delay. A failed
+// write surfaces when the caller sends its error frame.
+func (s *session) sendBackpressure(delay time.Duration) {
+	retryAfter := (delay + time.Millisecond - 1) / time.Millisecond // Rounded up, so retrying then succeeds
+	frame := BackpressureFrame{Type: "backpressure", RetryAfterMs: int64(retryAfter)}
+	if err := s.client.writeJSON(frame); err != nil {
+		slog.Warn("Write error", "error", err)
+	}
+}
+
+// handleFrame dispatches one inbound text frame on its envelope type and
+// reports whether the read loop may continue.
+func (s *session) handleFrame(data []byte) bool {
+	s.requestID = ""
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		slog.Info("Invalid frame JSON", "user_id", s.claims.ID, "error", err)
+		slog.Debug("Invalid frame data", "user_id", s.claims.ID, sensitiveAttr("data", string(data)))
+		return s.reject("invalid_json")
+	}
+	s.requestID = envelope.RequestID
+
+	switch envelope.Type {
+	case "":
+		// Frames from before the envelope are bare chat messages
+		return s.handleChatMessage(data)
+	case envelopeMessage:
+		return s.handleChatMessage(envelope.Data)
+	case envelopeTyping:
+		return s.handleTyping(envelope.Data)
+	case envelopeRead:
+		return s.handleRead(envelope.Data)
+	case envelopeReceived:
+		return s.handleReceived(envelope.Data)
+	case envelopeJoin:
+		return s.handleJoin(envelope.Data)
+	case envelopeLeave:
+		return s.handleLeave(envelope.Data)
+	case envelopeEdit:
+		return s.handleEdit(envelope.Data)
+	case envelopeDelete:
+		return s.handleDelete(envelope.Data)
+	case envelopeAttachment:
+		return s.handleAttachmentHeader(envelope.Data)
+	case envelopeUndo:
+		return s.handleUndo(data, envelope.Data)
+	case envelopeSubscribe:
+		return s.handleSubscribe(data, envelope.Data, true)
+	case envelopeUnsubscribe:
+		return s.handleSubscribe(data, envelope.Data, false)
+	case envelopeResync:
+		return s.handleResync(envelope.Data)
+	default:
+		slog.Warn("Unknown frame type", "type", envelope.Type, "user_id", s.claims.ID)
+		return s.reject("unknown_type")
+	}
+}
+
+// ackEvent is the data of the ack frame sent back for a stored message.
+type ackEvent struct {
+	ClientTempID string `json:"clientTempId,omitempty"` // Echoed from the message, if the client set one
+	ID           int64  `json:"id"`                     // Server-assigned sequence ID
+	Timestamp    int64  `json:"timestamp"`              // Authoritative server timestamp
+}
+
+// handleChatMessage validates, stores and delivers a chat message.
+func (s *session) handleChatMessage(data []byte) bool {
+	// Enforce the operator-supplied schema before decoding
+	if violations := validateMessageSchema(data); len(violations) > 0 {
+		slog.Info("Message failed schema validation", "user_id", s.claims.ID, "violations", violations)
+		return s.rejectDetails("schema_validation", violations)
+	}
+
+	// Parse the incoming message into the Message struct
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		slog.Info("Invalid message JSON", "user_id", s.claims.ID, "error", err)
+		slog.Debug("Invalid message data", "user_id", s.claims.ID, sensitiveAttr("data", string(data)))
+		return s.reject("invalid_json")
+	}
+
+	// Log the parsed message details
+	slog.Debug("Parsed message", "user_id", s.claims.ID, "recipient_id", message.RecipientID, "room_id", message.RoomID, sensitiveAttr("content", message.Content))
+
+	// Attachments only arrive as binary frames
+	message.Type = ""
+	message.Attachment = nil
+
+	return s.sendMessage(message, nil)
+}
+
+// rejectInsert reports a message that failed validation or storage to the
+// client; the session continues. Failures that no retry can fix are also
+// reported with a deliveryFailed frame.
+func (s *session) rejectInsert(message Message, err error) bool {
+	reason := "insert_failed"
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		reason = validationErr.Reason
+	} else {
+		slog.Error("MongoDB insert error", "user_id", s.claims.ID, "error", err)
+	}
+	if !s.reject(reason) {
+		return false
+	}
+	if reason != "unknown_recipient" {
+		return true
+	}
+	frame := DeliveryFailedFrame{
+		Type:         "deliveryFailed",
+		ClientMsgID:  message.ClientMsgID,
+		ClientTempID: message.ClientTempID,
+		Reason:       deliveryFailureReason(reason),
+	}
+	if err := s.client.writeJSON(frame); err != nil {
+		slog.Warn("Write error", "error", err)
+		return false
+	}
+	return true
+}
+
+// sendMessage applies the send policy to a decoded message, then stores,
+// acknowledges and delivers it. upload, if set, runs once every check has
+// passed, right before the insert, so refused messages never store a blob.
+func (s *session) sendMessage(message Message, upload func(*Message) error) bool {
+	// Maintenance and the rate limit come first, before any database work
+	if reason := s.checkWrite(); reason != "" {
+		return s.reject(reason)
+	}
+
+	// Set SenderID from JWT claims
+	message.SenderID = s.claims.ID
+
+	// Scope the message to the sender's tenant, ignoring any client-supplied value
+	message.Tenant = s.claims.TenantID()
+
+	// Only members of a room may post to it
+	if message.RoomID != 0 {
+		ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+		member, err := isRoomMember(ctx, s.claims.TenantID(), s.claims.ID, message.RoomID)
+		cancel()
+		if err != nil {
+			slog.Error("Room membership check error", "error", err)
+			return s.reject("insert_failed")
+		}
+		if !member {
+			return s.reject("not_in_room")
+		}
+	}
+
+	// A reused clientMsgId is a client bug: flag it in strict mode, drop it otherwise
+	if message.ClientMsgID != "" && s.seenClientIDs.Contains(message.ClientMsgID) {
+		slog.Info("Duplicate clientMsgId", "client_msg_id", message.ClientMsgID, "user_id", s.claims.ID)
+		if duplicateClientIDMode == duplicateModeStrict {
+			return s.reject("duplicate_client_id")
+		}
+		return true
+	}
+
+	// Escalate against senders that keep exceeding the sustained volume limit
+	switch s.abuse.Record(time.Now()) {
+	case abuseWarn:
+		// The warned message is still sent
+		slog.Warn("Abuse threshold exceeded: warning", "user_id", s.claims.ID)
+		if !s.reject("abuse_warning") {
+			return false
+		}
+	case abuseSuspend:
+		slog.Warn("Abuse threshold exceeded: suspended", "user_id", s.claims.ID)
+		return s.reject("send_suspended")
+	case abuseDisconnect:
+		slog.Warn("Disconnected for sustained abuse", "user_id", s.claims.ID)
+		closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "abuse")
+		s.client.writeMessage(websocket.CloseMessage, closeMsg)
+		return false
+	}
+
+	// Validate before the upload so an invalid message never stores a blob
+	validated, err := validateMessage(s.ctx, message)
+	if err != nil {
+		return s.rejectInsert(message, err)
+	}
+	message = validated
+
+	// Clients with undo get a window to take the message back before it is stored
+	if upload == nil && message.ClientMsgID != "" && s.holdsSends() {
+		return s.holdSend(message)
+	}
+
+	if upload != nil {
+		if err := upload(&message); err != nil {
+			slog.Error("Attachment upload error", "user_id", s.claims.ID, "error", err)
+			return s.reject("upload_failed")
+		}
+	}
+
+	// Insert the validated message into MongoDB
+	stored, err := insertValidated(s.ctx, message)
+	if err != nil {
+		// Do not leave the blob of a message that was never stored behind
+		if message.Attachment != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := blobStore.Delete(ctx, message.Attachment.ID); err != nil {
+				slog.Warn("Attachment blob delete error", "attachment_id", message.Attachment.ID, "error", err)
+			}
+			cancel()
+		}
+		return s.rejectInsert(message, err)
+	}
+	if message.ClientMsgID != "" {
+		s.seenClientIDs.Add(message.ClientMsgID)
+	}
+	return s.announce(stored)
+}
+
+// announce acknowledges a stored message to its sender and delivers it.
+func (s *session) announce(stored Message) bool {
+	// Tell the sender the ID and timestamp the server assigned
+	ack := ackEvent{ClientTempID: stored.ClientTempID, ID: stored.ID, Timestamp: stored.Timestamp}
+	if !s.reply(Frame{Type: envelopeAck, Data: ack}) {
+		return false
+	}
+	stored.ClientTempID = "" // Only meaningful to the sender
+
+	// Keep the sender's other devices in sync with the conversation
+	sendToSockets(stored.Tenant, stored.SenderID, s.client, stored)
+
+	// Push the stored message to the recipient, or the room, if online
+	if stored.RoomID != 0 {
+		deliverRoomMessage(stored)
+	} else {
+		deliverMessage(stored)
+	}
+	emitMessageEvent(stored)
+	return true
+}
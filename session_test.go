@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"golang.org/x/time/rate"
+)
+
+func TestCheckWrite(t *testing.T) {
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := &session{client: entry, claims: claims, limiter: rate.NewLimiter(rate.Every(time.Hour), 1)}
+
+	maintenanceMode.Store(true)
+	if reason := s.checkWrite(); reason != "maintenance" {
+		t.Errorf("during maintenance: reason = %q, want maintenance", reason)
+	}
+	maintenanceMode.Store(false)
+
+	if reason := s.checkWrite(); reason != "" {
+		t.Errorf("first write: reason = %q, want none", reason)
+	}
+	if reason := s.checkWrite(); reason != "rate_limited" {
+		t.Errorf("write over the limit: reason = %q, want rate_limited", reason)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading backpressure frame: %v", err)
+	}
+	var frame BackpressureFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	if frame.Type != "backpressure" {
+		t.Errorf("frame type = %q, want backpressure", frame.Type)
+	}
+	// The single token refills after an hour; the rejected write must not have used it up
+	if frame.RetryAfterMs <= 0 || frame.RetryAfterMs > time.Hour.Milliseconds() {
+		t.Errorf("retryAfterMs = %d, want within (0, 1h]", frame.RetryAfterMs)
+	}
+	if reason := s.checkWrite(); reason != "rate_limited" {
+		t.Errorf("second write over the limit: reason = %q, want rate_limited", reason)
+	}
+	if n := s.limiter.TokensAt(time.Now().Add(time.Hour)); n < 0.99 {
+		t.Errorf("tokens an hour later = %v; refused writes must not borrow tokens", n)
+	}
+}
+
+// readReply reads one frame from a test client and decodes it, keeping the
+// echoed requestId.
+func readReply(t *testing.T, client *websocket.Conn) Envelope {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	return envelope
+}
+
+func TestRequestIDOnErrors(t *testing.T) {
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+
+	frames := []struct {
+		frame, wantID string
+	}{
+		{`{"type":"edit","requestId":"e1","data":{"id":0}}`, "e1"},
+		{`{"type":"bogus","requestId":"b1"}`, "b1"},
+		{`{"type":"join","data":{"roomId":0}}`, ""},
+		{`{"type":"read","requestId":"r1","data":{"messageIds":[]}}`, "r1"},
+		{`not json`, ""},
+	}
+	for _, f := range frames {
+		if !s.handleFrame([]byte(f.frame)) {
+			t.Fatalf("%s ended the session", f.frame)
+		}
+		reply := readReply(t, client)
+		if reply.Type != "error" || reply.RequestID != f.wantID {
+			t.Errorf("%s: got %s frame with requestId %q, want an error with %q", f.frame, reply.Type, reply.RequestID, f.wantID)
+		}
+	}
+}
+
+func TestRequestIDOnReplies(t *testing.T) {
+	useTestDB(t)
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+
+	send := func(frame, wantType, wantID string) json.RawMessage {
+		t.Helper()
+		if !s.handleFrame([]byte(frame)) {
+			t.Fatalf("%s ended the session", frame)
+		}
+		reply := readReply(t, client)
+		if reply.Type != wantType || reply.RequestID != wantID {
+			t.Fatalf("%s: got %s frame with requestId %q, want %s with %q", frame, reply.Type, reply.RequestID, wantType, wantID)
+		}
+		return reply.Data
+	}
+
+	var ack ackEvent
+	json.Unmarshal(send(`{"type":"message","requestId":"m1","data":{"recipientId":2,"content":"hi"}}`, envelopeAck, "m1"), &ack)
+	send(fmt.Sprintf(`{"type":"edit","requestId":"e1","data":{"id":%d,"content":"hello"}}`, ack.ID), envelopeEdit, "e1")
+	send(fmt.Sprintf(`{"type":"delete","requestId":"d1","data":{"id":%d}}`, ack.ID), envelopeDelete, "d1")
+	send(`{"type":"join","requestId":"j1","data":{"roomId":7}}`, envelopeJoin, "j1")
+	send(`{"type":"leave","requestId":"l1","data":{"roomId":7}}`, envelopeLeave, "l1")
+	send(`{"type":"edit","requestId":"e2","data":{"id":999,"content":"hello"}}`, "error", "e2")
+
+	received, err := InsertMessage(context.Background(), Message{SenderID: 2, RecipientID: 1, Content: "hey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read readEvent
+	json.Unmarshal(send(fmt.Sprintf(`{"type":"read","requestId":"r1","data":{"messageIds":[%d]}}`, received.ID), envelopeAck, "r1"), &read)
+	if len(read.MessageIDs) != 1 || read.MessageIDs[0] != received.ID {
+		t.Errorf("read ack = %+v, want message %d", read, received.ID)
+	}
+
+	// The attachment header's requestId comes back on the ack of its binary frame
+	blobStore = newMemoryBlobStore()
+	if !s.handleFrame([]byte(`{"type":"attachment","requestId":"a1","data":{"recipientId":2,"contentType":"image/png"}}`)) {
+		t.Fatal("header frame ended the session")
+	}
+	if !s.handleAttachment([]byte("data")) {
+		t.Fatal("binary frame ended the session")
+	}
+	if reply := readReply(t, client); reply.Type != envelopeAck || reply.RequestID != "a1" {
+		t.Errorf("attachment: got %s frame with requestId %q, want ack with a1", reply.Type, reply.RequestID)
+	}
+}
+
+func TestDeliveryFailedForUnknownRecipient(t *testing.T) {
+	saved := recipientValidator
+	t.Cleanup(func() { recipientValidator = saved })
+	recipientValidator = func(context.Context, string, int64) (bool, error) { return false, nil }
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+
+	if !s.handleFrame([]byte(`{"type":"message","data":{"recipientId":99,"content":"hi","clientMsgId":"c1","clientTempId":"t1"}}`)) {
+		t.Fatal("handleFrame ended the session")
+	}
+	if reason := readErrorReason(t, client); reason != "unknown_recipient" {
+		t.Errorf("error reason = %q, want unknown_recipient", reason)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading deliveryFailed frame: %v", err)
+	}
+	var frame DeliveryFailedFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	want := DeliveryFailedFrame{Type: "deliveryFailed", ClientMsgID: "c1", ClientTempID: "t1", Reason: "unknown_recipient"}
+	if frame != want {
+		t.Errorf("frame = %+v, want %+v", frame, want)
+	}
+}
+
+func TestDeliveryFailureReasonMasks(t *testing.T) {
+	if got := deliveryFailureReason("unknown_recipient"); got != "unknown_recipient" {
+		t.Errorf("unknown_recipient passed as %q", got)
+	}
+	if got := deliveryFailureReason("blocked"); got != "undeliverable" {
+		t.Errorf("blocked passed as %q, want undeliverable", got)
+	}
+}
+
+func TestMalformedFrameKeepsSession(t *testing.T) {
+	useTestDB(t)
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+
+	if !s.handleFrame([]byte(`{"recipientId":2,"content":`)) {
+		t.Fatal("malformed frame ended the session")
+	}
+	if reason := readErrorReason(t, client); reason != "invalid_json" {
+		t.Errorf("reason = %q, want invalid_json", reason)
+	}
+
+	if !s.handleFrame([]byte(`{"recipientId":2,"content":"after the garbage"}`)) {
+		t.Fatal("valid frame ended the session")
+	}
+	if reply := readReply(t, client); reply.Type != envelopeAck {
+		t.Fatalf("got %s frame, want the ack of the valid message", reply.Type)
+	}
+	var stored []Message
+	cursor, err := collection.Find(context.Background(), bson.D{})
+	if err != nil || cursor.All(context.Background(), &stored) != nil {
+		t.Fatalf("loading messages: %v", err)
+	}
+	if len(stored) != 1 || stored[0].Content != "after the garbage" {
+		t.Errorf("stored %+v, want only the valid message", stored)
+	}
+}
+
+func TestHandleFrameDispatch(t *testing.T) {
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+	s.limiter = rate.NewLimiter(rate.Inf, 1)
+
+	// Each handler names its own frame type in the reason it rejects bad data with
+	frames := []struct{ frame, reason string }{
+		{`{"content":7}`, "invalid_json"},
+		{`{"type":"message","data":"x"}`, "invalid_json"},
+		{`{"type":"typing","data":{}}`, "invalid_typing"},
+		{`{"type":"read","data":{"messageIds":[]}}`, "invalid_read"},
+		{`{"type":"received","data":{"messageIds":[1]}}`, "acks_not_enabled"},
+		{`{"type":"join","data":{"roomId":0}}`, "invalid_room"},
+		{`{"type":"leave","data":{"roomId":0}}`, "invalid_room"},
+		{`{"type":"edit","data":{"id":0}}`, "invalid_edit"},
+		{`{"type":"delete","data":{"id":0}}`, "invalid_delete"},
+		{`{"type":"attachment","data":"x"}`, "invalid_attachment"},
+		{`{"type":"undo"}`, "invalid_undo"},
+		{`{"type":"subscribe"}`, "invalid_subscription"},
+		{`{"type":"unsubscribe"}`, "invalid_subscription"},
+		{`{"type":"resync","data":{}}`, "invalid_resync"},
+		{`{"type":"bogus"}`, "unknown_type"},
+	}
+	for _, f := range frames {
+		if !s.handleFrame([]byte(f.frame)) {
+			t.Fatalf("%s ended the session", f.frame)
+		}
+		if reason := readErrorReason(t, client); reason != f.reason {
+			t.Errorf("%s: reason = %q, want %q", f.frame, reason, f.reason)
+		}
+	}
+}
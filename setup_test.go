@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// testSecret signs tokens in tests. It is installed before init reads
+// JWT_SECRET_KEY, since package variables are initialized before any init
+// function runs.
+const testSecret = "test-secret"
+
+var _ = func() bool {
+	os.Setenv("JWT_SECRET_KEY", testSecret)
+	os.Setenv("LOG_LEVEL", "error")
+	return true
+}()
+
+// newTestConn returns a connEntry for the server side of a live WebSocket
+// together with the client end of it.
+func newTestConn(t *testing.T, claims *JWTClaims, configure func(*websocket.Conn)) (*connEntry, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	conn := <-serverConns
+	t.Cleanup(func() { conn.Close() })
+	if configure != nil {
+		configure(conn)
+	}
+	return newConnEntry(claims, conn), client
+}
+
+// testToken returns an HS256 token for userID signed with testSecret.
+func testToken(t *testing.T, userID int64, expires time.Time) string {
+	t.Helper()
+	claims := JWTClaims{ID: userID, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expires)}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return token
+}
+
+// useTestDB points the MongoDB globals at a fresh database on the server in
+// MONGO_TEST_URI, with the sequence seeded and the indexes built, and drops it
+// when the test ends. Tests that need MongoDB are skipped when it is not set.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connecting to MongoDB: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("pinging MongoDB: %v", err)
+	}
+
+	savedDB, savedMessages, savedHistory, savedSeq := mongoDB, collection, historyColl, seqColl
+	savedPubkeys, savedUsers, savedMembers := pubkeyColl, usersColl, roomMembersColl
+	savedBlobs, savedTracker := blobStore, deliveryTracker
+	t.Cleanup(func() {
+		mongoDB, collection, historyColl, seqColl = savedDB, savedMessages, savedHistory, savedSeq
+		pubkeyColl, usersColl, roomMembersColl = savedPubkeys, savedUsers, savedMembers
+		blobStore, deliveryTracker = savedBlobs, savedTracker
+	})
+
+	mongoDB = client.Database(fmt.Sprintf("websocket_app_test_%d", time.Now().UnixNano()))
+	collection = mongoDB.Collection("messages")
+	historyColl = collection
+	seqColl = mongoDB.Collection("sequences")
+	pubkeyColl = mongoDB.Collection("user_pubkeys")
+	usersColl = mongoDB.Collection("users")
+	roomMembersColl = mongoDB.Collection("room_members")
+	blobStore = newGridFSBlobStore(mongoDB)
+	deliveryTracker = newMongoDeliveryTracker(mongoDB.Collection("device_deliveries"))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		mongoDB.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+
+	if err := ensureSequence(ctx, messageSequenceName); err != nil {
+		t.Fatalf("seeding the sequence: %v", err)
+	}
+	ensureIndexes(ctx)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownGrace bounds how long shutdown waits for connections to finish.
+var shutdownGrace = envDuration("SHUTDOWN_GRACE", 15*time.Second)
+
+var (
+	activeConns  sync.WaitGroup        // One per WebSocket session still running its read loop
+	shuttingDown = make(chan struct{}) // Closed when shutdown begins, releasing pending long-polls
+)
+
+// shutdown stops accepting requests, asks every WebSocket client to go
+// away and waits up to shutdownGrace for their sessions to end. Hijacked
+// WebSocket connections are not tracked by http.Server, hence activeConns.
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+
+	close(shuttingDown)
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shutdown error", "error", err)
+	}
+
+	n := hub.CloseAll(websocket.CloseGoingAway, "server shutting down")
+	slog.Info("Sent close frames", "connections", n)
+
+	done := make(chan struct{})
+	go func() {
+		activeConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("All connections closed")
+	case <-ctx.Done():
+		slog.Warn("Shutdown grace period elapsed with connections still open")
+	}
+}
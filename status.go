@@ -0,0 +1,118 @@
+package main
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// MessageStatus is where a direct message is in its lifecycle. It only
+// moves forward: sent, then delivered, then read. A message whose deliverBy
+// deadline passes while it is still sent moves to expired instead, which is
+// final. Room messages stay sent; per-member progress lives in the
+// room_members cursors.
+type MessageStatus string
+
+const (
+	statusSent      MessageStatus = "sent"      // Stored by the server
+	statusDelivered MessageStatus = "delivered" // Reached one of the recipient's clients
+	statusRead      MessageStatus = "read"      // Read receipt received from the recipient
+	statusExpired   MessageStatus = "expired"   // Not delivered by its deliverBy deadline; never delivered after
+)
+
+// StatusChange records when a message entered a status.
+type StatusChange struct {
+	Status MessageStatus `bson:"status" json:"status"`
+	At     int64         `bson:"at" json:"at"` // Unix time of the transition
+}
+
+// statusRank orders statuses; unknown statuses, including none at all on
+// documents written before statuses existed, rank lowest.
+func statusRank(status MessageStatus) int {
+	switch status {
+	case statusSent:
+		return 1
+	case statusDelivered:
+		return 2
+	case statusRead:
+		return 3
+	}
+	return 0
+}
+
+// validStatusTransition reports whether a message may move from one status
+// to the next. Statuses never move backwards or repeat, only a message not
+// yet delivered can expire, and an expired message stays expired.
+func validStatusTransition(from, to MessageStatus) bool {
+	switch {
+	case from == statusExpired:
+		return false
+	case to == statusExpired:
+		return statusRank(from) <= statusRank(statusSent)
+	}
+	return statusRank(to) > statusRank(from)
+}
+
+// statusesBefore lists the stored status values a message may advance to
+// status from, for use in update filters. nil matches documents without a
+// status.
+func statusesBefore(status MessageStatus) bson.A {
+	before := bson.A{nil}
+	for _, s := range []MessageStatus{statusSent, statusDelivered, statusRead} {
+		if validStatusTransition(s, status) {
+			before = append(before, s)
+		}
+	}
+	return before
+}
+
+// advanceStatus returns the filter clause and update that move matching
+// messages forward to status. Messages already at or past it are left alone.
+func advanceStatus(status MessageStatus, at time.Time, set bson.D) (bson.E, bson.D) {
+	clause := bson.E{Key: "status", Value: bson.D{{Key: "$in", Value: statusesBefore(status)}}}
+	set = append(set, bson.E{Key: "status", Value: status})
+	update := bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$push", Value: bson.D{{Key: "statusHistory", Value: StatusChange{Status: status, At: at.Unix()}}}},
+	}
+	return clause, update
+}
+
+// statusEvent is the data of a status frame, sent to the sender of messages
+// whose status advanced.
+type statusEvent struct {
+	MessageIDs []int64       `json:"messageIds"`
+	Status     MessageStatus `json:"status"`
+	At         int64         `json:"at"` // Unix time of the transition
+}
+
+// notifyStatus tells the senders in bySender that their messages reached
+// status. Sockets that opted into capStatusEvents get a status frame for
+// every transition. The others keep the frames they always had: a read
+// frame for reads, and nothing for deliveries, which they only see inline
+// in the status field of messages. Sockets with a status window get them
+// coalesced, see sendStatus.
+func notifyStatus(tenant string, bySender map[int64][]int64, status MessageStatus, at time.Time) {
+	for senderID, ids := range bySender {
+		for _, entry := range hub.Sockets(tenant, senderID) {
+			switch {
+			case entry.caps[capStatusEvents]:
+				entry.sendStatus(statusEvent{MessageIDs: ids, Status: status, At: at.Unix()})
+			case status == statusRead:
+				entry.sendRead(readEvent{MessageIDs: ids, ReadAt: at.Unix()})
+			}
+		}
+	}
+}
+
+// markStatus applies status to a message copy being sent to a client.
+func (m *Message) markStatus(status MessageStatus, at time.Time) {
+	if !validStatusTransition(m.Status, status) {
+		return
+	}
+	m.Status = status
+	m.StatusHistory = append(m.StatusHistory, StatusChange{Status: status, At: at.Unix()})
+	if statusRank(status) >= statusRank(statusDelivered) {
+		m.Delivered = true
+	}
+}
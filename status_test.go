@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readFrame reads one frame from a test client and decodes its envelope.
+func readFrame(t *testing.T, client *websocket.Conn) (string, json.RawMessage) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	return envelope.Type, envelope.Data
+}
+
+// readErrorReason reads one frame from a test client, which must be an error
+// frame, and returns its reason.
+func readErrorReason(t *testing.T, client *websocket.Conn) string {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	var frame ErrorFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	if frame.Type != "error" {
+		t.Fatalf("frame %s is not an error frame", data)
+	}
+	return frame.Reason
+}
+
+// expectNoFrame fails if the test client receives a frame soon. The client
+// cannot be read from afterwards.
+func expectNoFrame(t *testing.T, client *websocket.Conn) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := client.ReadMessage(); err == nil {
+		t.Errorf("unexpected frame %s", data)
+	}
+}
+
+func TestNotifyStatus(t *testing.T) {
+	claims := &JWTClaims{ID: 501}
+	modern, modernClient := newTestConn(t, claims, nil)
+	modern.caps = parseClientCaps(capStatusEvents)
+	legacy, legacyClient := newTestConn(t, claims, nil)
+	for _, entry := range []*connEntry{modern, legacy} {
+		hub.Register(entry)
+		t.Cleanup(func() { hub.Unregister(entry) })
+	}
+	at := time.Unix(1_700_000_000, 0)
+	bySender := map[int64][]int64{claims.ID: {7, 8}}
+
+	notifyStatus(claims.TenantID(), bySender, statusDelivered, at)
+	frameType, data := readFrame(t, modernClient)
+	var event statusEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if frameType != envelopeStatus || event.Status != statusDelivered || event.At != at.Unix() || len(event.MessageIDs) != 2 {
+		t.Errorf("delivered: got %s %+v", frameType, event)
+	}
+
+	notifyStatus(claims.TenantID(), bySender, statusRead, at)
+	frameType, data = readFrame(t, modernClient)
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if frameType != envelopeStatus || event.Status != statusRead {
+		t.Errorf("read, with capability: got %s %+v", frameType, event)
+	}
+	// The first frame without the capability is the read: deliveries were
+	// never sent to such clients
+	frameType, data = readFrame(t, legacyClient)
+	var read readEvent
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if frameType != envelopeRead || read.ReadAt != at.Unix() || len(read.MessageIDs) != 2 {
+		t.Errorf("read, without capability: got %s %+v", frameType, read)
+	}
+
+	// No read frame on top of the status frame, nor anything else
+	expectNoFrame(t, modernClient)
+	expectNoFrame(t, legacyClient)
+}
+
+func TestValidStatusTransition(t *testing.T) {
+	statuses := []MessageStatus{"", statusSent, statusDelivered, statusRead, statusExpired}
+	valid := map[[2]MessageStatus]bool{
+		{"", statusSent}:              true,
+		{"", statusDelivered}:         true,
+		{"", statusRead}:              true,
+		{"", statusExpired}:           true,
+		{statusSent, statusDelivered}: true,
+		{statusSent, statusRead}:      true,
+		{statusSent, statusExpired}:   true,
+		{statusDelivered, statusRead}: true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := valid[[2]MessageStatus{from, to}]
+			if got := validStatusTransition(from, to); got != want {
+				t.Errorf("validStatusTransition(%q, %q) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+	// Unknown statuses rank like a missing one
+	if validStatusTransition(statusSent, "archived") {
+		t.Error("an unknown status was accepted as a transition target")
+	}
+	if !validStatusTransition("archived", statusSent) {
+		t.Error("a message with an unknown status could not move to sent")
+	}
+}
+
+func TestStatusesBefore(t *testing.T) {
+	tests := []struct {
+		status MessageStatus
+		want   []interface{}
+	}{
+		{statusSent, []interface{}{nil}},
+		{statusDelivered, []interface{}{nil, statusSent}},
+		{statusRead, []interface{}{nil, statusSent, statusDelivered}},
+		{statusExpired, []interface{}{nil, statusSent}},
+	}
+	for _, tt := range tests {
+		got := statusesBefore(tt.status)
+		if len(got) != len(tt.want) {
+			t.Errorf("statusesBefore(%q) = %v, want %v", tt.status, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("statusesBefore(%q) = %v, want %v", tt.status, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMarkStatus(t *testing.T) {
+	at := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name          string
+		from          MessageStatus
+		to            MessageStatus
+		wantStatus    MessageStatus
+		wantHistory   int
+		wantDelivered bool
+	}{
+		{"sent to delivered", statusSent, statusDelivered, statusDelivered, 2, true},
+		{"sent to read", statusSent, statusRead, statusRead, 2, true},
+		{"delivered to read", statusDelivered, statusRead, statusRead, 2, true},
+		{"none to sent", "", statusSent, statusSent, 2, false},
+		{"read to delivered is ignored", statusRead, statusDelivered, statusRead, 1, false},
+		{"delivered to sent is ignored", statusDelivered, statusSent, statusDelivered, 1, false},
+		{"repeat is ignored", statusDelivered, statusDelivered, statusDelivered, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Message{Status: tt.from, StatusHistory: []StatusChange{{Status: tt.from, At: 1}}}
+			m.markStatus(tt.to, at)
+			if m.Status != tt.wantStatus || len(m.StatusHistory) != tt.wantHistory || m.Delivered != tt.wantDelivered {
+				t.Errorf("got status %q, %d history entries, delivered %v; want %q, %d, %v",
+					m.Status, len(m.StatusHistory), m.Delivered, tt.wantStatus, tt.wantHistory, tt.wantDelivered)
+			}
+			if tt.wantHistory == 2 {
+				if last := m.StatusHistory[1]; last.Status != tt.to || last.At != at.Unix() {
+					t.Errorf("new history entry = %+v, want %q at %d", last, tt.to, at.Unix())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status receipts can be coalesced per connection to spare chatty updates on
+// clients that pay for every frame. Status and read frames for a socket
+// within its window are merged into one frame per status when the window
+// ends. The window follows the client's platform, taken from the platform
+// claim of its token or else from ?platform= on /ws. Zero sends every
+// receipt at once.
+var (
+	statusWindow        = envDuration("STATUS_WINDOW", 0)                    // Clients with no or an unknown platform hint
+	statusWindowMobile  = envDuration("STATUS_WINDOW_MOBILE", 2*time.Second) // Platforms mobile, ios and android
+	statusWindowDesktop = envDuration("STATUS_WINDOW_DESKTOP", 0)            // Platforms desktop and web
+)
+
+const maxStatusWindow = 10 * time.Second // Longest a receipt may be held back
+
+func init() {
+	for name, window := range map[string]time.Duration{
+		"STATUS_WINDOW":         statusWindow,
+		"STATUS_WINDOW_MOBILE":  statusWindowMobile,
+		"STATUS_WINDOW_DESKTOP": statusWindowDesktop,
+	} {
+		if window < 0 || window > maxStatusWindow {
+			log.Fatalf("%s (%s) must be between 0 and %s", name, window, maxStatusWindow)
+		}
+	}
+}
+
+// statusWindowFor returns the coalescing window for a platform hint.
+func statusWindowFor(platform string) time.Duration {
+	switch strings.ToLower(platform) {
+	case "mobile", "ios", "android":
+		return statusWindowMobile
+	case "desktop", "web":
+		return statusWindowDesktop
+	default:
+		return statusWindow
+	}
+}
+
+// statusBatch collects the receipts of one socket during its window.
+type statusBatch struct {
+	mu     sync.Mutex
+	events map[MessageStatus]*statusEvent // Status frames, by status
+	reads  *readEvent                     // Read frame for sockets without capStatusEvents
+	timer  *time.Timer                    // Flushes the batch; nil when empty
+}
+
+// sendStatus sends a status frame to the connection, or merges it into the
+// receipts held for its window.
+func (c *connEntry) sendStatus(event statusEvent) {
+	if c.statusWindow <= 0 {
+		writeToSocket(c, Frame{Type: envelopeStatus, Data: event})
+		return
+	}
+	b := &c.statuses
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.events == nil {
+		b.events = make(map[MessageStatus]*statusEvent)
+	}
+	if held := b.events[event.Status]; held != nil {
+		held.MessageIDs = append(held.MessageIDs, event.MessageIDs...)
+		held.At = max(held.At, event.At)
+	} else {
+		event.MessageIDs = append([]int64{}, event.MessageIDs...)
+		b.events[event.Status] = &event
+	}
+	c.scheduleStatuses()
+}
+
+// sendRead sends a legacy read frame to the connection, or merges it into
+// the receipts held for its window.
+func (c *connEntry) sendRead(event readEvent) {
+	if c.statusWindow <= 0 {
+		writeToSocket(c, Frame{Type: envelopeRead, Data: event})
+		return
+	}
+	b := &c.statuses
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reads != nil {
+		b.reads.MessageIDs = append(b.reads.MessageIDs, event.MessageIDs...)
+		b.reads.ReadAt = max(b.reads.ReadAt, event.ReadAt)
+	} else {
+		event.MessageIDs = append([]int64{}, event.MessageIDs...)
+		b.reads = &event
+	}
+	c.scheduleStatuses()
+}
+
+// scheduleStatuses starts the window of the first receipt held.
+// c.statuses.mu must be held.
+func (c *connEntry) scheduleStatuses() {
+	if c.statuses.timer == nil {
+		c.statuses.timer = time.AfterFunc(c.statusWindow, c.flushStatuses)
+	}
+}
+
+// flushStatuses writes the receipts held for the window, a message's
+// earlier status first.
+func (c *connEntry) flushStatuses() {
+	b := &c.statuses
+	b.mu.Lock()
+	events, reads := b.events, b.reads
+	b.events, b.reads, b.timer = nil, nil, nil
+	b.mu.Unlock()
+
+	statuses := make([]MessageStatus, 0, len(events))
+	for status := range events {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statusRank(statuses[i]) < statusRank(statuses[j]) })
+	for _, status := range statuses {
+		writeToSocket(c, Frame{Type: envelopeStatus, Data: *events[status]})
+	}
+	if reads != nil {
+		writeToSocket(c, Frame{Type: envelopeRead, Data: *reads})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStatusWindowFor(t *testing.T) {
+	for platform, want := range map[string]time.Duration{
+		"":        statusWindow,
+		"iOS":     statusWindowMobile,
+		"android": statusWindowMobile,
+		"desktop": statusWindowDesktop,
+		"web":     statusWindowDesktop,
+		"toaster": statusWindow,
+	} {
+		if got := statusWindowFor(platform); got != want {
+			t.Errorf("statusWindowFor(%q) = %s, want %s", platform, got, want)
+		}
+	}
+}
+
+func TestStatusWindowCoalesces(t *testing.T) {
+	claims := &JWTClaims{ID: 521, Tenant: "coalesce"}
+	modern, modernClient := newTestConn(t, claims, nil)
+	modern.caps = parseClientCaps(capStatusEvents)
+	modern.statusWindow = 100 * time.Millisecond
+	legacy, legacyClient := newTestConn(t, claims, nil)
+	legacy.statusWindow = 100 * time.Millisecond
+	snappy, snappyClient := newTestConn(t, claims, nil)
+	snappy.caps = parseClientCaps(capStatusEvents)
+	for _, entry := range []*connEntry{modern, legacy, snappy} {
+		hub.Register(entry)
+		t.Cleanup(func() { hub.Unregister(entry) })
+	}
+
+	start := time.Now()
+	notifyStatus("coalesce", map[int64][]int64{521: {1}}, statusRead, start)
+	notifyStatus("coalesce", map[int64][]int64{521: {2, 3}}, statusDelivered, start)
+	notifyStatus("coalesce", map[int64][]int64{521: {2}}, statusRead, start.Add(time.Second))
+
+	// Without a window every receipt goes out at once
+	for _, want := range []MessageStatus{statusRead, statusDelivered, statusRead} {
+		_, data := readFrame(t, snappyClient)
+		var event statusEvent
+		json.Unmarshal(data, &event)
+		if event.Status != want {
+			t.Fatalf("snappy socket got %s, want status %s", data, want)
+		}
+	}
+
+	var delivered, read statusEvent
+	_, data := readFrame(t, modernClient)
+	json.Unmarshal(data, &delivered)
+	_, data = readFrame(t, modernClient)
+	json.Unmarshal(data, &read)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("coalesced receipts sent after %s, before the window ended", elapsed)
+	}
+	if delivered.Status != statusDelivered || !slices.Equal(delivered.MessageIDs, []int64{2, 3}) {
+		t.Errorf("first frame = %+v, want delivered [2 3]", delivered)
+	}
+	if read.Status != statusRead || !slices.Equal(read.MessageIDs, []int64{1, 2}) || read.At != start.Add(time.Second).Unix() {
+		t.Errorf("second frame = %+v, want read [1 2] at the latest time", read)
+	}
+
+	frameType, data := readFrame(t, legacyClient)
+	var legacyRead readEvent
+	json.Unmarshal(data, &legacyRead)
+	if frameType != envelopeRead || !slices.Equal(legacyRead.MessageIDs, []int64{1, 2}) {
+		t.Errorf("legacy socket got %s %s, want one read frame for [1 2]", frameType, data)
+	}
+	expectNoFrame(t, legacyClient)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Conversation subscriptions. A connection receives live messages only for
+// the conversations it is subscribed to; others are still stored, replayed
+// by the catch-up on the next connect and returned by history. Every
+// conversation starts subscribed when subscribeAllByDefault is set, so
+// clients that never subscribe keep receiving everything; without it a
+// connection receives no live messages until it subscribes.
+var (
+	subscribeAllByDefault = envBool("SUBSCRIBE_ALL_BY_DEFAULT", true)
+	maxSubscriptions      = envInt("MAX_SUBSCRIPTIONS", 1000) // Conversations a connection may subscribe to or unsubscribe from
+)
+
+func init() {
+	if maxSubscriptions <= 0 {
+		log.Fatalf("MAX_SUBSCRIPTIONS (%d) must be positive", maxSubscriptions)
+	}
+}
+
+// subscribeRequest is the data of an inbound subscribe or unsubscribe
+// frame, and of the frame answering it: exactly one of a peer or a room.
+// The IDs may also sit beside the frame's type.
+type subscribeRequest struct {
+	PeerID int64 `json:"peerId,omitempty"`
+	RoomID int64 `json:"roomId,omitempty"`
+}
+
+// conversationID returns the ID of the conversation the request names for
+// userID.
+func (r subscribeRequest) conversationID(userID int64) string {
+	if r.RoomID != 0 {
+		return roomConversationID(r.RoomID)
+	}
+	return directConversationID(userID, r.PeerID)
+}
+
+// messageConversationID returns the ID of the direct conversation or room
+// of message, whether or not it was stored with one.
+func messageConversationID(message Message) string {
+	if message.RoomID != 0 {
+		return roomConversationID(message.RoomID)
+	}
+	return directConversationID(message.SenderID, message.RecipientID)
+}
+
+// subscribedTo reports whether live messages of the conversation of message
+// may be pushed to the connection.
+func (c *connEntry) subscribedTo(message Message) bool {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	if subscribed, ok := c.subs[messageConversationID(message)]; ok {
+		return subscribed
+	}
+	return subscribeAllByDefault
+}
+
+// subscribe records whether the connection wants live messages of the
+// conversation with id, and reports false when it already tracks
+// maxSubscriptions others.
+func (c *connEntry) subscribe(id string, subscribed bool) bool {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	if _, ok := c.subs[id]; !ok && len(c.subs) >= maxSubscriptions {
+		return false
+	}
+	if c.subs == nil {
+		c.subs = make(map[string]bool)
+	}
+	c.subs[id] = subscribed
+	return true
+}
+
+// handleSubscribe subscribes the connection to a conversation, or
+// unsubscribes it when subscribed is false. Subscriptions store nothing, so
+// only the rate limit applies.
+func (s *session) handleSubscribe(frame, data []byte, subscribed bool) bool {
+	if reason := s.checkRate(); reason != "" {
+		return s.reject(reason)
+	}
+	var req subscribeRequest
+	err := json.Unmarshal(frame, &req)
+	if err == nil && req.PeerID == 0 && req.RoomID == 0 && len(data) > 0 {
+		err = json.Unmarshal(data, &req)
+	}
+	if err != nil || req.PeerID < 0 || req.RoomID < 0 || (req.PeerID == 0) == (req.RoomID == 0) {
+		return s.reject("invalid_subscription")
+	}
+
+	if !s.client.subscribe(req.conversationID(s.claims.ID), subscribed) {
+		return s.reject("too_many_subscriptions")
+	}
+	frameType := envelopeSubscribe
+	if !subscribed {
+		frameType = envelopeUnsubscribe
+	}
+	return s.reply(Frame{Type: frameType, Data: req})
+}
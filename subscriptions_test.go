@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSubscriptions(t *testing.T) {
+	claims := &JWTClaims{ID: 801}
+	entry, client := newTestConn(t, claims, nil)
+	hub.Register(entry)
+	t.Cleanup(func() { hub.Unregister(entry) })
+	s := newSession(context.Background(), entry, claims)
+	send := func(frame string) string {
+		t.Helper()
+		if !s.handleFrame([]byte(frame)) {
+			t.Fatalf("%s ended the session", frame)
+		}
+		return readReply(t, client).Type
+	}
+	fromPeer := Message{ID: 1, Tenant: defaultTenant, SenderID: 802, RecipientID: 801, Content: "hi"}
+	fromRoom := Message{ID: 2, Tenant: defaultTenant, SenderID: 803, RoomID: 9, Content: "all"}
+	pushed := func(message Message) bool {
+		t.Helper()
+		return sendToSockets(defaultTenant, 801, nil, message) == 1
+	}
+
+	// Subscribed to everything by default
+	if !pushed(fromPeer) || !pushed(fromRoom) {
+		t.Fatal("default subscriptions dropped a live message")
+	}
+	readFrame(t, client)
+	readFrame(t, client)
+
+	if frameType := send(`{"type":"unsubscribe","peerId":802}`); frameType != envelopeUnsubscribe {
+		t.Fatalf("unsubscribe got %s", frameType)
+	}
+	if frameType := send(`{"type":"unsubscribe","data":{"roomId":9}}`); frameType != envelopeUnsubscribe {
+		t.Fatalf("unsubscribe got %s", frameType)
+	}
+	if pushed(fromPeer) || pushed(fromRoom) {
+		t.Error("message of an unsubscribed conversation was pushed")
+	}
+	// The sender's own echo belongs to the same conversation
+	if pushed(Message{ID: 3, Tenant: defaultTenant, SenderID: 801, RecipientID: 802}) {
+		t.Error("echo of an unsubscribed conversation was pushed")
+	}
+	if !pushed(Message{ID: 4, Tenant: defaultTenant, SenderID: 804, RecipientID: 801}) {
+		t.Error("message of another conversation was dropped")
+	}
+	readFrame(t, client)
+
+	if frameType := send(`{"type":"subscribe","peerId":802}`); frameType != envelopeSubscribe {
+		t.Fatalf("subscribe got %s", frameType)
+	}
+	if !pushed(fromPeer) {
+		t.Error("resubscribed conversation was dropped")
+	}
+	readFrame(t, client)
+
+	for _, frame := range []string{`{"type":"subscribe"}`, `{"type":"subscribe","peerId":802,"roomId":9}`, `{"type":"subscribe","peerId":-1}`} {
+		s.handleFrame([]byte(frame))
+		if reason := readErrorReason(t, client); reason != "invalid_subscription" {
+			t.Errorf("%s: reason = %q, want invalid_subscription", frame, reason)
+		}
+	}
+}
+
+func TestSubscriptionsOptIn(t *testing.T) {
+	savedDefault, savedMax := subscribeAllByDefault, maxSubscriptions
+	subscribeAllByDefault, maxSubscriptions = false, 1
+	t.Cleanup(func() { subscribeAllByDefault, maxSubscriptions = savedDefault, savedMax })
+
+	claims := &JWTClaims{ID: 811}
+	entry, client := newTestConn(t, claims, nil)
+	hub.Register(entry)
+	t.Cleanup(func() { hub.Unregister(entry) })
+	s := newSession(context.Background(), entry, claims)
+
+	message := Message{ID: 1, Tenant: defaultTenant, SenderID: 812, RecipientID: 811, Content: "hi"}
+	if sendToSockets(defaultTenant, 811, nil, message) != 0 {
+		t.Fatal("message pushed before any subscription")
+	}
+	s.handleFrame([]byte(`{"type":"subscribe","peerId":812}`))
+	readReply(t, client)
+	if sendToSockets(defaultTenant, 811, nil, message) != 1 {
+		t.Error("subscribed conversation was dropped")
+	}
+	readFrame(t, client)
+
+	s.handleFrame([]byte(`{"type":"subscribe","peerId":813}`))
+	if reason := readErrorReason(t, client); reason != "too_many_subscriptions" {
+		t.Errorf("reason = %q, want too_many_subscriptions", reason)
+	}
+}
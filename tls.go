@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+)
+
+// TLS is enabled when both TLS_CERT_FILE and TLS_KEY_FILE are set, so the
+// server speaks wss:// without a terminating proxy in front of it.
+var (
+	tlsCertFile = envString("TLS_CERT_FILE", "")
+	tlsKeyFile  = envString("TLS_KEY_FILE", "")
+	tlsEnabled  = checkTLSFiles(tlsCertFile, tlsKeyFile)
+
+	tlsMinVersion = parseTLSVersion(envString("TLS_MIN_VERSION", "1.2")) // Oldest protocol version accepted
+)
+
+func checkTLSFiles(cert, key string) bool {
+	if (cert == "") != (key == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	return cert != ""
+}
+
+func parseTLSVersion(name string) uint16 {
+	switch name {
+	case "1.2":
+		return tls.VersionTLS12
+	case "1.3":
+		return tls.VersionTLS13
+	}
+	log.Fatalf("Unknown TLS_MIN_VERSION %q: want 1.2 or 1.3", name)
+	return 0
+}
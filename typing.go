@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const typingDebounce = time.Second // Minimum gap between typing frames for one conversation
+
+// typingTTL is how long a typing event keeps its sender listed as typing
+// unless refreshed.
+var typingTTL = envDuration("TYPING_TTL", 5*time.Second)
+
+func init() {
+	if typingTTL <= 0 {
+		log.Fatalf("TYPING_TTL (%s) must be positive", typingTTL)
+	}
+}
+
+// typingRequest is the data of an inbound typing frame: exactly one of a
+// recipient or a room.
+type typingRequest struct {
+	RecipientID int64 `json:"recipientId,omitempty"`
+	RoomID      int64 `json:"roomId,omitempty"`
+}
+
+// typingEvent is the data of a typing frame forwarded to the recipient.
+type typingEvent struct {
+	SenderID int64 `json:"senderId"`
+}
+
+// roomTypingEvent is the data of a typing frame sent to room members: every
+// member currently typing, the receiving member included. An empty list
+// means nobody is typing any more.
+type roomTypingEvent struct {
+	ConversationID string  `json:"conversationId"`
+	Typers         []int64 `json:"typers"`
+}
+
+// typingState is the typing activity in one conversation.
+type typingState struct {
+	typers   map[int64]time.Time // Typer -> when their typing expires
+	lastSent time.Time           // When members were last told
+	timer    *time.Timer         // Next send, nil when none is scheduled
+	nextAt   time.Time           // When timer fires
+	send     func(typers []int64)
+}
+
+// typingTracker aggregates typing events per conversation. Members get at
+// most one frame per typingDebounce: the first event in a quiet period goes
+// out at once, and later ones are merged into a single frame at the end of
+// the window, so the latest state is never dropped. Typers expire after
+// typingTTL, which also triggers a frame.
+type typingTracker struct {
+	mu            sync.Mutex
+	conversations map[string]*typingState
+}
+
+var typing = &typingTracker{conversations: make(map[string]*typingState)}
+
+// touch records that userID is typing in the conversation with key, and
+// makes sure its members are told within typingDebounce. send delivers
+// the list of typers; it runs without the tracker's lock held.
+func (t *typingTracker) touch(key string, userID int64, now time.Time, send func(typers []int64)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.conversations[key]
+	if state == nil {
+		state = &typingState{typers: make(map[int64]time.Time), send: send}
+		t.conversations[key] = state
+	}
+	state.typers[userID] = now.Add(typingTTL)
+
+	due := state.lastSent.Add(typingDebounce)
+	if due.Before(now) {
+		due = now
+	}
+	t.schedule(key, state, due, now)
+}
+
+// schedule makes the next send of state happen no later than at.
+func (t *typingTracker) schedule(key string, state *typingState, at, now time.Time) {
+	if state.timer != nil {
+		if !state.nextAt.After(at) {
+			return
+		}
+		state.timer.Stop()
+	}
+	state.nextAt = at
+	state.timer = time.AfterFunc(at.Sub(now), func() { t.flush(key, state) })
+}
+
+// flush sends the current typers of a conversation, dropping expired ones,
+// and schedules the next send for when the earliest remaining one expires.
+func (t *typingTracker) flush(key string, state *typingState) {
+	t.mu.Lock()
+	if t.conversations[key] != state {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	state.timer = nil
+	state.lastSent = now
+	typers := make([]int64, 0, len(state.typers))
+	var earliest time.Time
+	for userID, expires := range state.typers {
+		if !expires.After(now) {
+			delete(state.typers, userID)
+			continue
+		}
+		typers = append(typers, userID)
+		if earliest.IsZero() || expires.Before(earliest) {
+			earliest = expires
+		}
+	}
+	if len(typers) == 0 {
+		delete(t.conversations, key)
+	} else {
+		t.schedule(key, state, earliest, now)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(typers, func(i, j int) bool { return typers[i] < typers[j] })
+	state.send(typers)
+}
+
+// handleTyping forwards a typing indicator. Typing events are ephemeral and
+// never stored, so maintenance mode does not block them, but they count
+// against the connection's rate limit. Direct recipients get a typing frame
+// naming the sender; room members get the aggregated list of typers.
+// Offline or long-polling users simply miss the indicator.
+func (s *session) handleTyping(data []byte) bool {
+	if reason := s.checkRate(); reason != "" {
+		return s.reject(reason)
+	}
+	var req typingRequest
+	if err := json.Unmarshal(data, &req); err != nil || (req.RecipientID == 0) == (req.RoomID == 0) {
+		return s.reject("invalid_typing")
+	}
+	tenant, senderID := s.claims.TenantID(), s.claims.ID
+
+	if req.RoomID == 0 {
+		key := fmt.Sprintf("%s|%d>%d", tenant, senderID, req.RecipientID)
+		typing.touch(key, senderID, time.Now(), func(typers []int64) {
+			if len(typers) > 0 {
+				frame := Frame{Type: envelopeTyping, Data: typingEvent{SenderID: senderID}}
+				sendToSockets(tenant, req.RecipientID, nil, frame)
+			}
+		})
+		return true
+	}
+
+	member, err := isRoomMember(s.ctx, tenant, senderID, req.RoomID)
+	if err != nil {
+		slog.Error("Room membership check error", "error", err)
+		return s.reject("typing_failed")
+	}
+	if !member {
+		return s.reject("not_member")
+	}
+	key := fmt.Sprintf("%s|%s", tenant, roomConversationID(req.RoomID))
+	typing.touch(key, senderID, time.Now(), func(typers []int64) {
+		sendRoomTyping(tenant, req.RoomID, typers)
+	})
+	return true
+}
+
+// sendRoomTyping tells every online member of a room who is typing in it.
+func sendRoomTyping(tenant string, roomID int64, typers []int64) {
+	members, err := roomMembers(tenant, roomID)
+	if err != nil {
+		slog.Error("Room member lookup error", "room_id", roomID, "error", err)
+		return
+	}
+	frame := Frame{Type: envelopeTyping, Data: roomTypingEvent{ConversationID: roomConversationID(roomID), Typers: typers}}
+	fanOut(len(members), func(i int) {
+		sendToSockets(tenant, members[i], nil, frame)
+	})
+}
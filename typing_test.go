@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// useTypingTracker gives the test an empty typing tracker, stopping any
+// sends still scheduled when it ends.
+func useTypingTracker(t *testing.T) {
+	t.Helper()
+	saved := typing
+	typing = &typingTracker{conversations: make(map[string]*typingState)}
+	t.Cleanup(func() {
+		typing.mu.Lock()
+		for _, state := range typing.conversations {
+			if state.timer != nil {
+				state.timer.Stop()
+			}
+		}
+		typing.mu.Unlock()
+		typing = saved
+	})
+}
+
+func TestTypingTrackerMergesWindow(t *testing.T) {
+	saved := typingTTL
+	typingTTL = 1500 * time.Millisecond
+	t.Cleanup(func() { typingTTL = saved })
+
+	tracker := &typingTracker{conversations: make(map[string]*typingState)}
+	sent := make(chan []int64, 10)
+	send := func(typers []int64) { sent <- typers }
+	receive := func(within time.Duration) []int64 {
+		t.Helper()
+		select {
+		case typers := <-sent:
+			return typers
+		case <-time.After(within):
+			t.Fatal("no typing frame sent")
+			return nil
+		}
+	}
+
+	start := time.Now()
+	tracker.touch("room", 1, time.Now(), send)
+	if typers := receive(200 * time.Millisecond); !slices.Equal(typers, []int64{1}) {
+		t.Fatalf("first event sent %v, want [1]", typers)
+	}
+
+	// Both land in the debounce window and go out together at its end
+	tracker.touch("room", 3, time.Now(), send)
+	tracker.touch("room", 2, time.Now(), send)
+	typers := receive(2 * time.Second)
+	if !slices.Equal(typers, []int64{1, 2, 3}) {
+		t.Errorf("window sent %v, want [1 2 3]", typers)
+	}
+	if elapsed := time.Since(start); elapsed < typingDebounce-50*time.Millisecond {
+		t.Errorf("merged frame sent after %s, inside the debounce window", elapsed)
+	}
+
+	if typers := receive(2 * time.Second); len(typers) != 0 {
+		t.Errorf("after expiry sent %v, want nobody typing", typers)
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if len(tracker.conversations) != 0 {
+		t.Errorf("%d conversations still tracked after everyone stopped typing", len(tracker.conversations))
+	}
+}
+
+func TestTypingRateLimited(t *testing.T) {
+	useTypingTracker(t)
+	recipient, recipientClient := newTestConn(t, &JWTClaims{ID: 902}, nil)
+	hub.Register(recipient)
+	t.Cleanup(func() { hub.Unregister(recipient) })
+
+	claims := &JWTClaims{ID: 901}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+	s.limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+
+	// Typing changes nothing stored, so maintenance does not stop it
+	maintenanceMode.Store(true)
+	ok := s.handleFrame([]byte(`{"type":"typing","data":{"recipientId":902}}`))
+	maintenanceMode.Store(false)
+	if !ok {
+		t.Fatal("typing frame ended the session")
+	}
+	frameType, data := readFrame(t, recipientClient)
+	var event typingEvent
+	json.Unmarshal(data, &event)
+	if frameType != envelopeTyping || event.SenderID != 901 {
+		t.Errorf("recipient got %s %s, want typing from 901", frameType, data)
+	}
+
+	if !s.handleFrame([]byte(`{"type":"typing","data":{"recipientId":902}}`)) {
+		t.Fatal("typing frame ended the session")
+	}
+	if frameType, _ := readFrame(t, client); frameType != "backpressure" {
+		t.Errorf("got %s frame, want backpressure", frameType)
+	}
+	if reason := readErrorReason(t, client); reason != "rate_limited" {
+		t.Errorf("reason = %q, want rate_limited", reason)
+	}
+
+	for _, frame := range []string{`{"type":"typing","data":{}}`, `{"type":"typing","data":{"recipientId":902,"roomId":7}}`} {
+		s.limiter = rate.NewLimiter(rate.Inf, 1)
+		s.handleFrame([]byte(frame))
+		if reason := readErrorReason(t, client); reason != "invalid_typing" {
+			t.Errorf("%s: reason = %q, want invalid_typing", frame, reason)
+		}
+	}
+}
+
+func TestRoomTypingAggregated(t *testing.T) {
+	useTestDB(t)
+	useTypingTracker(t)
+	ctx := context.Background()
+	for _, userID := range []int64{1, 2} {
+		if err := joinRoom(ctx, defaultTenant, userID, 7); err != nil {
+			t.Fatalf("joinRoom: %v", err)
+		}
+	}
+	members := make(map[int64]*session)
+	var clients []*websocket.Conn
+	for _, userID := range []int64{1, 2} {
+		claims := &JWTClaims{ID: userID}
+		entry, client := newTestConn(t, claims, nil)
+		hub.Register(entry)
+		t.Cleanup(func() { hub.Unregister(entry) })
+		members[userID] = newSession(ctx, entry, claims)
+		clients = append(clients, client)
+	}
+	outsider, outsiderClient := newTestConn(t, &JWTClaims{ID: 3}, nil)
+	hub.Register(outsider)
+	t.Cleanup(func() { hub.Unregister(outsider) })
+
+	// Both members see user 1 at once, then both typers merged a window later
+	for round, want := range [][]int64{{1}, {1, 2}} {
+		if !members[int64(round+1)].handleFrame([]byte(`{"type":"typing","data":{"roomId":7}}`)) {
+			t.Fatal("typing frame ended the session")
+		}
+		if round > 0 {
+			time.Sleep(typingDebounce)
+		}
+		for i, client := range clients {
+			frameType, data := readFrame(t, client)
+			var event roomTypingEvent
+			json.Unmarshal(data, &event)
+			if frameType != envelopeTyping || event.ConversationID != roomConversationID(7) || !slices.Equal(event.Typers, want) {
+				t.Errorf("member %d got %s %s, want typers %v", i+1, frameType, data, want)
+			}
+		}
+	}
+
+	s := newSession(ctx, outsider, &JWTClaims{ID: 3})
+	s.handleFrame([]byte(`{"type":"typing","data":{"roomId":7}}`))
+	if reason := readErrorReason(t, outsiderClient); reason != "not_member" {
+		t.Errorf("outsider: reason = %q, want not_member", reason)
+	}
+}
+
+func TestTypingForwardedNotStored(t *testing.T) {
+	useTestDB(t)
+	useTypingTracker(t)
+	recipient, recipientClient := newTestConn(t, &JWTClaims{ID: 2}, nil)
+	hub.Register(recipient)
+	t.Cleanup(func() { hub.Unregister(recipient) })
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	s := newSession(context.Background(), entry, claims)
+	if !s.handleFrame([]byte(`{"type":"typing","data":{"recipientId":2}}`)) {
+		t.Fatal("typing frame ended the session")
+	}
+
+	frameType, data := readFrame(t, recipientClient)
+	var event typingEvent
+	json.Unmarshal(data, &event)
+	if frameType != envelopeTyping || event.SenderID != 1 {
+		t.Errorf("recipient got %s %s, want typing from 1", frameType, data)
+	}
+	if n := storedCount(t); n != 0 {
+		t.Errorf("%d messages stored for a typing frame, want none", n)
+	}
+	expectNoFrame(t, client)
+}
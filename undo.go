@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Undo send. On a connection with the undoSend capability, a chat message
+// carrying a clientMsgId is held for undoWindow before it is stored or
+// delivered, and an undo frame naming that clientMsgId within the window
+// drops it. Once the window ends the message is stored like any other, and
+// undo answers too_late. Messages still held when the connection ends are
+// stored right away. Attachments are never held, since their blob is stored
+// up front.
+var undoWindow = envDuration("UNDO_WINDOW", 5*time.Second) // Zero disables holding
+
+func init() {
+	if undoWindow < 0 {
+		log.Fatalf("UNDO_WINDOW (%s) must not be negative", undoWindow)
+	}
+}
+
+// undoRequest is the data of an inbound undo frame, and of the undo frame
+// answering it. The clientMsgId may also sit beside the frame's type.
+type undoRequest struct {
+	ClientMsgID string `json:"clientMsgId"`
+}
+
+// heldEvent is the data of the held frame telling the sender its message
+// waits for the undo window before it is stored.
+type heldEvent struct {
+	ClientMsgID  string `json:"clientMsgId"`
+	ClientTempID string `json:"clientTempId,omitempty"`
+	CommitAt     int64  `json:"commitAt"` // Unix milliseconds when the message is stored
+}
+
+// heldSend is a message waiting out its undo window.
+type heldSend struct {
+	message   Message
+	requestID string // requestId of the frame that sent it, echoed on its ack
+	heldAt    time.Time
+	timer     *time.Timer
+}
+
+// heldSends are the messages of one connection waiting out their undo
+// window, by clientMsgId. Timers commit them from their own goroutines.
+type heldSends struct {
+	mu    sync.Mutex
+	sends map[string]*heldSend
+}
+
+func newHeldSends() *heldSends {
+	return &heldSends{sends: make(map[string]*heldSend)}
+}
+
+// take removes the held message with clientMsgID and reports whether it
+// was still held.
+func (h *heldSends) take(clientMsgID string) (*heldSend, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	held, ok := h.sends[clientMsgID]
+	if ok {
+		held.timer.Stop()
+		delete(h.sends, clientMsgID)
+	}
+	return held, ok
+}
+
+// takeAll removes every held message, oldest first.
+func (h *heldSends) takeAll() []*heldSend {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	all := make([]*heldSend, 0, len(h.sends))
+	for id, held := range h.sends {
+		held.timer.Stop()
+		delete(h.sends, id)
+		all = append(all, held)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].heldAt.Before(all[j].heldAt) })
+	return all
+}
+
+// holdsSends reports whether the connection holds its messages for undo.
+func (s *session) holdsSends() bool {
+	return undoWindow > 0 && s.client.caps[capUndoSend]
+}
+
+// holdSend keeps a validated message back for undoWindow, then commits it,
+// and tells the sender it is held.
+func (s *session) holdSend(message Message) bool {
+	s.seenClientIDs.Add(message.ClientMsgID)
+	held := &heldSend{message: message, requestID: s.requestID, heldAt: time.Now()}
+	commitAt := held.heldAt.Add(undoWindow)
+	s.held.mu.Lock()
+	held.timer = time.AfterFunc(undoWindow, func() { s.commitHeld(message.ClientMsgID) })
+	s.held.sends[message.ClientMsgID] = held
+	s.held.mu.Unlock()
+
+	return s.reply(Frame{Type: envelopeHeld, Data: heldEvent{
+		ClientMsgID:  message.ClientMsgID,
+		ClientTempID: message.ClientTempID,
+		CommitAt:     commitAt.UnixMilli(),
+	}})
+}
+
+// commitHeld stores and delivers a held message whose undo window ended,
+// unless it was undone meanwhile.
+func (s *session) commitHeld(clientMsgID string) {
+	if held, ok := s.held.take(clientMsgID); ok {
+		s.commit(held)
+	}
+}
+
+// commitAllHeld stores every message still held, when the connection ends.
+func (s *session) commitAllHeld() {
+	for _, held := range s.held.takeAll() {
+		s.commit(held)
+	}
+}
+
+// commit stores and delivers a held message. It runs outside the read loop,
+// so it answers through a session of its own carrying the held frame's
+// requestId, which outlives the connection's context. Maintenance mode
+// started during the window still refuses the write.
+func (s *session) commit(held *heldSend) {
+	c := &session{
+		ctx:       context.WithoutCancel(s.ctx),
+		client:    s.client,
+		claims:    s.claims,
+		requestID: held.requestID,
+	}
+
+	if maintenanceMode.Load() {
+		c.reject("maintenance")
+		return
+	}
+	stored, err := insertValidated(c.ctx, held.message)
+	if err != nil {
+		c.rejectInsert(held.message, err)
+		return
+	}
+	c.announce(stored)
+}
+
+// handleUndo drops a message still held for undo. Undo stores nothing, so
+// only the rate limit applies.
+func (s *session) handleUndo(frame, data []byte) bool {
+	if reason := s.checkRate(); reason != "" {
+		return s.reject(reason)
+	}
+	var req undoRequest
+	if err := json.Unmarshal(frame, &req); err != nil {
+		return s.reject("invalid_undo")
+	}
+	if req.ClientMsgID == "" && len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return s.reject("invalid_undo")
+		}
+	}
+	if req.ClientMsgID == "" {
+		return s.reject("invalid_undo")
+	}
+
+	if _, ok := s.held.take(req.ClientMsgID); !ok {
+		// A clientMsgId this connection used was already stored
+		if s.seenClientIDs.Contains(req.ClientMsgID) {
+			return s.reject("too_late")
+		}
+		return s.reject("not_found")
+	}
+	slog.Info("Message undone", "user_id", s.claims.ID, "client_msg_id", req.ClientMsgID)
+	return s.reply(Frame{Type: envelopeUndo, Data: req})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// storedCount returns how many messages are stored.
+func storedCount(t *testing.T) int64 {
+	t.Helper()
+	n, err := collection.CountDocuments(context.Background(), bson.D{})
+	if err != nil {
+		t.Fatalf("counting messages: %v", err)
+	}
+	return n
+}
+
+func TestUndoSend(t *testing.T) {
+	useTestDB(t)
+	saved := undoWindow
+	undoWindow = 200 * time.Millisecond
+	t.Cleanup(func() { undoWindow = saved })
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	entry.caps = parseClientCaps(capUndoSend)
+	s := newSession(context.Background(), entry, claims)
+	send := func(frame string) Envelope {
+		t.Helper()
+		if !s.handleFrame([]byte(frame)) {
+			t.Fatalf("%s ended the session", frame)
+		}
+		return readReply(t, client)
+	}
+
+	reply := send(`{"type":"message","requestId":"m1","data":{"recipientId":2,"content":"oops","clientMsgId":"a"}}`)
+	var held heldEvent
+	json.Unmarshal(reply.Data, &held)
+	if reply.Type != envelopeHeld || reply.RequestID != "m1" || held.ClientMsgID != "a" || held.CommitAt <= time.Now().UnixMilli() {
+		t.Fatalf("got %s %s for m1, want a held frame", reply.Type, reply.Data)
+	}
+	if reply = send(`{"type":"undo","clientMsgId":"a"}`); reply.Type != envelopeUndo {
+		t.Errorf("undo got %s %s, want undo", reply.Type, reply.Data)
+	}
+
+	if reply = send(`{"type":"message","requestId":"m2","data":{"recipientId":2,"content":"keep","clientMsgId":"b"}}`); reply.Type != envelopeHeld {
+		t.Fatalf("got %s for m2, want held", reply.Type)
+	}
+	// The ack comes once the window ends
+	if reply = readReply(t, client); reply.Type != envelopeAck || reply.RequestID != "m2" {
+		t.Fatalf("got %s %q after the window, want the ack of m2", reply.Type, reply.RequestID)
+	}
+	if n := storedCount(t); n != 1 {
+		t.Errorf("%d messages stored, want only the one not undone", n)
+	}
+
+	for _, c := range []struct{ frame, reason string }{
+		{`{"type":"undo","data":{"clientMsgId":"b"}}`, "too_late"},
+		{`{"type":"undo","clientMsgId":"never-sent"}`, "not_found"},
+		{`{"type":"undo","data":{}}`, "invalid_undo"},
+	} {
+		s.handleFrame([]byte(c.frame))
+		if reason := readErrorReason(t, client); reason != c.reason {
+			t.Errorf("%s: reason = %q, want %s", c.frame, reason, c.reason)
+		}
+	}
+}
+
+func TestHeldSendsCommit(t *testing.T) {
+	useTestDB(t)
+	saved := undoWindow
+	undoWindow = time.Hour
+	t.Cleanup(func() { undoWindow = saved })
+
+	claims := &JWTClaims{ID: 1}
+	entry, client := newTestConn(t, claims, nil)
+	entry.caps = parseClientCaps(capUndoSend)
+	s := newSession(context.Background(), entry, claims)
+
+	// Without a clientMsgId there is nothing to undo by, so the message is stored at once
+	s.handleFrame([]byte(`{"type":"message","data":{"recipientId":2,"content":"now"}}`))
+	if reply := readReply(t, client); reply.Type != envelopeAck {
+		t.Fatalf("got %s, want an ack", reply.Type)
+	}
+	for _, id := range []string{"x", "y"} {
+		s.handleFrame([]byte(`{"type":"message","data":{"recipientId":2,"content":"later","clientMsgId":"` + id + `"}}`))
+		if reply := readReply(t, client); reply.Type != envelopeHeld {
+			t.Fatalf("got %s, want held", reply.Type)
+		}
+	}
+
+	// Maintenance starting during the window still refuses the write
+	maintenanceMode.Store(true)
+	s.commitHeld("x")
+	maintenanceMode.Store(false)
+	if reason := readErrorReason(t, client); reason != "maintenance" {
+		t.Errorf("reason = %q, want maintenance", reason)
+	}
+
+	// Closing the connection stores what is still held
+	s.commitAllHeld()
+	if reply := readReply(t, client); reply.Type != envelopeAck {
+		t.Errorf("got %s, want the ack of y", reply.Type)
+	}
+	if n := storedCount(t); n != 2 {
+		t.Errorf("%d messages stored, want 2", n)
+	}
+}